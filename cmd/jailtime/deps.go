@@ -0,0 +1,318 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Library dependency graph output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"blichmann.eu/code/jailtime/internal/spec"
+	"blichmann.eu/code/jailtime/pkg/loader"
+)
+
+// depsNode is a library dependency graph node as written by the dot and JSON
+// output formats.
+type depsNode struct {
+	Soname  string   `json:"soname"`
+	Path    string   `json:"path,omitempty"`
+	Arch    string   `json:"arch,omitempty"`
+	Size    int64    `json:"size"`
+	Binary  bool     `json:"binary,omitempty"`
+	Shared  bool     `json:"shared,omitempty"`
+	Missing bool     `json:"missing,omitempty"`
+	Needed  []string `json:"needed,omitempty"`
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// nodeID returns a key that identifies l across the graphs of all binaries.
+func nodeID(l *loader.Library) string {
+	if l.Missing() {
+		return l.Name
+	}
+	return l.Path
+}
+
+// countUsers returns the number of binaries that use each library.
+func countUsers(roots []*loader.Library) map[string]int {
+	users := make(map[string]int)
+	for _, r := range roots {
+		r.Walk(func(l *loader.Library) {
+			if l != r {
+				users[nodeID(l)]++
+			}
+		})
+	}
+	return users
+}
+
+// mergeGraphs merges the dependency graphs of all binaries into a single
+// list of nodes, sorted by id.
+func mergeGraphs(roots []*loader.Library) (ids []string,
+	nodes map[string]*depsNode) {
+	users := countUsers(roots)
+	nodes = make(map[string]*depsNode)
+	for _, r := range roots {
+		r.Walk(func(l *loader.Library) {
+			id := nodeID(l)
+			n, ok := nodes[id]
+			if !ok {
+				n = &depsNode{
+					Soname:  l.Name,
+					Path:    l.Path,
+					Arch:    l.Arch,
+					Size:    l.Size,
+					Shared:  users[id] > 1,
+					Missing: l.Missing(),
+				}
+				for _, s := range l.Skipped {
+					n.Skipped = append(n.Skipped, s.Path)
+				}
+				nodes[id] = n
+				ids = append(ids, id)
+			}
+			if l == r {
+				n.Binary = true
+			}
+			for _, d := range l.Needed {
+				n.Needed = appendUnique(n.Needed, nodeID(d))
+			}
+		})
+	}
+	sort.Strings(ids)
+	return
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// skippedLibraries describes the files of other architectures that were
+// skipped while looking for l.
+func skippedLibraries(l *loader.Library) string {
+	var s []string
+	for _, w := range l.Skipped {
+		s = append(s, fmt.Sprintf("%s is %s", w.Path, w.Arch))
+	}
+	return strings.Join(s, ", ")
+}
+
+func describeLibrary(l *loader.Library, users map[string]int) string {
+	var desc string
+	if l.Missing() {
+		desc = fmt.Sprintf("%s => not found", l.Name)
+		if len(l.Skipped) > 0 {
+			desc += fmt.Sprintf(" (wrong architecture: %s)",
+				skippedLibraries(l))
+		}
+	} else if l.Name == l.Path && l.Arch != "" {
+		// Binaries list their architecture, libraries always match it
+		desc = fmt.Sprintf("%s (%s, %d bytes)", l.Path, l.Arch, l.Size)
+	} else if l.Name == l.Path {
+		desc = fmt.Sprintf("%s (%d bytes)", l.Path, l.Size)
+	} else {
+		desc = fmt.Sprintf("%s => %s (%d bytes)", l.Name, l.Path, l.Size)
+	}
+	if n := users[nodeID(l)]; n > 1 {
+		desc += fmt.Sprintf(" [shared by %d]", n)
+	}
+	return desc
+}
+
+func writeTree(w io.Writer, roots []*loader.Library) {
+	users := countUsers(roots)
+	for _, r := range roots {
+		expanded := make(map[*loader.Library]bool)
+		var write func(l *loader.Library, prefix, childPrefix string)
+		write = func(l *loader.Library, prefix, childPrefix string) {
+			desc := describeLibrary(l, users)
+			if expanded[l] && len(l.Needed) > 0 {
+				// Only list dependencies on first occurrence
+				desc += " ..."
+			}
+			fmt.Fprintf(w, "%s%s\n", prefix, desc)
+			if expanded[l] {
+				return
+			}
+			expanded[l] = true
+			for i, n := range l.Needed {
+				if i == len(l.Needed)-1 {
+					write(n, childPrefix+"+- ", childPrefix+"   ")
+				} else {
+					write(n, childPrefix+"+- ", childPrefix+"|  ")
+				}
+			}
+		}
+		write(r, "", "")
+	}
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func writeDot(w io.Writer, roots []*loader.Library) {
+	ids, nodes := mergeGraphs(roots)
+	fmt.Fprintf(w, "digraph deps {\n\tnode [shape=box];\n")
+	for _, id := range ids {
+		n := nodes[id]
+		var label string
+		var attrs []string
+		switch {
+		case n.Missing && len(n.Skipped) > 0:
+			label = dotQuote(n.Soname + "\\nwrong architecture")
+			attrs = append(attrs, "color=red", "fontcolor=red")
+		case n.Missing:
+			label = dotQuote(n.Soname + "\\nnot found")
+			attrs = append(attrs, "color=red", "fontcolor=red")
+		case n.Binary && n.Arch != "":
+			label = dotQuote(fmt.Sprintf("%s\\n%s, %d bytes", n.Path, n.Arch,
+				n.Size))
+			attrs = append(attrs, "shape=ellipse")
+		case n.Binary:
+			label = dotQuote(fmt.Sprintf("%s\\n%d bytes", n.Path, n.Size))
+			attrs = append(attrs, "shape=ellipse")
+		default:
+			label = dotQuote(fmt.Sprintf("%s\\n%s\\n%d bytes", n.Soname,
+				n.Path, n.Size))
+		}
+		if n.Shared {
+			attrs = append(attrs, "style=bold")
+		}
+		fmt.Fprintf(w, "\t%s [%s];\n", dotQuote(id),
+			strings.Join(append([]string{"label=" + label}, attrs...), ", "))
+	}
+	for _, id := range ids {
+		for _, d := range nodes[id].Needed {
+			fmt.Fprintf(w, "\t%s -> %s;\n", dotQuote(id), dotQuote(d))
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func writeJSON(w io.Writer, roots []*loader.Library) error {
+	ids, nodes := mergeGraphs(roots)
+	list := make([]*depsNode, len(ids))
+	for i, id := range ids {
+		list[i] = nodes[id]
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(struct {
+		Nodes []*depsNode `json:"nodes"`
+	}{list})
+}
+
+// depsBinaries returns the binaries to analyze. Arguments ending in
+// ".jailspec" are parsed and all files they copy are analyzed.
+func depsBinaries(args []string) (binaries []string, err error) {
+	for _, a := range args {
+		if !strings.HasSuffix(a, ".jailspec") {
+			binaries = append(binaries, a)
+			continue
+		}
+		var stmts spec.Statements
+		if stmts, err = spec.Parse(a); err != nil {
+			return
+		}
+		for _, s := range stmts {
+			if f, ok := s.(spec.RegularFile); ok {
+				binaries = append(binaries, f.Source())
+			}
+		}
+	}
+	return
+}
+
+// depsGraphs returns the dependency graphs of the binaries in args. Like in
+// the main command, all paths are inside the root of r, including the
+// sources of spec files.
+func depsGraphs(r *loader.Resolver, args []string) ([]*loader.Library,
+	error) {
+	binaries, err := depsBinaries(args)
+	if err != nil {
+		return nil, err
+	}
+	return r.ResolveAll(binaries)
+}
+
+// runDeps implements the "deps" command, which prints the library
+// dependency graph of binaries.
+func runDeps(args []string) {
+	fs := flag.NewFlagSet("deps", flag.ExitOnError)
+	format := fs.String("format", "tree", "output format, one of 'tree', "+
+		"'dot' or 'json'")
+	depsSysroot := fs.String("sysroot", "", "use DIR as the root directory "+
+		"for all sources and library lookups")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s deps [OPTION]... FILE...\n"+
+			"Print the shared library dependencies of binary FILEs. FILEs "+
+			"ending in\n"+
+			".jailspec are parsed and the files they copy are used "+
+			"instead.\n\n", os.Args[0])
+		fs.VisitAll(func(f *flag.Flag) {
+			fmt.Printf("      --%-23s %s\n", f.Name, f.Usage)
+		})
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatalf("missing file operand\nTry '%s deps --help' for more "+
+			"information.\n", os.Args[0])
+	}
+
+	// Binaries often share libraries, parse each of them only once
+	roots, err := depsGraphs(loader.NewResolver(
+		newLoaderConfig(*depsSysroot)), fs.Args())
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	switch *format {
+	case "tree":
+		writeTree(os.Stdout, roots)
+	case "dot":
+		writeDot(os.Stdout, roots)
+	case "json":
+		err = writeJSON(os.Stdout, roots)
+	default:
+		log.Fatalf("invalid output format: %s\n", *format)
+	}
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+}
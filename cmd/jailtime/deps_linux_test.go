@@ -0,0 +1,77 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for the dependency graphs of spec files
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blichmann.eu/code/jailtime/pkg/loader"
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+func TestDepsGraphsSysroot(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// The source only exists inside the sysroot. Files that are not ELF
+	// binaries have no dependencies, but are still listed.
+	root := filepath.Join(td, "root")
+	tool := filepath.Join(root, "jailtime_test", "tool")
+	if err := os.MkdirAll(filepath.Dir(tool), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tool, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := filepath.Join(td, "tool.jailspec")
+	if err := ioutil.WriteFile(s, []byte("/jailtime_test/tool\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := loader.NewResolver(loader.NewConfig(sysroot.Root(root)))
+	graphs, err := depsGraphs(r, []string{s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graphs) != 1 {
+		t.Fatalf("expected 1 graph, actual %d", len(graphs))
+	}
+	if p := graphs[0].Path; p != "/jailtime_test/tool" {
+		t.Errorf("expected /jailtime_test/tool, actual %s", p)
+	}
+	if graphs[0].Size != 10 {
+		t.Errorf("expected 10 bytes, actual %d", graphs[0].Size)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for the library dependency graph output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"blichmann.eu/code/jailtime/pkg/loader"
+)
+
+// testGraphs returns the graphs of two binaries that share the C library.
+// The first binary also needs a library that only exists for i386.
+func testGraphs() []*loader.Library {
+	ld := &loader.Library{Name: "ld.so", Path: "/lib/ld.so", Size: 5}
+	libc := &loader.Library{Name: "libc.so.6", Path: "/lib/libc.so.6",
+		Size: 100, Needed: []*loader.Library{ld}}
+	libm := &loader.Library{Name: "libm.so.6", Skipped: []*loader.Library{
+		{Name: "libm.so.6", Path: "/lib32/libm.so.6", Arch: "i386"}}}
+	return []*loader.Library{
+		{Name: "/bin/a", Path: "/bin/a", Arch: "x86_64", Size: 10,
+			Needed: []*loader.Library{libc, libm}},
+		{Name: "/bin/b", Path: "/bin/b", Arch: "x86_64", Size: 20,
+			Needed: []*loader.Library{libc}},
+	}
+}
+
+func TestMergeGraphs(t *testing.T) {
+	ids, nodes := mergeGraphs(testGraphs())
+	expected := []string{"/bin/a", "/bin/b", "/lib/ld.so", "/lib/libc.so.6",
+		"libm.so.6"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, actual %v", expected, ids)
+	}
+	for _, test := range []struct {
+		id       string
+		expected depsNode
+	}{
+		{"/bin/a", depsNode{Soname: "/bin/a", Path: "/bin/a",
+			Arch: "x86_64", Size: 10, Binary: true,
+			Needed: []string{"/lib/libc.so.6", "libm.so.6"}}},
+		{"/bin/b", depsNode{Soname: "/bin/b", Path: "/bin/b",
+			Arch: "x86_64", Size: 20, Binary: true,
+			Needed: []string{"/lib/libc.so.6"}}},
+		{"/lib/ld.so", depsNode{Soname: "ld.so", Path: "/lib/ld.so",
+			Size: 5, Shared: true}},
+		{"/lib/libc.so.6", depsNode{Soname: "libc.so.6",
+			Path: "/lib/libc.so.6", Size: 100, Shared: true,
+			Needed: []string{"/lib/ld.so"}}},
+		{"libm.so.6", depsNode{Soname: "libm.so.6", Missing: true,
+			Skipped: []string{"/lib32/libm.so.6"}}},
+	} {
+		if n := nodes[test.id]; n == nil {
+			t.Errorf("expected node %s, actual none", test.id)
+		} else if !reflect.DeepEqual(*n, test.expected) {
+			t.Errorf("expected %+v, actual %+v", test.expected, *n)
+		}
+	}
+}
+
+func TestWriteTree(t *testing.T) {
+	var b bytes.Buffer
+	writeTree(&b, testGraphs())
+	expected := `/bin/a (x86_64, 10 bytes)
++- libc.so.6 => /lib/libc.so.6 (100 bytes) [shared by 2]
+|  +- ld.so => /lib/ld.so (5 bytes) [shared by 2]
++- libm.so.6 => not found (wrong architecture: /lib32/libm.so.6 is i386)
+/bin/b (x86_64, 20 bytes)
++- libc.so.6 => /lib/libc.so.6 (100 bytes) [shared by 2]
+   +- ld.so => /lib/ld.so (5 bytes) [shared by 2]
+`
+	if actual := b.String(); actual != expected {
+		t.Errorf("expected %s, actual %s", expected, actual)
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	var b bytes.Buffer
+	writeDot(&b, testGraphs())
+	expected := `digraph deps {
+	node [shape=box];
+	"/bin/a" [label="/bin/a\nx86_64, 10 bytes", shape=ellipse];
+	"/bin/b" [label="/bin/b\nx86_64, 20 bytes", shape=ellipse];
+	"/lib/ld.so" [label="ld.so\n/lib/ld.so\n5 bytes", style=bold];
+	"/lib/libc.so.6" [label="libc.so.6\n/lib/libc.so.6\n100 bytes", ` +
+		`style=bold];
+	"libm.so.6" [label="libm.so.6\nwrong architecture", color=red, ` +
+		`fontcolor=red];
+	"/bin/a" -> "/lib/libc.so.6";
+	"/bin/a" -> "libm.so.6";
+	"/bin/b" -> "/lib/libc.so.6";
+	"/lib/libc.so.6" -> "/lib/ld.so";
+}
+`
+	if actual := b.String(); actual != expected {
+		t.Errorf("expected %s, actual %s", expected, actual)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeJSON(&b, testGraphs()); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{
+  "nodes": [
+    {
+      "soname": "/bin/a",
+      "path": "/bin/a",
+      "arch": "x86_64",
+      "size": 10,
+      "binary": true,
+      "needed": [
+        "/lib/libc.so.6",
+        "libm.so.6"
+      ]
+    },
+    {
+      "soname": "/bin/b",
+      "path": "/bin/b",
+      "arch": "x86_64",
+      "size": 20,
+      "binary": true,
+      "needed": [
+        "/lib/libc.so.6"
+      ]
+    },
+    {
+      "soname": "ld.so",
+      "path": "/lib/ld.so",
+      "size": 5,
+      "shared": true
+    },
+    {
+      "soname": "libc.so.6",
+      "path": "/lib/libc.so.6",
+      "size": 100,
+      "shared": true,
+      "needed": [
+        "/lib/ld.so"
+      ]
+    },
+    {
+      "soname": "libm.so.6",
+      "size": 0,
+      "missing": true,
+      "skipped": [
+        "/lib32/libm.so.6"
+      ]
+    }
+  ]
+}
+`
+	if actual := b.String(); actual != expected {
+		t.Errorf("expected %s, actual %s", expected, actual)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Incremental chroot updates
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"blichmann.eu/code/jailtime/internal/action"
+	"blichmann.eu/code/jailtime/internal/spec"
+	"blichmann.eu/code/jailtime/pkg/elfpatch"
+	"blichmann.eu/code/jailtime/pkg/store"
+)
+
+// outcome tells what applying a statement did to its target.
+type outcome int
+
+const (
+	created outcome = iota
+	updated
+	unchanged
+)
+
+// summary counts the outcomes of all targets. Targets that appear in more
+// than one statement are only counted once.
+type summary map[string]outcome
+
+func (s summary) add(target string, o outcome) {
+	if _, ok := s[target]; !ok {
+		s[target] = o
+	}
+}
+
+func (s summary) String() string {
+	var counts [unchanged + 1]int
+	for _, o := range s {
+		counts[o]++
+	}
+	return fmt.Sprintf("%d created, %d updated, %d unchanged",
+		counts[created], counts[updated], counts[unchanged])
+}
+
+// targetState returns whether the target of s needs to be created or
+// updated. With --incremental, targets that already match s are reported
+// as unchanged. sums has the hashes of the files in the chroot recorded by
+// the previous update, if any.
+func targetState(target string, s spec.Statement, lay *layout,
+	sums map[string]string) (outcome, error) {
+	if !action.Exists(target) {
+		return created, nil
+	}
+	if !*incremental {
+		return updated, nil
+	}
+	var same bool
+	var err error
+	switch stmt := s.(type) {
+	case spec.Directory:
+		same = action.DirectoryMatches(target, stmt)
+	case spec.RegularFile:
+		same, err = fileMatches(target, stmt, lay, sums[stmt.Target()])
+	case spec.Link:
+		same = action.LinkMatches(target, stmt)
+	case spec.Device:
+		same = action.DeviceMatches(target, stmt)
+	}
+	if same {
+		return unchanged, err
+	}
+	return updated, err
+}
+
+// transformed returns whether the copy of f is changed after copying, so
+// that it differs from the source.
+func transformed(f spec.RegularFile, lay *layout) bool {
+	strip, _ := stripOptions(f)
+	_, relocated := lay.relocs[f.Target()]
+	return strip || relocated
+}
+
+// fileMatches returns whether target already is an up to date copy of f. By
+// default, the size and modification time of source and target need to be
+// the same. With --compare=hash, the contents are compared instead. If sum
+// is not empty, it is the hash of target recorded in the manifest, which is
+// used instead of reading target.
+func fileMatches(target string, f spec.RegularFile, lay *layout,
+	sum string) (bool, error) {
+	tfi, err := os.Lstat(target)
+	if err != nil || !tfi.Mode().IsRegular() {
+		return false, nil
+	}
+	sfi, err := os.Stat(f.Source())
+	if err != nil {
+		return false, err
+	}
+	mode := sfi.Mode().Perm()
+	if m := f.FileAttr().Mode; m != spec.FileModeUnspecified {
+		mode = os.FileMode(m).Perm()
+	}
+	if tfi.Mode().Perm() != mode {
+		return false, nil
+	}
+	if *compareMode != "hash" {
+		// Transformed copies differ in size, but keep the modification time
+		return tfi.ModTime().Equal(sfi.ModTime()) &&
+			(tfi.Size() == sfi.Size() || transformed(f, lay)), nil
+	}
+	if !transformed(f, lay) {
+		if tfi.Size() != sfi.Size() {
+			return false, nil
+		}
+		if sum == "" {
+			if sum, err = store.Hash(target); err != nil {
+				return false, err
+			}
+		}
+		expected, err := store.Hash(f.Source())
+		return err == nil && sum == expected, err
+	}
+	expected, err := expectedContent(f, lay)
+	if err != nil {
+		return false, err
+	}
+	if sum != "" {
+		h := sha256.Sum256(expected)
+		return sum == hex.EncodeToString(h[:]), nil
+	}
+	actual, err := ioutil.ReadFile(target)
+	return err == nil && bytes.Equal(actual, expected), err
+}
+
+// expectedContent returns the content the copy of f has after stripping and
+// relocation.
+func expectedContent(f spec.RegularFile, lay *layout) ([]byte, error) {
+	b, err := ioutil.ReadFile(f.Source())
+	if err != nil || !bytes.HasPrefix(b, []byte(elf.ELFMAG)) {
+		return b, err
+	}
+	if strip, all := stripOptions(f); strip {
+		if b, err = elfpatch.Strip(b, all); err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Source(), err)
+		}
+	}
+	if r, ok := lay.relocs[f.Target()]; ok {
+		if b, err = elfpatch.Rewrite(b, r.patch); err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Source(), err)
+		}
+	}
+	return b, nil
+}
+
+// keepModTime gives the copy of f at target the modification time of its
+// source, which later runs with --incremental compare.
+func keepModTime(target string, f spec.RegularFile) error {
+	fi, err := os.Stat(f.Source())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
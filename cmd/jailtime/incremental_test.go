@@ -0,0 +1,245 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for incremental updates
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"blichmann.eu/code/jailtime/internal/action"
+	"blichmann.eu/code/jailtime/internal/sink"
+	"blichmann.eu/code/jailtime/internal/spec"
+	"blichmann.eu/code/jailtime/pkg/elfpatch"
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+// parseSpec parses the jailspec in the string s.
+func parseSpec(t *testing.T, dir, s string) spec.Statements {
+	t.Helper()
+	filename := filepath.Join(dir, "test.jailspec")
+	if err := ioutil.WriteFile(filename, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stmts, err := spec.Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stmts
+}
+
+// setFlags sets the --incremental and --compare flags until the returned
+// function is called.
+func setFlags(inc bool, compare string) func() {
+	oldInc, oldCompare := *incremental, *compareMode
+	*incremental, *compareMode = inc, compare
+	return func() { *incremental, *compareMode = oldInc, oldCompare }
+}
+
+func TestTargetState(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	defer setFlags(true, "size-mtime")()
+	defer syscall.Umask(syscall.Umask(022))
+
+	source := filepath.Join(td, "source")
+	if err := ioutil.WriteFile(source, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chroot := filepath.Join(td, "chroot")
+	if err := os.Mkdir(chroot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := sink.NewDir(chroot)
+	lay := newLayout(sysroot.Root(""))
+	for _, s := range parseSpec(t, td, source+" /file\n"+
+		"/fifo p 0 0 0666\n"+
+		"/dir/ 0700\n") {
+		target := filepath.Join(chroot, s.Target())
+		if o, err := targetState(target, s, lay, nil); err != nil {
+			t.Fatal(err)
+		} else if o != created {
+			t.Errorf("%s: expected created, actual %d", s.Target(), o)
+		}
+		switch stmt := s.(type) {
+		case spec.Directory:
+			err = action.Directory(out, stmt)
+		case spec.RegularFile:
+			if _, err = action.RegularFile(out, stmt, nil); err == nil {
+				err = keepModTime(target, stmt)
+			}
+		case spec.Device:
+			err = action.Device(out, stmt)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Modes are kept despite the umask
+		if o, err := targetState(target, s, lay, nil); err != nil {
+			t.Fatal(err)
+		} else if o != unchanged {
+			t.Errorf("%s: expected unchanged, actual %d", s.Target(), o)
+		}
+	}
+
+	// Changing the source updates the copy
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(source, later, later); err != nil {
+		t.Fatal(err)
+	}
+	f := spec.NewRegularFile(source, "/file")
+	target := filepath.Join(chroot, "file")
+	if o, err := targetState(target, f, lay, nil); err != nil || o != updated {
+		t.Errorf("expected updated, actual %d (%v)", o, err)
+	}
+	defer setFlags(false, "size-mtime")()
+	if err := keepModTime(target, f); err != nil {
+		t.Fatal(err)
+	}
+	if o, err := targetState(target, f, lay, nil); err != nil || o != updated {
+		t.Errorf("expected updated without --incremental, actual %d (%v)",
+			o, err)
+	}
+}
+
+func TestFileMatchesHash(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	defer setFlags(true, "hash")()
+
+	source := filepath.Join(td, "source")
+	target := filepath.Join(td, "target")
+	f := spec.NewRegularFile(source, "/target")
+	lay := newLayout(sysroot.Root(""))
+	const dataSum = "3a6eb0790f39ac87c94f3856b2dd2c5d" +
+		"110e6811602261a9a923d3bb23adc8b7"
+	for _, test := range []struct {
+		source, target string
+		sum            string // Recorded in the manifest
+		expected       bool
+	}{
+		{"data", "data", "", true},
+		{"data", "date", "", false},
+		{"data", "longer", "", false},
+		// The recorded hash is used instead of the contents of the target
+		{"data", "date", dataSum, true},
+		{"date", "data", dataSum, false},
+	} {
+		if err := ioutil.WriteFile(source, []byte(test.source),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+		// Modification times do not matter
+		if err := ioutil.WriteFile(target, []byte(test.target),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+		if actual, err := fileMatches(target, f, lay, test.sum); err != nil {
+			t.Fatal(err)
+		} else if actual != test.expected {
+			t.Errorf("%s and %s: expected %t, actual %t", test.source,
+				test.target, test.expected, actual)
+		}
+	}
+}
+
+func TestExpectedContent(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	lay := newLayout(sysroot.Root(""))
+	source := filepath.Join(td, "script")
+	if err := ioutil.WriteFile(source, []byte("#!/bin/sh\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+	// Only ELF files are stripped
+	f := spec.NewRegularFile(source, "/script").WithOptions(
+		spec.Options{StripDebug: true})
+	if b, err := expectedContent(f, lay); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "#!/bin/sh\n" {
+		t.Errorf("expected unchanged script, actual %q", b)
+	}
+
+	// Relocated copies get a new interpreter
+	const ls = "/bin/ls"
+	e, err := elf.Open(ls)
+	if err != nil {
+		t.Skip(err)
+	}
+	e.Close()
+	orig, err := ioutil.ReadFile(ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = spec.NewRegularFile(ls, "/bin/ls")
+	if b, err := expectedContent(f, lay); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, orig) {
+		t.Error("expected unchanged binary without relocation")
+	}
+	const interp = "/opt/bundle/lib/ld.so"
+	lay.relocs["/bin/ls"] = &relocation{patch: elfpatch.Patch{
+		Interp: interp}}
+	b, err := expectedContent(f, lay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range e.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		actual, err := ioutil.ReadAll(p.Open())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := string(bytes.TrimRight(actual, "\x00")); actual !=
+			interp {
+			t.Errorf("expected %s, actual %s", interp, actual)
+		}
+	}
+}
@@ -28,16 +28,28 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 
 	"blichmann.eu/code/jailtime/internal/action"
+	"blichmann.eu/code/jailtime/internal/executor"
+	"blichmann.eu/code/jailtime/internal/sink"
 	"blichmann.eu/code/jailtime/internal/spec"
 	"blichmann.eu/code/jailtime/pkg/copy"
+	"blichmann.eu/code/jailtime/pkg/elfpatch"
 	"blichmann.eu/code/jailtime/pkg/loader"
+	"blichmann.eu/code/jailtime/pkg/store"
+	"blichmann.eu/code/jailtime/pkg/sysroot"
 )
 
 var (
@@ -50,27 +62,172 @@ var (
 		"existing destination file before\n"+
 		"                                  attempting to open it (contrast "+
 		"with --force)")
-	reflink = flag.Bool("reflink", false, "perform lightweight copies using "+
-		"CoW")
-	verbose = flag.Bool("verbose", false, "explain what is being done")
-	dryRun  = flag.Bool("dry-run", false, "don't do anything, just print "+
+	noClobber = flag.Bool("no-clobber", false, "do not overwrite existing "+
+		"files, links and\n"+
+		"                                  devices")
+	oneFilesystem = flag.Bool("one-filesystem", false, "do not write "+
+		"through mount points\n"+
+		"                                  inside TARGET")
+	output = flag.String("output", "", "write an archive instead of TARGET, "+
+		"as\n"+
+		"                                  FORMAT:FILE with FORMAT 'tar', "+
+		"'cpio', 'oci'\n"+
+		"                                  or 'oci-archive' (FILE[:TAG] "+
+		"for images)")
+	reflink      = reflinkValue(copy.ReflinkNo)
+	preserve     preserveValue
+	progressMode progressValue
+	keepSymlinks = flag.Bool("keep-symlinks", false, "recreate symlinks to "+
+		"files and libraries\n"+
+		"                                  instead of copying their targets")
+	searchPath = flag.String("path", "/usr/local/bin:/usr/bin:/bin", "search "+
+		"path for script interpreters run\n"+
+		"                                  via env(1)")
+	sysrootDir = flag.String("sysroot", "", "use DIR as the root directory "+
+		"for all\n"+
+		"                                  sources and library lookups")
+	archList = flag.String("arch", "", "only allow binaries for the "+
+		"comma-separated\n"+
+		"                                  list of ARCHs, like 'x86_64,i386'")
+	ldConfig = flag.Bool("ldconfig", false, "write /etc/ld.so.conf and "+
+		"/etc/ld.so.cache for\n"+
+		"                                  the libraries in the chroot")
+	verifyCopies = flag.Bool("verify", false, "compare the SHA-256 hashes "+
+		"of each copy and\n"+
+		"                                  its source, copying once more "+
+		"if they differ")
+	manifestFile = flag.String("manifest", "", "record the SHA-256 hash "+
+		"of each file in the\n"+
+		"                                  chroot in FILE, in the format "+
+		"of sha256sum(1)")
+	storeDir = flag.String("store", "", "keep copied files once in the "+
+		"store DIR and hard\n"+
+		"                                  link them into the chroot")
+	depsCache = flag.String("deps-cache", "", "remember parsed library "+
+		"headers in FILE to speed\n"+
+		"                                  up later runs")
+	incremental = flag.Bool("incremental", false, "skip files, directories, "+
+		"links and devices\n"+
+		"                                  that are already up to date")
+	compareMode = flag.String("compare", "size-mtime", "how --incremental "+
+		"detects changed files,\n"+
+		"                                  'size-mtime' or 'hash'")
+	syncFiles = flag.Bool("sync", false, "flush each file to disk before "+
+		"it replaces\n"+
+		"                                  the previous version")
+	stripDebug = flag.Bool("strip-debug", false, "remove debug information "+
+		"from copies of\n"+
+		"                                  binaries and libraries")
+	stripAll = flag.Bool("strip-all", false, "remove symbol tables as well "+
+		"(implies\n"+
+		"                                  --strip-debug)")
+	jobs = flag.Int("jobs", runtime.NumCPU(), "run up to N independent "+
+		"actions at once (-j N),\n"+
+		"                                  defaults to the number of CPUs")
+	verbose      = flag.Bool("verbose", false, "explain what is being done")
+	checkSymbols = flag.Bool("check-symbols", false, "verify that libraries "+
+		"provide all symbols\n"+
+		"                                  and versions binaries need")
+	dryRun = flag.Bool("dry-run", false, "don't do anything, just print "+
 		"(implies --verbose)")
 	version = flag.Bool("version", false, "display version and exit")
-	// TODO(cblichmann): Implement these
-	//noClobber = flag.Bool("no-clobber", false, "do not overwrite existing "+
-	//	"files")
-	//oneFilesystem = flag.Bool("one-filesystem", false, "do not cross "+
-	//	"filesystem boundaries")
 )
 
+// reflinkValue implements the --reflink[=WHEN] flag like GNU cp. Without a
+// value, it means always.
+type reflinkValue int
+
+func (v *reflinkValue) String() string {
+	switch int(*v) {
+	case copy.ReflinkAlways:
+		return "always"
+	case copy.ReflinkNo:
+		return "never"
+	}
+	return "auto"
+}
+
+func (v *reflinkValue) Set(s string) error {
+	switch s {
+	case "always", "true":
+		*v = copy.ReflinkAlways
+	case "auto":
+		*v = copy.ReflinkAuto
+	case "never", "false":
+		*v = copy.ReflinkNo
+	default:
+		return fmt.Errorf("invalid argument '%s' for reflink", s)
+	}
+	return nil
+}
+
+func (v *reflinkValue) IsBoolFlag() bool {
+	return true
+}
+
+// preserveValue implements the --preserve[=ATTR_LIST] flag like GNU cp.
+// Without a value, it means mode,ownership,timestamps.
+type preserveValue copy.Preserve
+
+func (v *preserveValue) String() string {
+	return copy.Preserve(*v).String()
+}
+
+func (v *preserveValue) Set(s string) error {
+	switch s {
+	case "true":
+		s = "mode,ownership,timestamps"
+	case "false":
+		*v = 0
+		return nil
+	}
+	p, err := copy.ParsePreserve(s)
+	if err != nil {
+		return fmt.Errorf("%s for preserve", err)
+	}
+	*v = preserveValue(p)
+	return nil
+}
+
+func (v *preserveValue) IsBoolFlag() bool {
+	return true
+}
+
+func init() {
+	flag.IntVar(jobs, "j", *jobs, "")
+	flag.Var(&progressMode, "progress", "report progress on standard "+
+		"error, FORMAT\n"+
+		"                                  is 'text' (the default) or "+
+		"'json'")
+	flag.Var(&reflink, "reflink", "control clone/CoW copies, WHEN is "+
+		"'always',\n"+
+		"                                  'auto' or 'never' (the default)")
+	flag.Var(&preserve, "preserve", "preserve the comma-separated "+
+		"ATTR_LIST of\n"+
+		"                                  'mode', 'ownership', "+
+		"'timestamps',\n"+
+		"                                  'xattr' or 'all', default is "+
+		"the first\n"+
+		"                                  three")
+}
+
 // Prints more GNU-looking usage text.
 func printUsage() {
 	fmt.Printf("Usage: %s [OPTION]... FILE... TARGET\n"+
 		"Create or update the chroot environment in TARGET using "+
 		"specification\n"+
 		"FILEs. TARGET should be a directory and is created if it does not\n"+
-		"exist.\n\n", os.Args[0])
+		"exist.\n\n"+
+		"  or:  %s --output=FORMAT:FILE [OPTION]... FILE...\n"+
+		"Write the chroot environment to the archive FILE instead, or as a\n"+
+		"container image.\n\n"+
+		"  or:  %s deps [OPTION]... FILE...\n"+
+		"Print the shared library dependencies of FILEs, see '%s deps "+
+		"--help'.\n\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	flag.VisitAll(func(f *flag.Flag) {
+		if f.Usage == "" {
+			return // Short alias
+		}
 		fmt.Printf("      --%-23s %s\n", f.Name, f.Usage)
 	})
 	fmt.Printf("\nFor bug reporting instructions, please see:\n" +
@@ -109,7 +266,11 @@ func processCommandLine() {
 	if flag.NArg() == 0 {
 		log.Fatalf("missing file operand\n%s\n", fatalHelp)
 	}
-	if flag.NArg() == 1 {
+	if *output != "" {
+		if err := checkOutput(); err != nil {
+			log.Fatalf("%s\n%s\n", err, fatalHelp)
+		}
+	} else if flag.NArg() == 1 {
 		log.Fatalf("missing destination operand after '%s'\n%s\n", flag.Arg(0),
 			fatalHelp)
 	}
@@ -117,81 +278,717 @@ func processCommandLine() {
 		// --dry-run implies verbose
 		*verbose = true
 	}
+	if *compareMode != "size-mtime" && *compareMode != "hash" {
+		log.Fatalf("invalid argument '%s' for compare\n%s\n", *compareMode,
+			fatalHelp)
+	}
 }
 
-func expandWithDependencies(stmts spec.Statements) spec.Statements {
+// newLoaderConfig returns the configuration for library lookups inside dir.
+// If dir is empty, the host's configuration is used.
+func newLoaderConfig(dir string) *loader.Config {
+	if dir == "" {
+		return loader.DefaultConfig
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if fi, err := os.Stat(abs); err != nil {
+		log.Fatalf("%s\n", err)
+	} else if !fi.IsDir() {
+		log.Fatalf("sysroot is not a directory: %s\n", dir)
+	}
+	return loader.NewConfig(sysroot.Root(abs))
+}
+
+// expandWithDependencies adds the script interpreters and shared libraries
+// all files in stmts need. Returns the expanded statements, the dependency
+// graphs of all files and the layout of relocated files.
+func expandWithDependencies(stmts spec.Statements,
+	r *loader.Resolver) (spec.Statements, []*loader.Library, *layout) {
 	expanded := spec.ExpandLexical(stmts)
+	paths := filepath.SplitList(*searchPath)
+	todo := []spec.RegularFile{}
 	for _, s := range expanded {
-		switch stmt := s.(type) {
-		case spec.RegularFile:
-			deps, err := loader.ImportedLibraries(stmt.Source())
+		if stmt, ok := s.(spec.RegularFile); ok {
+			todo = append(todo, stmt)
+		}
+	}
+	if *depsCache != "" {
+		if err := r.LoadCache(*depsCache); err != nil {
+			log.Printf("ignoring dependency cache: %s\n", err)
+		}
+	}
+	allowedArchs := make(map[string]bool)
+	for _, a := range strings.Split(*archList, ",") {
+		if a != "" {
+			allowedArchs[a] = true
+		}
+	}
+	lay := newLayout(r.Root)
+	archOK := true
+	seen := make(map[string]bool)
+	var allGraphs []*loader.Library
+	var problems []loader.Problem
+	for len(todo) > 0 {
+		// Resolve all new files in parallel. Script interpreters found along
+		// the way are resolved in the next round.
+		batch := []spec.RegularFile{}
+		sources := []string{}
+		for _, stmt := range todo {
+			if !seen[stmt.Source()] {
+				seen[stmt.Source()] = true
+				batch = append(batch, stmt)
+				sources = append(sources, stmt.Source())
+			}
+		}
+		todo = nil
+		graphs, err := r.ResolveAll(sources)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		allGraphs = append(allGraphs, graphs...)
+		for i, stmt := range batch {
+			if !checkArch(graphs[i], allowedArchs) {
+				archOK = false
+			}
+			// Scripts need their interpreter, which may be a script itself
+			interps, err := r.ScriptInterpreters(stmt.Source(), paths)
 			if err != nil {
 				log.Fatalf("%s\n", err)
 			}
-			attr := stmt.FileAttr()
-			for _, d := range deps {
-				f := spec.NewRegularFile(d, d)
-				*f.FileAttr() = *attr
+			for _, i := range interps {
+				f := stmt.Dependency(i)
 				expanded = append(expanded, f)
+				todo = append(todo, f)
+			}
+
+			if *checkSymbols {
+				p, err := r.Verify(stmt.Source())
+				if err != nil {
+					log.Fatalf("%s\n", err)
+				}
+				problems = append(problems, p...)
+			}
+			if err := lay.plan(stmt, graphs[i]); err != nil {
+				log.Fatalf("%s\n", err)
+			}
+			for _, d := range graphs[i].Dependencies() {
+				f := stmt.Dependency(d)
+				target, err := lay.place(d, f.Options())
+				if err != nil {
+					log.Fatalf("%s\n", err)
+				}
+				expanded = append(expanded, f.WithTarget(target))
 			}
 		}
 	}
+	if *depsCache != "" {
+		if err := r.SaveCache(*depsCache); err != nil {
+			log.Printf("cannot write dependency cache: %s\n", err)
+		}
+	}
+	if !archOK {
+		log.Fatalf("architecture mismatch, not updating chroot\n")
+	}
+	if len(problems) > 0 {
+		reported := make(map[string]bool)
+		for _, p := range problems {
+			if msg := p.String(); !reported[msg] {
+				log.Printf("%s\n", msg)
+				reported[msg] = true
+			}
+		}
+		log.Fatalf("unresolved symbols or libraries, not updating chroot\n")
+	}
+	return resolveSources(expandSymlinks(expanded, r.Root, lay), r.Root),
+		allGraphs, lay
+}
+
+// checkArch reports libraries of root that were only found for a different
+// architecture. If allowed is not empty, the architecture of root must be in
+// it. Returns false if the architecture is not allowed.
+func checkArch(root *loader.Library, allowed map[string]bool) bool {
+	reported := make(map[*loader.Library]bool)
+	root.Walk(func(l *loader.Library) {
+		for _, n := range l.Needed {
+			if !n.Missing() || len(n.Skipped) == 0 || reported[n] {
+				continue
+			}
+			reported[n] = true
+			for _, s := range n.Skipped {
+				log.Printf("%s: %s needed by %s not found for %s, skipped %s "+
+					"(%s)\n", root.Name, n.Name, l.Name, root.Arch, s.Path,
+					s.Arch)
+			}
+		}
+	})
+	if len(allowed) > 0 && root.Arch != "" && !allowed[root.Arch] {
+		log.Printf("%s: architecture %s not allowed\n", root.Name, root.Arch)
+		return false
+	}
+	return true
+}
+
+// expandSymlinks replaces regular files that should keep their symlinks with
+// the statements that recreate the symlink chain inside the chroot. Copies
+// that need to be rewritten for lay are tracked to the end of the chain.
+func expandSymlinks(stmts spec.Statements, root sysroot.Root,
+	lay *layout) spec.Statements {
+	expanded := make(spec.Statements, 0, len(stmts))
+	for _, s := range stmts {
+		f, ok := s.(spec.RegularFile)
+		if !ok || !(*keepSymlinks || f.Options().KeepSymlinks) {
+			expanded = append(expanded, s)
+			continue
+		}
+		chain, err := spec.ExpandSymlinks(f, root)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		lay.retarget(f.Target(), chain[len(chain)-1].Target())
+		expanded = append(expanded, chain...)
+	}
 	return expanded
 }
 
-func updateChroot(chrootDir string, stmts spec.Statements) (err error) {
-	reflinkOpt := copy.ReflinkNo
-	if *reflink {
-		reflinkOpt = copy.ReflinkAlways
+// resolveSources changes the sources of all regular files and the original
+// symlinks of links to their host paths inside root.
+func resolveSources(stmts spec.Statements,
+	root sysroot.Root) spec.Statements {
+	if root == "" {
+		return stmts
+	}
+	for i, s := range stmts {
+		if f, ok := s.(spec.RegularFile); ok {
+			source, err := root.Path(f.Source())
+			if err != nil {
+				log.Fatalf("%s\n", err)
+			}
+			stmts[i] = f.WithSource(source)
+		} else if l, ok := s.(spec.Link); ok && l.Original() != "" {
+			original, err := root.LinkPath(l.Original())
+			if err != nil {
+				log.Fatalf("%s\n", err)
+			}
+			stmts[i] = l.WithOriginal(original)
+		}
+	}
+	return stmts
+}
+
+// taskResult records what applying a statement did, for the summaries.
+type taskResult struct {
+	outcome outcome
+	applied bool // The statement changed the chroot
+	copied  bool // A file was copied using method
+	method  copy.Method
+	saved   int64  // Bytes saved by stripping
+	sum     string // Hash of the file for the manifest or --verify
+}
+
+// update holds the state shared by all statements that update a chroot.
+type update struct {
+	chrootDir string
+	out       sink.Sink // Memory with --dry-run
+	archive   bool      // Whether out is an archive, chrootDir is empty
+	lay       *layout
+	guard     *mountGuard  // Nil unless --one-filesystem
+	store     *store.Store // Nil unless --store
+	// The manifest of the previous update, nil unless --manifest or --store
+	manifest *store.Manifest
+}
+
+// skippedSum returns the hash of the target of s for the manifest, if s is a
+// regular file that was left as it is. The hash recorded by the previous
+// update is used if there is one, so that only files without one are read.
+func (u *update) skippedSum(target string, s spec.Statement) (string, error) {
+	if _, ok := s.(spec.RegularFile); !ok || u.manifest == nil {
+		return "", nil
+	}
+	if sum, ok := u.manifest.Files[s.Target()]; ok {
+		return sum, nil
+	}
+	if fi, err := os.Lstat(target); err != nil || !fi.Mode().IsRegular() {
+		return "", err
+	}
+	return store.Hash(target)
+}
+
+// apply applies the statement s to the chroot and writes what it does to w.
+// Returns what was done for the summaries.
+func (u *update) apply(w io.Writer, s spec.Statement,
+	copts *copy.Options) (res taskResult, err error) {
+	if u.archive {
+		return u.add(w, s, copts)
 	}
-	for _, s := range spec.ExpandLexical(expandWithDependencies(stmts)) {
-		target := filepath.Join(chrootDir, s.Target())
+	chrootDir, lay := u.chrootDir, u.lay
+	target := filepath.Join(chrootDir, s.Target())
+	if _, ok := s.(spec.Run); !ok && u.guard != nil {
+		if err = u.guard.check(target); err != nil {
+			return
+		}
+	}
+	if clobberProtected(target, s) {
+		res.outcome = unchanged
 		if *verbose {
-			fmt.Println(s.Verbose())
-			if *dryRun {
-				continue
+			fmt.Fprintf(w, "skip existing: %s\n", s.Target())
+		}
+		res.sum, err = u.skippedSum(target, s)
+		return
+	}
+	if _, ok := s.(spec.Run); !ok {
+		var sums map[string]string
+		if u.manifest != nil {
+			sums = u.manifest.Files
+		}
+		if res.outcome, err = targetState(target, s, lay, sums); err != nil {
+			return
+		}
+		if res.outcome == unchanged {
+			res.sum, err = u.skippedSum(target, s)
+			if err == nil && res.sum != "" && u.store != nil {
+				err = u.store.AddHashed(target, res.sum)
 			}
+			return
 		}
-		switch stmt := s.(type) {
-		case spec.Directory:
-			err = action.Directory(target, stmt)
-		case spec.RegularFile:
-			err = action.RegularFile(target, stmt, &copy.Options{
-				Force:             *force,
-				Reflink:           reflinkOpt,
-				RemoveDestination: *removeDestination,
-			})
-		case spec.Link:
-			err = action.Link(target, stmt)
-		case spec.Device:
-			err = action.Device(target, stmt)
-		case spec.Run:
-			err = action.Run(target, stmt, chrootDir)
+	}
+	if *verbose {
+		fmt.Fprintln(w, s.Verbose())
+	}
+	res.applied = !*dryRun
+	switch stmt := s.(type) {
+	case spec.Directory:
+		err = action.Directory(u.out, stmt)
+	case spec.RegularFile:
+		var r copy.Result
+		r, err = action.RegularFile(u.out, stmt, copts)
+		if err == nil && *dryRun {
+			stripFile(w, chrootDir, stmt, copts)
+			lay.relocate(w, chrootDir, stmt.Target(), copts)
 		}
-		if err != nil {
+		if err != nil || *dryRun {
 			return
 		}
+		res.copied, res.method = true, r.Method
+		if err == nil && cancelSignal() != 0 {
+			return res, errCancelled // Copy was aborted
+		}
+		if err == nil && *verifyCopies {
+			res.sum, err = verifyCopy(w, u.out, target, stmt, copts)
+		}
+		if err == nil {
+			res.saved, err = stripFile(w, chrootDir, stmt, copts)
+		}
+		if err == nil {
+			err = lay.relocate(w, chrootDir, stmt.Target(), copts)
+		}
+		if err == nil && *incremental {
+			err = keepModTime(target, stmt)
+		}
+		if err == nil && res.sum != "" && transformed(stmt, lay) {
+			res.sum, err = store.Hash(target)
+		}
+		if err == nil && u.store != nil {
+			if res.sum != "" {
+				err = u.store.AddHashed(target, res.sum)
+			} else {
+				res.sum, err = u.store.Add(target)
+			}
+		} else if err == nil && u.manifest != nil && res.sum == "" {
+			res.sum, err = store.Hash(target)
+		}
+	case spec.Link:
+		err = action.Link(u.out, stmt)
+		if err == nil && preserve != 0 && stmt.Original() != "" &&
+			!*dryRun {
+			err = copy.Attributes(stmt.Original(), target,
+				copy.Preserve(preserve))
+		}
+	case spec.Device:
+		err = action.Device(u.out, stmt)
+	case spec.Run:
+		if !*dryRun {
+			err = action.Run(stmt, chrootDir)
+		}
 	}
 	return
 }
 
+// openMemory opens the sink for --dry-run, which writes nothing.
+func openMemory() (sink.Sink, error) {
+	return sink.NewMemory(), nil
+}
+
+// updateChroot writes the statements stmts to the sink returned by open,
+// which is only called once all dependencies are resolved, so that nothing
+// is left behind if that fails. If the sink is a directory, chrootDir is its
+// path, otherwise it is empty.
+func updateChroot(chrootDir string, open func() (sink.Sink, error),
+	stmts spec.Statements) (err error) {
+	if chrootDir == "" {
+		for _, s := range stmts {
+			if r, ok := s.(spec.Run); ok {
+				return fmt.Errorf("commands cannot be run in archives, "+
+					"remove 'run %s' or write a directory", r.Command())
+			}
+		}
+	}
+	r := loader.NewResolver(newLoaderConfig(*sysrootDir))
+	expanded, graphs, lay := expandWithDependencies(stmts, r)
+	copts := &copy.Options{
+		Force:             *force,
+		Reflink:           int(reflink),
+		RemoveDestination: *removeDestination,
+		Sync:              *syncFiles,
+		Preserve:          copy.Preserve(preserve),
+	}
+	out, err := open()
+	if err != nil {
+		return
+	}
+	u := &update{chrootDir: chrootDir, out: out, archive: chrootDir == "",
+		lay: lay}
+	if *oneFilesystem {
+		if u.guard, err = newMountGuard(chrootDir); err != nil {
+			return
+		}
+	}
+	if *storeDir != "" && !*dryRun {
+		if u.store, err = store.Open(*storeDir); err != nil {
+			return
+		}
+	}
+	if (*storeDir != "" || *manifestFile != "") && !*dryRun {
+		var jail string
+		if jail, err = filepath.Abs(chrootDir); err != nil {
+			return
+		}
+		if *manifestFile != "" {
+			u.manifest, err = store.ReadManifestFile(*manifestFile)
+		} else {
+			u.manifest, err = u.store.ReadManifest(jail)
+		}
+		if err != nil {
+			return
+		}
+		if u.manifest.Jail != jail {
+			// Written for another jail, its hashes do not apply
+			u.manifest.Jail = jail
+			u.manifest.Files = make(map[string]string)
+		}
+	}
+	tasks := planTasks(spec.ExpandLexical(expanded), *ldConfig)
+	results := make([]taskResult, len(tasks))
+	sizes := make([]int64, len(tasks)) // Of the sources of files
+	var statements int
+	var total int64
+	for i, s := range tasks {
+		if s == nil {
+			continue
+		}
+		statements++
+		if f, ok := s.(spec.RegularFile); ok {
+			if fi, err := os.Stat(f.Source()); err == nil {
+				sizes[i] = fi.Size()
+				total += sizes[i]
+			}
+		}
+	}
+	prog := newProgress(progressFormat(progressMode), statements, total)
+	err = executor.Run(taskDependencies(tasks), *jobs,
+		prog.output(os.Stdout), func(i int, w io.Writer) (err error) {
+			if cancelSignal() != 0 {
+				return errCancelled
+			}
+			s := tasks[i]
+			if s == nil {
+				return writeLdConfig(w, u, r, graphs, copts)
+			}
+			topts := *copts
+			done := func() {}
+			if _, ok := s.(spec.RegularFile); ok {
+				topts.Progress, done = prog.startFile(s.Target(), sizes[i])
+			} else if _, ok := s.(spec.Run); ok {
+				prog.clear() // Commands write to the terminal directly
+			}
+			if results[i], err = u.apply(w, s, &topts); err == nil {
+				done()
+				prog.statementDone()
+			}
+			return
+		})
+	prog.finish()
+	if err != nil {
+		return
+	}
+
+	saved := make(map[string]int64) // Bytes saved by stripping, by target
+	methods := make(map[copy.Method]int)
+	files := make(map[string]string) // Hashes of the files for the manifest
+	outcomes := make(summary)
+	var dirs []spec.Directory // Directories to preserve attributes for
+	for i, s := range tasks {
+		if isBarrier(s) {
+			continue
+		}
+		res := results[i]
+		outcomes.add(s.Target(), res.outcome)
+		if res.copied {
+			methods[res.method]++
+		}
+		if res.saved > 0 {
+			saved[s.Target()] = res.saved
+		}
+		if d, ok := s.(spec.Directory); ok && res.applied {
+			dirs = append(dirs, d)
+		}
+		if _, ok := s.(spec.RegularFile); ok && res.sum != "" {
+			files[s.Target()] = res.sum
+		}
+	}
+	if u.manifest != nil {
+		u.manifest.Files = files
+		if *manifestFile != "" {
+			err = u.manifest.WriteFile(*manifestFile)
+		}
+		if err == nil && u.store != nil {
+			err = u.store.WriteManifest(u.manifest)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if !u.archive {
+		if err = preserveDirectories(chrootDir, dirs); err != nil {
+			return
+		}
+	}
+	if *verbose && len(methods) > 0 {
+		var counts []string
+		for m := copy.MethodReadWrite; m <= copy.MethodClone; m++ {
+			if n := methods[m]; n > 0 {
+				counts = append(counts, fmt.Sprintf("%d %s", n, m))
+			}
+		}
+		fmt.Printf("copied files: %s\n", strings.Join(counts, ", "))
+	}
+	if *verbose || *incremental {
+		fmt.Printf("%s\n", outcomes)
+	}
+	if len(saved) > 0 && !*dryRun {
+		var total int64
+		for _, n := range saved {
+			total += n
+		}
+		fmt.Printf("stripped %d files, %d bytes saved\n", len(saved), total)
+	}
+	if u.archive {
+		return nil
+	}
+	return lay.verify(chrootDir)
+}
+
+// preserveDirectories gives the directories in the chroot the preserved
+// attributes of the directories at the same paths on the host or in the
+// sysroot, if any. Modes are left as given in the spec. This is done last,
+// as adding entries changes the modification time of a directory.
+func preserveDirectories(chrootDir string, dirs []spec.Directory) error {
+	p := copy.Preserve(preserve) &^ copy.PreserveMode
+	if p == 0 || *dryRun {
+		return nil
+	}
+	root := sysroot.Root(*sysrootDir)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		source, err := root.Path(dirs[i].Target())
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(source); err != nil || !fi.IsDir() {
+			continue // Only exists in the chroot
+		}
+		err = copy.Attributes(source, filepath.Join(chrootDir,
+			dirs[i].Target()), p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripOptions returns whether the copy of f is stripped, and whether its
+// symbol tables are removed as well.
+func stripOptions(f spec.RegularFile) (strip, all bool) {
+	opts := f.Options()
+	all = *stripAll || opts.StripAll
+	return all || *stripDebug || opts.StripDebug, all
+}
+
+// stripFile removes debug information from the copy of f in the chroot, if
+// requested on the command-line or by the options of f. Returns the number
+// of bytes saved. Verbose output goes to w.
+func stripFile(w io.Writer, chrootDir string, f spec.RegularFile,
+	copts *copy.Options) (int64, error) {
+	strip, all := stripOptions(f)
+	if !strip {
+		return 0, nil
+	}
+	if *dryRun {
+		fmt.Fprintf(w, "strip file: %s\n", f.Target())
+		return 0, nil
+	}
+	saved, err := elfpatch.StripFile(filepath.Join(chrootDir, f.Target()),
+		all, copts)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", f.Target(), err)
+	}
+	if *verbose && saved > 0 {
+		fmt.Fprintf(w, "strip file: %s (%d bytes saved)\n", f.Target(),
+			saved)
+	}
+	return saved, nil
+}
+
+// clobberProtected returns whether s must not replace the existing target
+// because of --no-clobber. Directories and commands are never skipped.
+func clobberProtected(target string, s spec.Statement) bool {
+	if !*noClobber {
+		return false
+	}
+	switch s.(type) {
+	case spec.Directory, spec.Run:
+		return false
+	}
+	return action.Exists(target)
+}
+
+// writeLdConfig writes a loader config and cache for all libraries in graphs
+// into the chroot, so that the loader finds libraries outside of its default
+// directories. Libraries moved by the layout of u are listed at their new
+// place. Verbose output goes to w. With --one-filesystem, the files are only
+// written if they are on the file system of the chroot.
+func writeLdConfig(w io.Writer, u *update, r *loader.Resolver,
+	graphs []*loader.Library, copts *copy.Options) error {
+	lay := u.lay
+	entries, bo, err := r.LdCacheEntries(graphs)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if target, ok := lay.moved[e.Path]; ok {
+			entries[i].Path = target
+		}
+	}
+	var conf, cache bytes.Buffer
+	if err := loader.WriteLdConfig(&conf, entries); err != nil {
+		return err
+	}
+	if err := loader.WriteLdCache(&cache, entries, bo); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"/etc/ld.so.conf", conf.Bytes()},
+		{"/etc/ld.so.cache", cache.Bytes()},
+	} {
+		target := filepath.Join(u.chrootDir, f.name)
+		if u.guard != nil {
+			if err := u.guard.check(target); err != nil {
+				return err
+			}
+		}
+		if *noClobber && action.Exists(target) {
+			if *verbose {
+				fmt.Fprintf(w, "skip existing: %s\n", f.name)
+			}
+			continue
+		}
+		if *incremental {
+			if old, err := ioutil.ReadFile(target); err == nil &&
+				bytes.Equal(old, f.data) {
+				continue
+			}
+		}
+		if *verbose {
+			fmt.Fprintf(w, "write file: %s\n", f.name)
+		}
+		err := u.out.Mkdir(&sink.Header{Name: filepath.Dir(f.name),
+			Mode: os.ModeDir | 0755})
+		if err != nil {
+			return err
+		}
+		err = u.out.WriteFile(&sink.Header{Name: f.name, Mode: 0644,
+			ModeSet: true}, f.data, copts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("jailtime: ")
+	if len(os.Args) > 1 && os.Args[1] == "deps" {
+		runDeps(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "store" {
+		runStore(os.Args[2:])
+		return
+	}
 	processCommandLine()
 
+	// The first interrupt cancels the update, running copies stop and leave
+	// their destination unchanged. Do not leave partially written files
+	// behind when interrupted again.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupt
+		log.Printf("interrupted by %s, cancelling\n", sig)
+		cancel(int(sig.(syscall.Signal)))
+		sig = <-interrupt
+		copy.RemoveTemporaries()
+		log.Printf("interrupted by %s\n", sig)
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+
 	// Parse all spec files given on the command-line
 	stmts := spec.Statements{}
-	lastArg := flag.NArg() - 1
-	for _, s := range flag.Args()[:lastArg] {
+	specs, chrootDir := flag.Args(), ""
+	if *output == "" {
+		specs, chrootDir = specs[:len(specs)-1], specs[len(specs)-1]
+	}
+	for _, s := range specs {
 		parsed, err := spec.Parse(s)
 		if err != nil {
 			log.Fatalf("%s\n", err)
 		}
 		stmts = append(stmts, parsed...)
 	}
+	// Only container images have a configuration
+	stmts, config := imageConfig(stmts)
 
-	if err := updateChroot(flag.Arg(lastArg), stmts); err != nil {
+	if sig := cancelSignal(); sig != 0 {
+		os.Exit(128 + sig)
+	}
+	var err error
+	if *output != "" {
+		err = writeArchive(stmts, config)
+	} else if *dryRun {
+		err = updateChroot(chrootDir, openMemory, stmts)
+	} else {
+		err = updateChroot(chrootDir, func() (sink.Sink, error) {
+			return sink.NewDir(chrootDir), nil
+		}, stmts)
+	}
+	if err == errCancelled {
+		os.Exit(128 + cancelSignal())
+	} else if err != nil {
 		log.Fatalf("%s\n", err)
 	}
 }
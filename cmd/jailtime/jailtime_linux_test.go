@@ -0,0 +1,84 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for the dependency expansion of spec statements
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blichmann.eu/code/jailtime/internal/spec"
+	"blichmann.eu/code/jailtime/pkg/loader"
+)
+
+func TestExpandInterpreterAttr(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// The interpreter is not an ELF binary, so it has no dependencies
+	interp := filepath.Join(td, "interp")
+	if err := ioutil.WriteFile(interp, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(td, "script")
+	if err := ioutil.WriteFile(script, []byte("#!"+interp+"\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+	s := filepath.Join(td, "script.jailspec")
+	if err := ioutil.WriteFile(s, []byte(script+" /bin/script 750\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	stmts, err := spec.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attr := spec.FileAttr{UID: spec.OwnerUnspecified,
+		GID: spec.OwnerUnspecified, Mode: 0750}
+
+	r := loader.NewResolver(loader.DefaultConfig)
+	expanded, _, _ := expandWithDependencies(stmts, r)
+	found := false
+	for _, s := range expanded {
+		if s.Target() != interp {
+			continue
+		}
+		found = true
+		if *s.FileAttr() != attr {
+			t.Errorf("expected %+v, actual %+v", attr, *s.FileAttr())
+		}
+	}
+	if !found {
+		t.Errorf("expected %s in expanded statements", interp)
+	}
+}
@@ -0,0 +1,298 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Relocated chroot layouts
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"blichmann.eu/code/jailtime/internal/spec"
+	"blichmann.eu/code/jailtime/pkg/copy"
+	"blichmann.eu/code/jailtime/pkg/elfpatch"
+	"blichmann.eu/code/jailtime/pkg/loader"
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+// relocation describes how the copy of a binary or library is rewritten to
+// find its interpreter and libraries in a relocated layout.
+type relocation struct {
+	opts  spec.Options
+	patch elfpatch.Patch
+}
+
+func (r *relocation) String() string {
+	var s []string
+	if r.patch.Interp != "" {
+		s = append(s, "interpreter "+r.patch.Interp)
+	}
+	if r.patch.RunPath != nil {
+		s = append(s, "run path "+strings.Join(r.patch.RunPath, ":"))
+	}
+	return strings.Join(s, ", ")
+}
+
+// relocatedBinary is a file from a jailspec that uses a relocated layout,
+// together with the paths its dependencies are planned to resolve to.
+type relocatedBinary struct {
+	target  string
+	prefix  string
+	planned map[string]bool
+}
+
+// layout plans where libraries are placed in the chroot if jailspecs use the
+// libdir or prefix options, and which copies need to be rewritten for that.
+type layout struct {
+	root     sysroot.Root
+	placed   map[string]string      // Target to source of moved libraries
+	moved    map[string]string      // Source to target of moved libraries
+	relocs   map[string]*relocation // By target
+	binaries []relocatedBinary
+}
+
+func newLayout(root sysroot.Root) *layout {
+	return &layout{
+		root:   root,
+		placed: make(map[string]string),
+		moved:  make(map[string]string),
+		relocs: make(map[string]*relocation),
+	}
+}
+
+// layoutTarget returns the target in the chroot of the library at path.
+func layoutTarget(path string, opts spec.Options) string {
+	if opts.LibDir == "" {
+		return path
+	}
+	return filepath.Join(opts.LibDir, filepath.Base(path))
+}
+
+// place returns the target of the library at path. Libraries moved to a
+// library directory must not collide with each other.
+func (l *layout) place(path string, opts spec.Options) (string, error) {
+	target := layoutTarget(path, opts)
+	if target == path {
+		return target, nil
+	}
+	if other, ok := l.placed[target]; ok && other != path {
+		return "", fmt.Errorf("%s and %s both map to %s", other, path,
+			target)
+	}
+	l.placed[target] = path
+	l.moved[path] = target
+	return target, nil
+}
+
+// interpreter returns the interpreter of the ELF file at path inside the
+// root. Files that are not ELF or have no interpreter yield an empty string.
+func (l *layout) interpreter(path string) (string, error) {
+	p, err := l.root.Path(path)
+	if err != nil {
+		return "", err
+	}
+	e, err := elf.Open(p)
+	if err != nil {
+		return "", nil // Not an ELF, e.g. a script
+	}
+	defer e.Close()
+	for _, prog := range e.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		b := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(b, 0); err != nil {
+			return "", fmt.Errorf("%s: %s", path, err)
+		}
+		return strings.TrimRight(string(b), "\x00"), nil
+	}
+	return "", nil
+}
+
+// add records the relocation of the copy at target, merging the run paths
+// if the copy is needed by several binaries.
+func (l *layout) add(target string, r *relocation) error {
+	cur, ok := l.relocs[target]
+	if !ok {
+		l.relocs[target] = r
+		return nil
+	}
+	if cur.opts != r.opts || cur.patch.Interp != r.patch.Interp {
+		return fmt.Errorf("%s: conflicting layouts", target)
+	}
+	seen := make(map[string]bool)
+	for _, dir := range cur.patch.RunPath {
+		seen[dir] = true
+	}
+	for _, dir := range r.patch.RunPath {
+		if !seen[dir] {
+			seen[dir] = true
+			cur.patch.RunPath = append(cur.patch.RunPath, dir)
+		}
+	}
+	return nil
+}
+
+// plan records how the copies of the file in stmt and of its libraries are
+// rewritten, given the dependency graph of the file. Files that do not use
+// a relocated layout are left alone.
+func (l *layout) plan(stmt spec.RegularFile, root *loader.Library) error {
+	opts := stmt.Options()
+	if !opts.Relocated() {
+		return nil
+	}
+	target := func(lib *loader.Library) string {
+		if lib == root {
+			return stmt.Target()
+		}
+		return layoutTarget(lib.Path, opts)
+	}
+	b := relocatedBinary{
+		target:  stmt.Target(),
+		prefix:  opts.Prefix,
+		planned: make(map[string]bool),
+	}
+	var err error
+	root.Walk(func(lib *loader.Library) {
+		if err != nil || lib.Missing() {
+			return
+		}
+		b.planned[target(lib)] = true
+		r := &relocation{opts: opts}
+		var interp string
+		if interp, err = l.interpreter(lib.Path); err != nil {
+			return
+		}
+		if interp != "" {
+			r.patch.Interp = filepath.Join(opts.Prefix,
+				layoutTarget(interp, opts))
+		}
+		seen := make(map[string]bool)
+		for _, n := range lib.Needed {
+			if n.Missing() {
+				continue
+			}
+			dir := filepath.Join(opts.Prefix, filepath.Dir(target(n)))
+			if !seen[dir] {
+				seen[dir] = true
+				r.patch.RunPath = append(r.patch.RunPath, dir)
+			}
+		}
+		if r.patch.Interp != "" || r.patch.RunPath != nil {
+			err = l.add(target(lib), r)
+		}
+	})
+	l.binaries = append(l.binaries, b)
+	return err
+}
+
+// retarget moves the relocation of the copy at target to the end of the
+// symlink chain that replaced it.
+func (l *layout) retarget(target, final string) {
+	if r, ok := l.relocs[target]; ok && target != final {
+		delete(l.relocs, target)
+		l.relocs[final] = r
+	}
+}
+
+// relocate rewrites the copy at target inside the chroot, if the layout
+// requires it. The copy is replaced, so that hard links to the host's files
+// are never modified. Verbose output goes to w.
+func (l *layout) relocate(w io.Writer, chrootDir, target string,
+	copts *copy.Options) error {
+	r, ok := l.relocs[target]
+	if !ok {
+		return nil
+	}
+	if *verbose {
+		fmt.Fprintf(w, "patch file: %s (%s)\n", target, r)
+		if *dryRun {
+			return nil
+		}
+	}
+	if err := elfpatch.Apply(filepath.Join(chrootDir, target), r.patch,
+		copts); err != nil {
+		return fmt.Errorf("%s: %s", target, err)
+	}
+	return nil
+}
+
+// verify checks that the rewritten binaries resolve their interpreter and
+// all libraries to their planned places in the chroot, and that these
+// provide all needed symbols.
+func (l *layout) verify(chrootDir string) error {
+	if len(l.binaries) == 0 || *dryRun {
+		return nil
+	}
+	abs, err := filepath.Abs(chrootDir)
+	if err != nil {
+		return err
+	}
+	configs := make(map[string]*loader.Config) // By prefix
+	var reported []string
+	for _, b := range l.binaries {
+		c, ok := configs[b.prefix]
+		if !ok {
+			c = loader.NewConfig(sysroot.Root(abs))
+			c.PathPrefix = b.prefix
+			configs[b.prefix] = c
+		}
+		root, err := c.DependencyGraph(b.target)
+		if err != nil {
+			return err
+		}
+		root.Walk(func(lib *loader.Library) {
+			if !lib.Missing() && !b.planned[lib.Path] {
+				reported = append(reported, fmt.Sprintf("%s: %s resolves "+
+					"to %s outside of the layout", b.target, lib.Name,
+					lib.Path))
+			}
+		})
+		problems, err := c.Verify(b.target)
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			reported = append(reported, p.String())
+		}
+	}
+	if len(reported) == 0 {
+		return nil
+	}
+	sort.Strings(reported)
+	for i, msg := range reported {
+		if i == 0 || msg != reported[i-1] {
+			log.Printf("%s\n", msg)
+		}
+	}
+	return errors.New("relocated files are not self-consistent")
+}
@@ -0,0 +1,135 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Detection of mount points inside the chroot
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// mountGuard checks that paths inside a chroot are on the same file system
+// as the chroot itself, so that writes do not reach through mount points,
+// like a bind-mounted /proc or /home.
+type mountGuard struct {
+	sync.Mutex
+	root    string
+	dev     uint64
+	checked map[string]bool // Paths known to be on the file system
+}
+
+// device returns the device that the file at path is on, without following
+// symlinks.
+func device(path string) (uint64, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("%s: no device information", path)
+	}
+	return uint64(st.Dev), nil
+}
+
+// newMountGuard returns a mountGuard for chrootDir. If chrootDir does not
+// exist yet, it will be created on the file system of its closest existing
+// parent directory.
+func newMountGuard(chrootDir string) (*mountGuard, error) {
+	root := filepath.Clean(chrootDir)
+	for dir := root; ; dir = filepath.Dir(dir) {
+		dev, err := device(dir)
+		if err == nil {
+			return &mountGuard{root: root, dev: dev,
+				checked: make(map[string]bool)}, nil
+		}
+		if !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return nil, err
+		}
+	}
+}
+
+// check returns an error if path or any of its existing parent directories
+// below the root of g is on a different file system. Parent directories must
+// also not lead out of the root through symlinks, as writes follow them.
+func (g *mountGuard) check(path string) error {
+	path = filepath.Clean(path)
+	// Targets themselves are replaced, even if they are symlinks
+	if dev, err := device(path); err == nil && dev != g.dev {
+		return fmt.Errorf("%s is a mount point or on another file system, "+
+			"not writing to it (--one-filesystem)", path)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	g.Lock()
+	defer g.Unlock()
+	var ok []string
+	for p := filepath.Dir(path); len(p) > len(g.root) &&
+		!g.checked[p]; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			continue // Will be created
+		}
+		if err := g.checkDir(p); err != nil {
+			return err
+		}
+		ok = append(ok, p)
+	}
+	for _, p := range ok {
+		g.checked[p] = true
+	}
+	return nil
+}
+
+// checkDir returns an error unless the existing directory dir resolves to a
+// directory inside the root of g and on its file system.
+func (g *mountGuard) checkDir(dir string) error {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(g.root)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return fmt.Errorf("%s leads outside of %s, not writing to it "+
+			"(--one-filesystem)", dir, g.root)
+	}
+	dev, err := device(resolved)
+	if err != nil {
+		return err
+	}
+	if dev != g.dev {
+		return fmt.Errorf("%s is a mount point or on another file system, "+
+			"not writing to it (--one-filesystem)", dir)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for mount point protection
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blichmann.eu/code/jailtime/internal/spec"
+)
+
+func TestMountGuard(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	root := filepath.Join(td, "chroot")
+	for _, dir := range []string{filepath.Join(root, "usr", "lib"),
+		filepath.Join(td, "outside")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, value := range map[string]string{
+		"lib":      "usr/lib",
+		"home":     filepath.Join(td, "outside"),
+		"up":       "..",
+		"dangling": filepath.Join(td, "missing"),
+		"file":     filepath.Join(td, "outside"),
+	} {
+		if err := os.Symlink(value, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := newMountGuard(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path string
+		ok   bool
+	}{
+		{"/usr/lib/libc.so.6", true},
+		{"/new/dir/file", true},
+		{"/lib/libc.so.6", true}, // Stays inside
+		{"/file", true},          // Replaced, not followed
+		{"/home/user/.bashrc", false},
+		{"/up/outside/file", false},
+		{"/dangling/file", false},
+	} {
+		err := g.check(filepath.Join(root, test.path))
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: expected ok %t, actual %t (%v)", test.path,
+				test.ok, ok, err)
+		}
+	}
+
+	// Directories on other devices are refused
+	other := &mountGuard{root: root, dev: g.dev + 1,
+		checked: make(map[string]bool)}
+	if err := other.check(filepath.Join(root, "usr/lib/libc.so.6")); err ==
+		nil {
+		t.Error("expected error for a directory on another device")
+	}
+	// Guards for chroots that do not exist yet use the closest parent
+	if g, err := newMountGuard(filepath.Join(root, "missing",
+		"chroot")); err != nil {
+		t.Fatal(err)
+	} else if g.dev != other.dev-1 {
+		t.Errorf("expected device %d, actual %d", other.dev-1, g.dev)
+	}
+}
+
+func TestClobberProtected(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	existing := filepath.Join(td, "existing")
+	if err := ioutil.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(td, "missing")
+	old := *noClobber
+	defer func() { *noClobber = old }()
+	for _, test := range []struct {
+		noClobber bool
+		target    string
+		s         spec.Statement
+		expected  bool
+	}{
+		{true, existing, spec.NewRegularFile("/bin/sh", "/existing"), true},
+		{true, existing, spec.NewLink("sh", "/existing", false), true},
+		{true, missing, spec.NewRegularFile("/bin/sh", "/missing"), false},
+		{true, existing, spec.NewDirectory("/existing"), false},
+		{true, existing, spec.NewRun("true"), false},
+		{false, existing, spec.NewRegularFile("/bin/sh", "/existing"), false},
+	} {
+		*noClobber = test.noClobber
+		if actual := clobberProtected(test.target, test.s); actual !=
+			test.expected {
+			t.Errorf("%s (--no-clobber=%t): expected %t, actual %t",
+				test.s.Verbose(), test.noClobber, test.expected, actual)
+		}
+	}
+}
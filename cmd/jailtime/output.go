@@ -0,0 +1,384 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Archive outputs
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"blichmann.eu/code/jailtime/internal/action"
+	"blichmann.eu/code/jailtime/internal/sink"
+	"blichmann.eu/code/jailtime/internal/spec"
+	"blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// parseOutput splits the value of --output into the output format, the file
+// name and, for container images, the tag. Images are tagged 'latest' by
+// default.
+func parseOutput(s string) (format, filename, tag string, err error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", "", "", fmt.Errorf("invalid argument '%s' for output, "+
+			"expected FORMAT:FILE", s)
+	}
+	format, filename = s[:i], s[i+1:]
+	switch format {
+	case "cpio", "tar":
+	case "oci", "oci-archive":
+		tag = "latest"
+		if i = strings.LastIndex(filename, ":"); i >= 0 {
+			filename, tag = filename[:i], filename[i+1:]
+			if tag == "" {
+				return "", "", "", fmt.Errorf("missing tag in '%s'", s)
+			}
+		}
+	default:
+		return "", "", "", fmt.Errorf("unknown output format '%s'", format)
+	}
+	if filename == "" {
+		return "", "", "", fmt.Errorf("missing file name in '%s'", s)
+	}
+	return format, filename, tag, nil
+}
+
+// imageConfig removes the image statements from stmts and returns the
+// configuration of container images they describe. Later statements override
+// earlier ones, environment variables are overridden by name.
+func imageConfig(stmts spec.Statements) (spec.Statements,
+	sink.ImageConfig) {
+	var config sink.ImageConfig
+	rest := make(spec.Statements, 0, len(stmts))
+	for _, s := range stmts {
+		image, ok := s.(spec.Image)
+		if !ok {
+			rest = append(rest, s)
+			continue
+		}
+		values := image.Values()
+		switch image.Field() {
+		case "entrypoint":
+			config.Entrypoint = values
+		case "cmd":
+			config.Cmd = values
+		case "env":
+			name := values[0][:strings.Index(values[0], "=")+1]
+			env := config.Env[:0:0]
+			for _, e := range config.Env {
+				if !strings.HasPrefix(e, name) {
+					env = append(env, e)
+				}
+			}
+			config.Env = append(env, values[0])
+		case "user":
+			config.User = values[0]
+		case "workdir":
+			config.WorkingDir = values[0]
+		}
+	}
+	return rest, config
+}
+
+// checkOutput checks the command-line for writing an archive with --output.
+// Options that update existing files in TARGET cannot be used.
+func checkOutput() error {
+	if _, _, _, err := parseOutput(*output); err != nil {
+		return err
+	}
+	if flag.NArg() == 0 {
+		return fmt.Errorf("missing file operand")
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"incremental", *incremental},
+		{"manifest", *manifestFile != ""},
+		{"no-clobber", *noClobber},
+		{"one-filesystem", *oneFilesystem},
+		{"store", *storeDir != ""},
+		{"verify", *verifyCopies},
+	} {
+		if f.set {
+			return fmt.Errorf("--%s cannot be used with --output", f.name)
+		}
+	}
+	return nil
+}
+
+// archiveTime returns the modification time of the entries of archives.
+// Like other tools that build reproducibly, it is taken from the
+// SOURCE_DATE_EPOCH environment variable if set. Otherwise, it is the start
+// of the epoch, so that archives do not depend on when they were written.
+func archiveTime() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Unix(0, 0), nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %s", epoch)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// cancelWriter stops writing an archive once the update is cancelled.
+type cancelWriter struct {
+	io.Writer
+}
+
+func (w cancelWriter) Write(p []byte) (int, error) {
+	if cancelSignal() != 0 {
+		return 0, errCancelled
+	}
+	return w.Writer.Write(p)
+}
+
+// zstdWriter compresses what is written to it with an external zstd(1)
+// process, like 'tar --zstd' does, as Go has no zstd encoder.
+type zstdWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// newZstdWriter starts zstd(1) to compress to w.
+func newZstdWriter(w io.Writer) (*zstdWriter, error) {
+	cmd := exec.Command("zstd", "-q", "-c")
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot compress with zstd: %s", err)
+	}
+	return &zstdWriter{cmd, stdin}, nil
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	return z.stdin.Write(p)
+}
+
+// Close finishes compressing and waits for zstd(1) to write all of its
+// output.
+func (z *zstdWriter) Close() error {
+	err := z.stdin.Close()
+	if waitErr := z.cmd.Wait(); waitErr != nil {
+		return fmt.Errorf("zstd: %s", waitErr)
+	}
+	return err
+}
+
+// archive is an archive written with --output. It is written to a temporary
+// file next to filename, which replaces filename once complete. Image layout
+// directories are written in place.
+type archive struct {
+	sink.Sink
+	filename string
+	file     *os.File // Nil for image layout directories
+	buf      *bufio.Writer
+	zw       io.WriteCloser // Compresses the archive, if not nil
+}
+
+// createArchive starts writing an archive in format to filename. It is
+// compressed with gzip if filename ends in '.gz', or with zstd(1) if it ends
+// in '.zst'. Container images are tagged tag and get the configuration
+// config.
+func createArchive(format, filename, tag string,
+	config sink.ImageConfig) (*archive, error) {
+	modTime, err := archiveTime()
+	if err != nil {
+		return nil, err
+	}
+	if format == "oci" {
+		if err = checkImageLayout(filename); err != nil {
+			return nil, err
+		}
+		return &archive{Sink: sink.NewOCI(filename, tag, config, modTime),
+			filename: filename}, nil
+	}
+	a := &archive{filename: filename}
+	if a.file, err = ioutil.TempFile(filepath.Dir(filename),
+		"."+filepath.Base(filename)+"."); err != nil {
+		return nil, err
+	}
+	a.buf = bufio.NewWriter(cancelWriter{a.file})
+	var w io.Writer = a.buf
+	switch filepath.Ext(filename) {
+	case ".gz":
+		a.zw = gzip.NewWriter(w)
+	case ".zst":
+		zw, err := newZstdWriter(w)
+		if err != nil {
+			a.discard()
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		a.zw = zw
+	}
+	if a.zw != nil {
+		w = a.zw
+	}
+	switch format {
+	case "cpio":
+		a.Sink = sink.NewCpio(w, modTime)
+	case "oci-archive":
+		a.Sink = sink.NewOCIArchive(w, filepath.Dir(filename), tag, config,
+			modTime)
+	default:
+		a.Sink = sink.NewTar(w, modTime)
+	}
+	return a, nil
+}
+
+// checkImageLayout checks that dir is either an image layout or can become
+// one, so that writing an image does not clutter other directories.
+func checkImageLayout(dir string) error {
+	names, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) || err == nil && len(names) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err = os.Stat(filepath.Join(dir, "oci-layout")); err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: not empty and not an image layout", dir)
+}
+
+// commit finishes the archive and moves it into place.
+func (a *archive) commit() error {
+	err := a.Sink.Close()
+	if a.file == nil {
+		return err
+	}
+	if err == nil && a.zw != nil {
+		err = a.zw.Close()
+	}
+	if err == nil {
+		err = a.buf.Flush()
+	}
+	if err == nil && *syncFiles {
+		err = a.file.Sync()
+	}
+	if err == nil {
+		err = a.file.Chmod(0644)
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(a.file.Name(), a.filename)
+	}
+	if err != nil {
+		os.Remove(a.file.Name())
+	}
+	return err
+}
+
+// discard removes the unfinished archive.
+func (a *archive) discard() {
+	if a.file == nil {
+		return
+	}
+	if a.zw != nil {
+		a.zw.Close() // Stops zstd(1)
+	}
+	a.file.Close()
+	os.Remove(a.file.Name())
+}
+
+// writeArchive writes the statements stmts to the archive given with
+// --output. Container images get the configuration config. With --dry-run,
+// nothing is written.
+func writeArchive(stmts spec.Statements, config sink.ImageConfig) error {
+	format, filename, tag, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return updateChroot("", openMemory, stmts)
+	}
+	var a *archive
+	if err = updateChroot("", func() (sink.Sink, error) {
+		a, err = createArchive(format, filename, tag, config)
+		return a, err
+	}, stmts); err != nil {
+		if a != nil {
+			a.discard()
+		}
+		return err
+	}
+	if *verbose {
+		fmt.Printf("write archive: %s\n", filename)
+	}
+	return a.commit()
+}
+
+// add adds the statement s to the archive and writes what it does to w.
+// Copies that are stripped or relocated are changed in memory.
+func (u *update) add(w io.Writer, s spec.Statement,
+	copts *copy.Options) (res taskResult, err error) {
+	res.outcome, res.applied = created, !*dryRun
+	if *verbose {
+		fmt.Fprintln(w, s.Verbose())
+	}
+	switch stmt := s.(type) {
+	case spec.Directory:
+		err = action.Directory(u.out, stmt)
+	case spec.RegularFile:
+		_, err = action.RegularFile(u.out, stmt, copts)
+		if err != nil || !transformed(stmt, u.lay) {
+			return
+		}
+		if strip, _ := stripOptions(stmt); strip && *verbose {
+			fmt.Fprintf(w, "strip file: %s\n", stmt.Target())
+		}
+		if r, ok := u.lay.relocs[stmt.Target()]; ok && *verbose {
+			fmt.Fprintf(w, "patch file: %s (%s)\n", stmt.Target(), r)
+		}
+		var data []byte
+		if data, err = expectedContent(stmt, u.lay); err == nil {
+			err = action.RewriteFile(u.out, stmt, data, copts)
+		}
+	case spec.Link:
+		err = action.Link(u.out, stmt)
+	case spec.Device:
+		err = action.Device(u.out, stmt)
+	}
+	return
+}
@@ -0,0 +1,152 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for writing archives
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"blichmann.eu/code/jailtime/internal/action"
+	"blichmann.eu/code/jailtime/internal/sink"
+	"blichmann.eu/code/jailtime/internal/spec"
+)
+
+// tarNames returns the names of the entries of the tar archive in r.
+func tarNames(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+}
+
+func TestArchiveTime(t *testing.T) {
+	defer os.Setenv("SOURCE_DATE_EPOCH", os.Getenv("SOURCE_DATE_EPOCH"))
+
+	for _, test := range []struct {
+		epoch    string
+		expected time.Time
+	}{
+		{"", time.Unix(0, 0)},
+		{"1700000000", time.Unix(1700000000, 0)},
+	} {
+		os.Setenv("SOURCE_DATE_EPOCH", test.epoch)
+		if actual, err := archiveTime(); err != nil {
+			t.Fatal(err)
+		} else if !actual.Equal(test.expected) {
+			t.Errorf("expected %s, actual %s", test.expected, actual)
+		}
+	}
+	os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if _, err := archiveTime(); err == nil {
+		t.Error("expected error for invalid SOURCE_DATE_EPOCH")
+	}
+}
+
+func TestCreateArchive(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	for _, test := range []struct {
+		name       string
+		decompress func(b []byte) (io.Reader, error)
+	}{
+		{"jail.tar", func(b []byte) (io.Reader, error) {
+			return bytes.NewReader(b), nil
+		}},
+		{"jail.tar.gz", func(b []byte) (io.Reader, error) {
+			return gzip.NewReader(bytes.NewReader(b))
+		}},
+		{"jail.tar.zst", func(b []byte) (io.Reader, error) {
+			cmd := exec.Command("zstd", "-d", "-c")
+			cmd.Stdin = bytes.NewReader(b)
+			out, err := cmd.Output()
+			return bytes.NewReader(out), err
+		}},
+	} {
+		if filepath.Ext(test.name) == ".zst" {
+			if _, err := exec.LookPath("zstd"); err != nil {
+				t.Logf("%s: skipped, %s", test.name, err)
+				continue
+			}
+		}
+		filename := filepath.Join(td, test.name)
+		a, err := createArchive("tar", filename, "", sink.ImageConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := action.Directory(a, spec.NewDirectory("/etc")); err != nil {
+			a.discard()
+			t.Fatal(err)
+		}
+		if err := a.commit(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := test.decompress(b)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		names := tarNames(t, r)
+		if len(names) != 1 || names[0] != "etc/" {
+			t.Errorf("%s: expected [etc/], actual %v", test.name, names)
+		}
+	}
+	// Only the archives are left
+	if fis, err := ioutil.ReadDir(td); err != nil {
+		t.Fatal(err)
+	} else {
+		for _, fi := range fis {
+			if fi.Name()[0] == '.' {
+				t.Errorf("expected no temporary files, actual %s",
+					fi.Name())
+			}
+		}
+	}
+}
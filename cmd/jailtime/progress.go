@@ -0,0 +1,318 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Progress reporting and cancellation of updates
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCancelled is returned by tasks that did not run because the update
+// was cancelled.
+var errCancelled = errors.New("cancelled")
+
+// Signal that cancelled the update, zero if none
+var cancelled int32
+
+// cancel makes running copies stop and keeps further tasks from starting.
+func cancel(sig int) {
+	atomic.StoreInt32(&cancelled, int32(sig))
+}
+
+// cancelSignal returns the signal that cancelled the update, or zero.
+func cancelSignal() int {
+	return int(atomic.LoadInt32(&cancelled))
+}
+
+// progressFormat selects how progress is reported.
+type progressFormat int
+
+const (
+	progressNone progressFormat = iota
+	progressText                // Status line on terminals, log otherwise
+	progressJSON                // One JSON object per line
+)
+
+// progressValue implements the --progress[=FORMAT] flag. Without a value,
+// it means text.
+type progressValue progressFormat
+
+func (v *progressValue) String() string {
+	switch progressFormat(*v) {
+	case progressText:
+		return "text"
+	case progressJSON:
+		return "json"
+	}
+	return "none"
+}
+
+func (v *progressValue) Set(s string) error {
+	switch s {
+	case "text", "true":
+		*v = progressValue(progressText)
+	case "json":
+		*v = progressValue(progressJSON)
+	case "none", "false":
+		*v = progressValue(progressNone)
+	default:
+		return fmt.Errorf("invalid argument '%s' for progress", s)
+	}
+	return nil
+}
+
+func (v *progressValue) IsBoolFlag() bool {
+	return true
+}
+
+// progressRecord is a progress report in JSON format.
+type progressRecord struct {
+	Statements     int     `json:"statements"`
+	StatementsDone int     `json:"statements_done"`
+	Bytes          int64   `json:"bytes"`
+	BytesDone      int64   `json:"bytes_done"`
+	Current        string  `json:"current,omitempty"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETASeconds     int64   `json:"eta_seconds"` // -1 if unknown
+	Done           bool    `json:"done"`
+	Cancelled      bool    `json:"cancelled,omitempty"`
+}
+
+// progress tracks how far an update is and reports it on standard error.
+type progress struct {
+	sync.Mutex
+	format   progressFormat
+	w        io.Writer
+	tty      bool          // Redraw a status line
+	interval time.Duration // Minimum time between reports
+	start    time.Time
+	reported time.Time
+	shown    bool // A status line is on the terminal
+
+	statements, statementsDone int
+	bytes, bytesDone           int64
+	current                    string
+}
+
+// newProgress returns a progress for an update with the given number of
+// statements that copy the given number of bytes.
+func newProgress(format progressFormat, statements int,
+	bytes int64) *progress {
+	p := &progress{format: format, w: os.Stderr, start: time.Now(),
+		statements: statements, bytes: bytes}
+	switch format {
+	case progressText:
+		fi, err := os.Stderr.Stat()
+		p.tty = err == nil && fi.Mode()&os.ModeCharDevice != 0
+		p.interval = 5 * time.Second
+		if p.tty {
+			p.interval = 100 * time.Millisecond
+		}
+	case progressJSON:
+		p.interval = time.Second
+	}
+	return p
+}
+
+// startFile notes that copying the file at target, which has size bytes,
+// has started. It returns a callback for copy.Options.Progress, which stops
+// the copy once the update is cancelled, and a function to call when done
+// with the file.
+func (p *progress) startFile(target string,
+	size int64) (func(written, total int64) bool, func()) {
+	p.Lock()
+	p.current = target
+	p.Unlock()
+	var counted int64
+	update := func(written, total int64) bool {
+		p.Lock()
+		p.bytesDone += written - counted
+		counted = written
+		p.report(false)
+		p.Unlock()
+		return cancelSignal() == 0
+	}
+	done := func() {
+		// Account for unchanged files and data that was not copied
+		p.Lock()
+		p.bytesDone += size - counted
+		counted = size
+		p.Unlock()
+	}
+	return update, done
+}
+
+// statementDone notes that one more statement was applied.
+func (p *progress) statementDone() {
+	p.Lock()
+	p.statementsDone++
+	p.report(false)
+	p.Unlock()
+}
+
+// finish reports the final state.
+func (p *progress) finish() {
+	p.Lock()
+	p.current = ""
+	p.report(true)
+	p.Unlock()
+}
+
+// clear removes the status line from the terminal, so that other output
+// can be written. It is drawn again with the next report.
+func (p *progress) clear() {
+	p.Lock()
+	p.clearLine()
+	p.Unlock()
+}
+
+// Must be called with p locked.
+func (p *progress) clearLine() {
+	if p.shown {
+		fmt.Fprint(p.w, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// output returns a writer for w that keeps the output apart from the status
+// line.
+func (p *progress) output(w io.Writer) io.Writer {
+	if !p.tty {
+		return w
+	}
+	return progressOutput{p, w}
+}
+
+type progressOutput struct {
+	p *progress
+	w io.Writer
+}
+
+func (o progressOutput) Write(b []byte) (int, error) {
+	o.p.clear()
+	return o.w.Write(b)
+}
+
+// record returns the current state. Must be called with p locked.
+func (p *progress) record(final bool) progressRecord {
+	r := progressRecord{
+		Statements:     p.statements,
+		StatementsDone: p.statementsDone,
+		Bytes:          p.bytes,
+		BytesDone:      p.bytesDone,
+		Current:        p.current,
+		ETASeconds:     -1,
+		Done:           final,
+		Cancelled:      cancelSignal() != 0,
+	}
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		r.BytesPerSecond = float64(p.bytesDone) / elapsed
+	}
+	if final {
+		r.ETASeconds = 0
+	} else if r.BytesPerSecond > 0 {
+		r.ETASeconds = int64(float64(p.bytes-p.bytesDone) /
+			r.BytesPerSecond)
+	}
+	return r
+}
+
+// report writes the current state if the last report was long enough ago,
+// or if final is set. Must be called with p locked.
+func (p *progress) report(final bool) {
+	if p.format == progressNone {
+		return
+	}
+	now := time.Now()
+	if !final && now.Sub(p.reported) < p.interval {
+		return
+	}
+	p.reported = now
+	r := p.record(final)
+	if p.format == progressJSON {
+		b, err := json.Marshal(r)
+		if err == nil {
+			fmt.Fprintf(p.w, "%s\n", b)
+		}
+		return
+	}
+	line := fmt.Sprintf("%d/%d statements, %s/%s, %s/s", r.StatementsDone,
+		r.Statements, formatBytes(r.BytesDone), formatBytes(r.Bytes),
+		formatBytes(int64(r.BytesPerSecond)))
+	if !final && r.ETASeconds >= 0 {
+		line += fmt.Sprintf(", ETA %s",
+			time.Duration(r.ETASeconds)*time.Second)
+	}
+	if r.Cancelled {
+		line += ", cancelled"
+	} else if r.Current != "" {
+		line += ": " + shortenPath(r.Current, 40)
+	}
+	if !p.tty {
+		log.Printf("%s\n", line)
+		return
+	}
+	p.clearLine()
+	fmt.Fprint(p.w, line)
+	p.shown = true
+	if final {
+		fmt.Fprintln(p.w)
+		p.shown = false
+	}
+}
+
+// formatBytes formats n using binary prefixes, like "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div),
+		"KMGTPE"[exp])
+}
+
+// shortenPath returns path, with leading characters replaced by "..." so
+// that it is at most max characters long.
+func shortenPath(path string, max int) string {
+	if len(path) <= max {
+		return path
+	}
+	return "..." + path[len(path)-max+3:]
+}
@@ -0,0 +1,151 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for progress reports
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestProgressValue(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{nil, "none"},
+		{[]string{"--progress"}, "text"},
+		{[]string{"--progress=text"}, "text"},
+		{[]string{"--progress=true"}, "text"},
+		{[]string{"--progress=json"}, "json"},
+		{[]string{"--progress=none"}, "none"},
+		{[]string{"--progress=false"}, "none"},
+	} {
+		var v progressValue
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Var(&v, "progress", "")
+		if err := fs.Parse(test.args); err != nil {
+			t.Errorf("%v: expected no error, actual %s", test.args, err)
+		} else if actual := v.String(); actual != test.expected {
+			t.Errorf("%v: expected %s, actual %s", test.args, test.expected,
+				actual)
+		}
+	}
+	var v progressValue
+	if err := v.Set("xml"); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
+
+// progressRecords decodes the JSON progress records in r.
+func progressRecords(t *testing.T, r io.Reader) []progressRecord {
+	t.Helper()
+	var records []progressRecord
+	d := json.NewDecoder(r)
+	for {
+		var rec progressRecord
+		if err := d.Decode(&rec); err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestProgressJSON(t *testing.T) {
+	var b bytes.Buffer
+	p := newProgress(progressJSON, 2, 100)
+	p.w = &b
+
+	// The first update is reported right away, later ones are throttled
+	update, done := p.startFile("/bin/a", 60)
+	if !update(20, 60) {
+		t.Error("expected copy to continue")
+	}
+	update(50, 60)
+	done()
+	p.statementDone()
+
+	// Files that are not copied still count as done
+	_, done = p.startFile("/bin/b", 40)
+	done()
+	p.statementDone()
+	p.finish()
+
+	records := progressRecords(t, &b)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, actual %d", len(records))
+	}
+	first := records[0]
+	if first.Current != "/bin/a" || first.BytesDone != 20 || first.Done {
+		t.Errorf("expected /bin/a with 20 bytes done, actual %+v", first)
+	}
+	last := records[1]
+	expected := progressRecord{Statements: 2, StatementsDone: 2,
+		Bytes: 100, BytesDone: 100, BytesPerSecond: last.BytesPerSecond,
+		Done: true}
+	if last != expected {
+		t.Errorf("expected %+v, actual %+v", expected, last)
+	}
+}
+
+func TestProgressBytes(t *testing.T) {
+	p := newProgress(progressNone, 1, 100)
+	update, done := p.startFile("/bin/a", 100)
+	update(30, 100)
+	update(80, 100)
+	if p.bytesDone != 80 {
+		t.Errorf("expected 80, actual %d", p.bytesDone)
+	}
+	// A file that changed size while copying is accounted with the size
+	// it was planned with
+	update(120, 120)
+	done()
+	if p.bytesDone != 100 {
+		t.Errorf("expected 100, actual %d", p.bytesDone)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, test := range []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+	} {
+		if actual := formatBytes(test.n); actual != test.expected {
+			t.Errorf("expected %s, actual %s", test.expected, actual)
+		}
+	}
+}
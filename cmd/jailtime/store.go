@@ -0,0 +1,83 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Maintenance of the shared store
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"blichmann.eu/code/jailtime/pkg/store"
+)
+
+// runStore implements the store subcommand.
+func runStore(args []string) {
+	if len(args) == 0 || args[0] != "gc" {
+		log.Fatalf("missing or unknown store command, expected 'gc'\n"+
+			"Try '%s store gc --help' for more information.\n", os.Args[0])
+	}
+	fs := flag.NewFlagSet("store gc", flag.ExitOnError)
+	gcDryRun := fs.Bool("dry-run", false, "don't remove anything, just "+
+		"print")
+	gcVerbose := fs.Bool("verbose", false, "print each file that is removed")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s store gc [OPTION]... DIR\n"+
+			"Remove the objects from the store in DIR that no jail uses "+
+			"anymore. Manifests\n"+
+			"of jails that no longer exist are removed first.\n\n",
+			os.Args[0])
+		fs.VisitAll(func(f *flag.Flag) {
+			fmt.Printf("      --%-23s %s\n", f.Name, f.Usage)
+		})
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		log.Fatalf("expected a single store directory\nTry '%s store gc "+
+			"--help' for more information.\n", os.Args[0])
+	}
+	if _, err := os.Stat(fs.Arg(0)); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	s, err := store.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	files := 0
+	freed, err := s.GC(*gcDryRun, func(path string) {
+		files++
+		if *gcVerbose || *gcDryRun {
+			fmt.Printf("remove: %s\n", path)
+		}
+	})
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	fmt.Printf("removed %d files, %s freed\n", files, formatBytes(freed))
+}
@@ -0,0 +1,138 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Ordering of the steps that update a chroot
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"path/filepath"
+
+	"blichmann.eu/code/jailtime/internal/spec"
+)
+
+// planTasks returns the steps to update a chroot with stmts, which must be
+// sorted. A nil statement stands for writing the loader config. Commands
+// may need it, so it comes before the first of them, or last if there are
+// none.
+func planTasks(stmts spec.Statements, ldConfig bool) []spec.Statement {
+	tasks := make([]spec.Statement, 0, len(stmts)+1)
+	for _, s := range stmts {
+		if _, ok := s.(spec.Run); ok && ldConfig {
+			tasks = append(tasks, nil)
+			ldConfig = false
+		}
+		tasks = append(tasks, s)
+	}
+	if ldConfig {
+		tasks = append(tasks, nil)
+	}
+	return tasks
+}
+
+// isBarrier returns whether s must run after all tasks before it and
+// before all tasks after it. Commands and the loader config may use any
+// file in the chroot.
+func isBarrier(s spec.Statement) bool {
+	if s == nil {
+		return true
+	}
+	_, ok := s.(spec.Run)
+	return ok
+}
+
+// linkDestination returns the path in the chroot that the symlink l points
+// to.
+func linkDestination(l spec.Link) string {
+	dest := l.Source()
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(l.Target()), dest)
+	}
+	return dest
+}
+
+// taskDependencies returns the tasks that each of tasks has to wait for:
+// Directories come before anything inside of them, files before links that
+// point to them, and statements with the same target keep their order.
+// Barriers stay at their place.
+func taskDependencies(tasks []spec.Statement) [][]int {
+	deps := make([][]int, len(tasks))
+	// Last task for each target, separately between each pair of barriers
+	var segments []map[string]int
+	byTarget := make(map[string]int)
+	barrier := -1
+	for i, s := range tasks {
+		if isBarrier(s) {
+			for j := barrier + 1; j < i; j++ {
+				deps[i] = append(deps[i], j)
+			}
+			if barrier >= 0 {
+				deps[i] = append(deps[i], barrier)
+			}
+			barrier = i
+			segments = append(segments, byTarget)
+			byTarget = make(map[string]int)
+			continue
+		}
+		if barrier >= 0 {
+			deps[i] = append(deps[i], barrier)
+		}
+		target := s.Target()
+		if j, ok := byTarget[target]; ok {
+			deps[i] = append(deps[i], j)
+		}
+		for dir := target; dir != filepath.Dir(dir); {
+			dir = filepath.Dir(dir)
+			if j, ok := byTarget[dir]; ok {
+				deps[i] = append(deps[i], j)
+				break
+			}
+		}
+		byTarget[target] = i
+	}
+	segments = append(segments, byTarget)
+
+	// Symlinks may point to files that come later. Hard links are made to
+	// files on the host.
+	segment := 0
+	for i, s := range tasks {
+		if isBarrier(s) {
+			segment++
+			continue
+		}
+		l, ok := s.(spec.Link)
+		if !ok || l.HardLink() {
+			continue
+		}
+		j, ok := segments[segment][linkDestination(l)]
+		if !ok || j == i {
+			continue
+		}
+		if _, ok := tasks[j].(spec.Link); !ok {
+			deps[i] = append(deps[i], j)
+		}
+	}
+	return deps
+}
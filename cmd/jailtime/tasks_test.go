@@ -0,0 +1,96 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for update task planning
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"blichmann.eu/code/jailtime/internal/spec"
+)
+
+func TestPlanTasks(t *testing.T) {
+	file := spec.NewRegularFile("/bin/sh", "/bin/sh")
+	run := spec.NewRun("true")
+	for _, test := range []struct {
+		stmts    spec.Statements
+		ldConfig bool
+		expected []spec.Statement
+	}{
+		{spec.Statements{file}, false, []spec.Statement{file}},
+		{spec.Statements{file}, true, []spec.Statement{file, nil}},
+		{spec.Statements{file, run, run}, true,
+			[]spec.Statement{file, nil, run, run}},
+		{spec.Statements{file, run}, false, []spec.Statement{file, run}},
+	} {
+		actual := planTasks(test.stmts, test.ldConfig)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("expected %v, actual %v", test.expected, actual)
+		}
+	}
+}
+
+func TestTaskDependencies(t *testing.T) {
+	// Task indexes, the loader config is task 9
+	deps := taskDependencies(planTasks(spec.Statements{
+		spec.NewDirectory("/bin"),                            // 0
+		spec.NewDirectory("/etc"),                            // 1
+		spec.NewRegularFile("/bin/bash", "/bin/bash"),        // 2
+		spec.NewRegularFile("/etc/a", "/etc/motd"),           // 3
+		spec.NewRegularFile("/etc/b", "/etc/motd"),           // 4
+		spec.NewLink("bash", "/bin/sh", false),               // 5
+		spec.NewLink("/bin/sh", "/bin/rbash", false),         // 6
+		spec.NewLink("/bin/bash", "/bin/hardlink", true),     // 7
+		spec.NewLink("/etc/missing", "/etc/dangling", false), // 8
+		spec.NewRun("ldconfig"),                              // 10
+		spec.NewRun("true"),                                  // 11
+	}, true))
+	for _, test := range []struct {
+		task     int
+		expected []int
+	}{
+		{0, nil},
+		{1, nil},
+		{2, []int{0}}, // Parent directory first
+		{3, []int{1}},
+		{4, []int{3, 1}}, // Same target in order
+		{5, []int{0, 2}}, // Symlink after its target
+		{6, []int{0}},    // Links to links need no order
+		{7, []int{0}},    // Hard links point to the host
+		{8, []int{1}},
+		{9, []int{0, 1, 2, 3, 4, 5, 6, 7, 8}}, // Loader config
+		{10, []int{9}},
+		{11, []int{10}},
+	} {
+		if actual := deps[test.task]; !reflect.DeepEqual(actual,
+			test.expected) {
+			t.Errorf("task %d: expected %v, actual %v", test.task,
+				test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Verification of copies
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"blichmann.eu/code/jailtime/internal/action"
+	"blichmann.eu/code/jailtime/internal/sink"
+	"blichmann.eu/code/jailtime/internal/spec"
+	"blichmann.eu/code/jailtime/pkg/copy"
+	"blichmann.eu/code/jailtime/pkg/store"
+)
+
+// verifyCopy checks that the copy of f at target has the same contents as
+// its source and copies it to out again once if not. Returns the SHA-256
+// hash of the copy.
+func verifyCopy(w io.Writer, out sink.Sink, target string, f spec.RegularFile,
+	copts *copy.Options) (string, error) {
+	for retried := false; ; retried = true {
+		want, err := store.Hash(f.Source())
+		if err != nil {
+			return "", err
+		}
+		got, err := store.Hash(target)
+		if err != nil {
+			return "", err
+		}
+		if got == want {
+			return got, nil
+		}
+		if retried {
+			return "", fmt.Errorf("%s: copy does not match %s (sha256 %s, "+
+				"copy sha256 %s)", f.Target(), f.Source(), want, got)
+		}
+		if *verbose {
+			fmt.Fprintf(w, "verify failed, copy again: %s\n", f.Target())
+		}
+		if _, err := action.RegularFile(out, f, copts); err != nil {
+			return "", err
+		}
+	}
+}
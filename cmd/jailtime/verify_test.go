@@ -0,0 +1,141 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for the verification of copies
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"blichmann.eu/code/jailtime/internal/sink"
+	"blichmann.eu/code/jailtime/internal/spec"
+	"blichmann.eu/code/jailtime/pkg/store"
+)
+
+func TestVerifyCopy(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	source := filepath.Join(td, "source")
+	if err := ioutil.WriteFile(source, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := store.Hash(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chroot := filepath.Join(td, "chroot")
+	if err := os.Mkdir(chroot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f := spec.NewRegularFile(source, "/file")
+	target := filepath.Join(chroot, "file")
+
+	// A bad copy is copied once more
+	if err := ioutil.WriteFile(target, []byte("date"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := verifyCopy(ioutil.Discard, sink.NewDir(chroot), target,
+		f, nil); err != nil {
+		t.Fatal(err)
+	} else if sum != want {
+		t.Errorf("expected %s, actual %s", want, sum)
+	}
+	if b, err := ioutil.ReadFile(target); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "data" {
+		t.Errorf("expected data, actual %s", b)
+	}
+
+	// If copying again does not help, both hashes are reported
+	if err := ioutil.WriteFile(target, []byte("date"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Hash(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifyCopy(ioutil.Discard, sink.NewMemory(), target, f, nil)
+	if err == nil {
+		t.Fatal("expected error for a copy that stays different")
+	} else if !strings.Contains(err.Error(), want) ||
+		!strings.Contains(err.Error(), got) {
+		t.Errorf("expected both hashes, actual %s", err)
+	}
+}
+
+func TestSkippedSum(t *testing.T) {
+	td, err := ioutil.TempDir("", "jailtime_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	file := filepath.Join(td, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := store.Hash(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const recorded = "0123456789abcdef0123456789abcdef" +
+		"0123456789abcdef0123456789abcdef"
+	u := &update{chrootDir: td, manifest: &store.Manifest{Jail: td,
+		Files: map[string]string{"/recorded": recorded}}}
+	for _, test := range []struct {
+		s        spec.Statement
+		expected string
+	}{
+		{spec.NewRegularFile(file, "/recorded"), recorded},
+		{spec.NewRegularFile(file, "/file"), sum}, // No entry yet
+		{spec.NewRegularFile(file, "/missing"), ""},
+		{spec.NewDirectory("/file"), ""},
+	} {
+		target := filepath.Join(td, test.s.Target())
+		if actual, err := u.skippedSum(target, test.s); err != nil &&
+			!os.IsNotExist(err) {
+			t.Fatal(err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected %q, actual %q", test.s.Target(),
+				test.expected, actual)
+		}
+	}
+
+	// Without a manifest, nothing is hashed
+	u.manifest = nil
+	s := spec.NewRegularFile(file, "/file")
+	if actual, err := u.skippedSum(file, s); err != nil || actual != "" {
+		t.Errorf("expected no hash, actual %q (%v)", actual, err)
+	}
+}
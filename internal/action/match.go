@@ -0,0 +1,90 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Checks whether statements are already applied
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package action
+
+import (
+	"os"
+	"syscall"
+
+	"blichmann.eu/code/jailtime/internal/sink"
+	"blichmann.eu/code/jailtime/internal/spec"
+)
+
+// Exists returns whether something exists at target, without following
+// symlinks.
+func Exists(target string) bool {
+	_, err := os.Lstat(target)
+	return err == nil
+}
+
+// DirectoryMatches returns whether target is a directory with the mode d
+// asks for. If d does not specify a mode, any directory matches.
+func DirectoryMatches(target string, d spec.Directory) bool {
+	fi, err := os.Lstat(target)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	mode := d.FileAttr().Mode
+	return mode == spec.FileModeUnspecified ||
+		fi.Mode().Perm() == os.FileMode(mode).Perm()
+}
+
+// LinkMatches returns whether target is already the symlink or hard link l
+// creates.
+func LinkMatches(target string, l spec.Link) bool {
+	if l.HardLink() {
+		fi, err := os.Lstat(target)
+		if err != nil {
+			return false
+		}
+		other, err := os.Lstat(l.Source())
+		return err == nil && os.SameFile(fi, other)
+	}
+	value, err := os.Readlink(target)
+	return err == nil && value == l.Source()
+}
+
+// DeviceMatches returns whether target is a device node of the type, device
+// number and mode d asks for.
+func DeviceMatches(target string, d spec.Device) bool {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	mode := d.FileAttr().Mode
+	if mode == spec.FileModeUnspecified {
+		mode = 0644
+	}
+	return int(st.Mode)&syscall.S_IFMT == d.Type() &&
+		uint64(st.Rdev) == uint64(sink.MakeDev(d.Major(), d.Minor())) &&
+		fi.Mode().Perm() == os.FileMode(mode).Perm()
+}
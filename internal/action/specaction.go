@@ -32,56 +32,64 @@ import (
 	"os/exec"
 	"syscall"
 
+	"blichmann.eu/code/jailtime/internal/sink"
 	"blichmann.eu/code/jailtime/internal/spec"
 	"blichmann.eu/code/jailtime/pkg/copy"
 )
 
-func Directory(target string, d spec.Directory) error {
-	mode := d.FileAttr().Mode
-	if mode == spec.FileModeUnspecified {
-		mode = 0755
+// header returns the header for the entry of s with the given type and
+// default mode, which is used if the spec does not specify one.
+func header(s spec.Statement, type_ uint32, mode int) *sink.Header {
+	fa := s.FileAttr()
+	h := &sink.Header{Name: s.Target(), UID: fa.UID, GID: fa.GID,
+		OwnerSet: fa.UID != spec.OwnerUnspecified}
+	if fa.Mode != spec.FileModeUnspecified {
+		mode, h.ModeSet = fa.Mode, true
 	}
-	return os.MkdirAll(target, os.FileMode(mode))
+	h.Mode = sink.FileMode(type_ | uint32(mode))
+	return h
 }
 
-func RegularFile(target string, f spec.RegularFile, copts *copy.Options) error {
-	if _, err := copy.File(f.Source(), target, copts); err != nil {
-		return err
-	}
-	if mode := f.FileAttr().Mode; mode != spec.FileModeUnspecified {
-		return os.Chmod(target, os.FileMode(mode))
-	}
-	return nil
+func Directory(out sink.Sink, d spec.Directory) error {
+	return out.Mkdir(header(d, syscall.S_IFDIR, 0755))
 }
 
-func Link(target string, l spec.Link) error {
-	if _, err := os.Stat(target); err == nil { // Link exists
-		if err = os.Remove(target); err != nil {
+func RegularFile(out sink.Sink, f spec.RegularFile,
+	copts *copy.Options) (copy.Result, error) {
+	return out.CopyFile(header(f, syscall.S_IFREG, 0644), f.Source(), copts)
+}
+
+// RewriteFile replaces the copy of f with data, for copies that are changed
+// after copying. Its mode is the same as with RegularFile.
+func RewriteFile(out sink.Sink, f spec.RegularFile, data []byte,
+	copts *copy.Options) error {
+	h := header(f, syscall.S_IFREG, 0644)
+	if !h.ModeSet {
+		fi, err := os.Stat(f.Source())
+		if err != nil {
 			return err
 		}
+		h.Mode = fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid)
 	}
-	linkName := l.Source()
+	return out.WriteFile(h, data, copts)
+}
+
+func Link(out sink.Sink, l spec.Link) error {
+	h := header(l, syscall.S_IFLNK, 0777)
+	h.Linkname = l.Source()
 	if l.HardLink() {
-		return os.Link(linkName, target)
+		return out.Link(h)
 	}
-	return os.Symlink(linkName, target)
+	return out.Symlink(h)
 }
 
-func Device(target string, d spec.Device) error {
-	if _, err := os.Stat(target); err == nil { // Device exists
-		if err = os.Remove(target); err != nil {
-			return err
-		}
-	}
-	mode := d.FileAttr().Mode
-	if mode == spec.FileModeUnspecified {
-		mode = 0644
-	}
-	return syscall.Mknod(target, uint32(d.Type()|mode),
-		MakeDev(d.Major(), d.Minor()))
+func Device(out sink.Sink, d spec.Device) error {
+	h := header(d, uint32(d.Type()), 0644)
+	h.Major, h.Minor = d.Major(), d.Minor()
+	return out.Mknod(h)
 }
 
-func Run(target string, r spec.Run, chrootDir string) error {
+func Run(r spec.Run, chrootDir string) error {
 	cmd := exec.Command("/bin/sh", "-c", r.Command())
 	cmd.Dir = chrootDir
 	cmd.Stdout = os.Stdout
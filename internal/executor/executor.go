@@ -0,0 +1,171 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Concurrent execution of dependent tasks
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package executor runs tasks that depend on each other concurrently, while
+// keeping their output and errors in task order.
+package executor
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// ErrCycle is returned if the tasks cannot be ordered.
+var ErrCycle = errors.New("dependency cycle between tasks")
+
+// Func performs task i and writes its output to w.
+type Func func(i int, w io.Writer) error
+
+// executor keeps the output of tasks in order. The task at next writes to
+// out directly, later ones are buffered until all tasks before them have
+// finished.
+type executor struct {
+	sync.Mutex
+	out      io.Writer
+	bufs     []bytes.Buffer
+	finished []bool
+	next     int // First task that has not finished
+}
+
+type taskWriter struct {
+	e *executor
+	i int
+}
+
+func (w taskWriter) Write(p []byte) (int, error) {
+	w.e.Lock()
+	defer w.e.Unlock()
+	if w.i == w.e.next {
+		return w.e.out.Write(p)
+	}
+	return w.e.bufs[w.i].Write(p)
+}
+
+// finish marks task i as finished and writes out the buffered output of
+// the following tasks, up to the first one that is still running.
+// Must be called with e locked.
+func (e *executor) finish(i int) {
+	e.finished[i] = true
+	for e.next < len(e.finished) && e.finished[e.next] {
+		e.next++
+		if e.next < len(e.bufs) {
+			e.out.Write(e.bufs[e.next].Bytes())
+			e.bufs[e.next] = bytes.Buffer{}
+		}
+	}
+}
+
+type result struct {
+	i   int
+	err error
+}
+
+// Run calls do for all tasks, with up to jobs tasks running at the same
+// time. deps[i] lists the tasks that must finish successfully before task i
+// may start. Among the tasks that are ready, the ones with the lowest
+// numbers start first, so that with a single job, tasks run in order
+// whenever their dependencies allow it. Output written by a task appears
+// on out after the output of all tasks with lower numbers.
+//
+// If a task fails, no tasks with higher numbers are started, but the ones
+// with lower numbers still run. The error returned is the one of the
+// lowest-numbered failing task, which does not depend on timing.
+func Run(deps [][]int, jobs int, out io.Writer, do Func) error {
+	n := len(deps)
+	if jobs < 1 {
+		jobs = 1
+	}
+	e := &executor{out: out, bufs: make([]bytes.Buffer, n),
+		finished: make([]bool, n)}
+
+	pending := make([]int, n) // Number of unfinished dependencies
+	dependents := make([][]int, n)
+	var ready []int // Sorted
+	for i, d := range deps {
+		pending[i] = len(d)
+		for _, j := range d {
+			dependents[j] = append(dependents[j], i)
+		}
+		if len(d) == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	done := make(chan result)
+	failed := n // Lowest-numbered failed task
+	var err error
+	running, completed := 0, 0
+	for {
+		for running < jobs && len(ready) > 0 && ready[0] < failed {
+			i := ready[0]
+			ready = ready[1:]
+			running++
+			go func(i int) {
+				done <- result{i, do(i, taskWriter{e, i})}
+			}(i)
+		}
+		if running == 0 {
+			break
+		}
+		r := <-done
+		running--
+		e.Lock()
+		e.finish(r.i)
+		e.Unlock()
+		if r.err != nil {
+			if r.i < failed {
+				failed, err = r.i, r.err
+			}
+			continue
+		}
+		completed++
+		for _, j := range dependents[r.i] {
+			if pending[j]--; pending[j] == 0 {
+				k := sort.SearchInts(ready, j)
+				ready = append(ready, 0)
+				copy(ready[k+1:], ready[k:])
+				ready[k] = j
+			}
+		}
+	}
+
+	// Write out what is left of the output of tasks that did run
+	e.Lock()
+	for i := e.next; i < n; i++ {
+		if !e.finished[i] {
+			e.finish(i)
+		}
+	}
+	e.Unlock()
+	if err == nil && completed != n {
+		err = ErrCycle
+	}
+	return err
+}
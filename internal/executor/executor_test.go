@@ -0,0 +1,134 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for concurrent execution of dependent tasks
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunOrder(t *testing.T) {
+	const n = 50
+	deps := make([][]int, n)
+	for i := 1; i < n; i++ {
+		// A chain every five tasks, the others are independent
+		if i%5 == 0 {
+			deps[i] = []int{i - 5}
+		}
+	}
+	// Forward dependency
+	deps[3] = []int{40}
+
+	var (
+		mu       sync.Mutex
+		finished = make(map[int]bool)
+		expected bytes.Buffer
+		actual   bytes.Buffer
+	)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&expected, "start %d\nend %d\n", i, i)
+	}
+	err := Run(deps, 8, &actual, func(i int, w io.Writer) error {
+		mu.Lock()
+		for _, j := range deps[i] {
+			if !finished[j] {
+				t.Errorf("task %d started before task %d finished", i, j)
+			}
+		}
+		mu.Unlock()
+		fmt.Fprintf(w, "start %d\n", i)
+		time.Sleep(time.Duration(n-i) * 100 * time.Microsecond)
+		fmt.Fprintf(w, "end %d\n", i)
+		mu.Lock()
+		finished[i] = true
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, actual %s", err)
+	}
+	if len(finished) != n {
+		t.Errorf("expected %d tasks, actual %d", n, len(finished))
+	}
+	if actual.String() != expected.String() {
+		t.Errorf("expected %q, actual %q", expected.String(), actual.String())
+	}
+}
+
+func TestRunError(t *testing.T) {
+	deps := make([][]int, 20)
+	deps[12] = []int{11}
+	for jobs := 1; jobs <= 8; jobs *= 2 {
+		var out bytes.Buffer
+		var mu sync.Mutex
+		started := make(map[int]bool)
+		err := Run(deps, jobs, &out, func(i int, w io.Writer) error {
+			mu.Lock()
+			started[i] = true
+			mu.Unlock()
+			fmt.Fprintf(w, "%d\n", i)
+			if i == 7 || i == 11 {
+				// Let the later error happen first
+				if i == 7 {
+					time.Sleep(5 * time.Millisecond)
+				}
+				return fmt.Errorf("task %d failed", i)
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "task 7 failed" {
+			t.Errorf("expected task 7 failed, actual %v", err)
+		}
+		if started[12] {
+			t.Error("expected task 12 not to start")
+		}
+		for i := 0; i < 7; i++ {
+			if !started[i] {
+				t.Errorf("expected task %d to run", i)
+			}
+		}
+		if jobs == 1 && strings.Count(out.String(), "\n") != 8 {
+			t.Errorf("expected 8 tasks, actual output %q", out.String())
+		}
+	}
+}
+
+func TestRunCycle(t *testing.T) {
+	deps := [][]int{nil, {2}, {1}}
+	err := Run(deps, 2, &bytes.Buffer{}, func(i int, w io.Writer) error {
+		return nil
+	})
+	if err != ErrCycle {
+		t.Errorf("expected %s, actual %v", ErrCycle, err)
+	}
+}
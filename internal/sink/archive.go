@@ -0,0 +1,154 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Entries of archive outputs
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// file is an entry of an archive with all of its attributes resolved.
+type file struct {
+	Entry
+	ModTime time.Time
+	Size    int64
+	Xattrs  map[string][]byte
+	Link    string // Earlier file with the same contents and attributes
+}
+
+// open returns the contents of the regular file f.
+func (f *file) open() (io.ReadCloser, error) {
+	if f.Data != nil {
+		return ioutil.NopCloser(bytes.NewReader(f.Data)), nil
+	}
+	return os.Open(f.Source)
+}
+
+// copyContents writes the contents of the regular file f to w.
+func (f *file) copyContents(w io.Writer) error {
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err = io.CopyN(w, r, f.Size); err == io.EOF {
+		return fmt.Errorf("%s: file changed while adding it", f.Source)
+	}
+	return err
+}
+
+// linkKey identifies regular files that can be stored as hard links.
+type linkKey struct {
+	dev, ino uint64
+	mode     os.FileMode
+	uid, gid int
+	modTime  time.Time
+}
+
+// files returns the entries recorded in m for writing them to an archive,
+// sorted by name. Missing parent directories are added. Entries have the
+// modification time modTime unless the timestamps of their source are
+// preserved. Copies of the same host file with the same attributes become
+// hard links to the first one.
+func (m *Memory) files(modTime time.Time) ([]file, error) {
+	entries := m.Entries()
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	for _, e := range entries {
+		for dir := path.Dir(e.Name); !names[dir]; dir = path.Dir(dir) {
+			names[dir] = true
+			entries = append(entries, Entry{Header: Header{Name: dir,
+				Mode: os.ModeDir | 0755}})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	files := make([]file, 0, len(entries))
+	links := make(map[linkKey]string)
+	for _, e := range entries {
+		if e.Name == "/" {
+			continue // The root of the archive itself
+		}
+		f := file{Entry: e, ModTime: modTime}
+		if !e.OwnerSet {
+			f.UID, f.GID = 0, 0
+		}
+		if !e.Mode.IsRegular() {
+			files = append(files, f)
+			continue
+		}
+		if e.Source == "" {
+			f.Size = int64(len(e.Data))
+			files = append(files, f)
+			continue
+		}
+		fi, err := os.Stat(e.Source)
+		if err != nil {
+			return nil, err
+		}
+		st, _ := fi.Sys().(*syscall.Stat_t)
+		if e.Preserve&copy.PreserveOwnership != 0 && !e.OwnerSet &&
+			st != nil {
+			f.UID, f.GID = int(st.Uid), int(st.Gid)
+		}
+		if e.Preserve&copy.PreserveTimestamps != 0 {
+			f.ModTime = fi.ModTime()
+		}
+		if e.Preserve&copy.PreserveXattr != 0 {
+			if f.Xattrs, err = copy.Xattrs(e.Source); err != nil {
+				return nil, err
+			}
+		}
+		if e.Data != nil {
+			f.Size = int64(len(e.Data))
+		} else if f.Size = fi.Size(); st != nil && len(f.Xattrs) == 0 {
+			key := linkKey{uint64(st.Dev), uint64(st.Ino), f.Mode, f.UID,
+				f.GID, f.ModTime}
+			if name, ok := links[key]; ok {
+				f.Link = name
+			} else {
+				links[key] = e.Name
+			}
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
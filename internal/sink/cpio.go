@@ -0,0 +1,169 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * cpio archive output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cpio writes jails to a cpio archive in the SVR4 "newc" format, which the
+// Linux kernel reads for initramfs images. Like a Tar, it records ownership
+// and device nodes without needing root and is written sorted by name on
+// Close. Extended attributes cannot be recorded.
+type Cpio struct {
+	Memory
+	w       io.Writer
+	modTime time.Time
+}
+
+// NewCpio returns a Sink that writes a cpio archive to w. Entries have the
+// modification time modTime, unless the timestamps of their source are
+// preserved.
+func NewCpio(w io.Writer, modTime time.Time) *Cpio {
+	return &Cpio{w: w, modTime: modTime}
+}
+
+// cpioTrailer is the name of the entry that ends cpio archives.
+const cpioTrailer = "TRAILER!!!"
+
+// cpioHeader holds the fields of a newc header that jailtime sets. The
+// device of entries and their checksum are always zero.
+type cpioHeader struct {
+	ino, mode, uid, gid, nlink, mtime uint32
+	size, rdevMajor, rdevMinor        uint32
+}
+
+// cpioWriter writes a cpio archive, keeping track of its size for padding.
+type cpioWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (cw *cpioWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.offset += int64(n)
+	return n, err
+}
+
+// pad aligns the archive to a multiple of four bytes.
+func (cw *cpioWriter) pad() error {
+	_, err := cw.Write(make([]byte, (4-cw.offset%4)%4))
+	return err
+}
+
+// writeHeader writes the header h of the entry name, followed by the name.
+func (cw *cpioWriter) writeHeader(name string, h *cpioHeader) error {
+	_, err := fmt.Fprintf(cw, "070701%08X%08X%08X%08X%08X%08X%08X"+
+		"%08X%08X%08X%08X%08X%08X%s\x00", h.ino, h.mode, h.uid, h.gid,
+		h.nlink, h.mtime, h.size, 0, 0, h.rdevMajor, h.rdevMinor,
+		len(name)+1, 0, name)
+	if err == nil {
+		err = cw.pad()
+	}
+	return err
+}
+
+// Close writes the archive. The underlying writer is not closed.
+func (c *Cpio) Close() error {
+	files, err := c.files(c.modTime)
+	if err != nil {
+		return err
+	}
+	// Hard links share the inode of the first file and, like GNU cpio and
+	// the kernel expect, only the last one has the contents.
+	nlinks := make(map[string]uint32)
+	last := make(map[string]int)
+	for i := range files {
+		if first := files[i].Link; first != "" {
+			nlinks[first]++
+			last[first] = i
+		} else {
+			nlinks[files[i].Name]++
+			last[files[i].Name] = i
+		}
+	}
+
+	cw := &cpioWriter{w: c.w}
+	inodes := make(map[string]uint32, len(files))
+	for i := range files {
+		f := &files[i]
+		first := f.Name
+		if f.Link != "" {
+			first = f.Link
+		} else {
+			inodes[f.Name] = uint32(len(inodes) + 1)
+		}
+		mtime := f.ModTime.Unix()
+		if mtime < 0 || mtime > math.MaxUint32 {
+			return fmt.Errorf("%s: modification time %s cannot be "+
+				"archived", f.Name, f.ModTime)
+		}
+		h := cpioHeader{ino: inodes[first], mode: UnixMode(f.Mode),
+			uid: uint32(f.UID), gid: uint32(f.GID), nlink: 1,
+			mtime: uint32(mtime)}
+		switch m := f.Mode; {
+		case m.IsDir():
+			h.nlink = 2
+		case m&os.ModeSymlink != 0:
+			h.size = uint32(len(f.Linkname))
+		case m&os.ModeDevice != 0:
+			h.rdevMajor, h.rdevMinor = uint32(f.Major), uint32(f.Minor)
+		case m.IsRegular():
+			h.nlink = nlinks[first]
+			if last[first] != i {
+				break
+			}
+			if f.Size > math.MaxUint32 {
+				return fmt.Errorf("%s: files larger than 4 GiB cannot be "+
+					"archived", f.Name)
+			}
+			h.size = uint32(f.Size)
+		}
+		if err = cw.writeHeader(strings.TrimPrefix(f.Name, "/"),
+			&h); err != nil {
+			return err
+		}
+		if f.Mode&os.ModeSymlink != 0 {
+			_, err = io.WriteString(cw, f.Linkname)
+		} else if h.size > 0 {
+			err = f.copyContents(cw)
+		}
+		if err == nil {
+			err = cw.pad()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return cw.writeHeader(cpioTrailer, &cpioHeader{nlink: 1})
+}
@@ -0,0 +1,131 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for cpio archive output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// cpioEntry is an entry of a newc archive as read by readCpio.
+type cpioEntry struct {
+	name                  string
+	ino, mode, uid, gid   uint64
+	nlink, rmajor, rminor uint64
+	data                  string
+}
+
+// readCpio reads the entries of the newc archive, up to and including the
+// trailer.
+func readCpio(t *testing.T, archive []byte) []cpioEntry {
+	t.Helper()
+	var entries []cpioEntry
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for pos := 0; ; {
+		if len(archive) < pos+110 || string(archive[pos:pos+6]) != "070701" {
+			t.Fatalf("expected header at offset %d", pos)
+		}
+		var fields [13]uint64
+		for i := range fields {
+			off := pos + 6 + 8*i
+			v, err := strconv.ParseUint(string(archive[off:off+8]), 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields[i] = v
+		}
+		nameEnd := pos + 110 + int(fields[11]) - 1
+		e := cpioEntry{name: string(archive[pos+110 : nameEnd]),
+			ino: fields[0], mode: fields[1], uid: fields[2], gid: fields[3],
+			nlink: fields[4], rmajor: fields[9], rminor: fields[10]}
+		pos = align(nameEnd + 1)
+		e.data = string(archive[pos : pos+int(fields[6])])
+		pos = align(pos + int(fields[6]))
+		entries = append(entries, e)
+		if e.name == cpioTrailer {
+			if pos != len(archive) {
+				t.Errorf("expected %d bytes, actual %d", pos, len(archive))
+			}
+			return entries
+		}
+		if fields[5] != 1700000000 {
+			t.Errorf("%s: expected fixed modification time, actual %d",
+				e.name, fields[5])
+		}
+	}
+}
+
+func TestCpio(t *testing.T) {
+	td, err := ioutil.TempDir("", "sink_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	source := filepath.Join(td, "source")
+	if err := ioutil.WriteFile(source, []byte("data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cpioArchive := func(order []int) []byte {
+		var buf bytes.Buffer
+		addEntries(t, NewCpio(&buf, time.Unix(1700000000, 0)), source, order)
+		return buf.Bytes()
+	}
+	archive := cpioArchive([]int{0, 1, 2, 3, 4, 5})
+	if other := cpioArchive([]int{5, 3, 4, 2, 1,
+		0}); !bytes.Equal(archive, other) {
+		t.Error("expected the same archive regardless of order")
+	}
+
+	// Hard links share an inode, the last one has the contents
+	expected := []cpioEntry{
+		{"bin", 1, 040755, 0, 0, 2, 0, 0, ""},
+		{"bin/a", 2, 0100755, 0, 0, 2, 0, 0, ""},
+		{"bin/b", 2, 0100755, 0, 0, 2, 0, 0, "data"},
+		{"bin/c", 3, 0100755, 0, 0, 1, 0, 0, "stripped"},
+		{"bin/sh", 4, 0120777, 0, 0, 1, 0, 0, "a"},
+		{"dev", 5, 040755, 0, 0, 2, 0, 0, ""},
+		{"dev/null", 6, 020666, 0, 0, 1, 1, 3, ""},
+		{"home", 7, 040755, 0, 0, 2, 0, 0, ""},
+		{"home/user", 8, 040700, 1000, 100, 2, 0, 0, ""},
+		{cpioTrailer, 0, 0, 0, 0, 1, 0, 0, ""},
+	}
+	if actual := readCpio(t, archive); !reflect.DeepEqual(actual,
+		expected) {
+		t.Errorf("expected %v, actual %v", expected, actual)
+	}
+}
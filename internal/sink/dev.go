@@ -27,7 +27,7 @@
  * POSSIBILITY OF SUCH DAMAGE.
  */
 
-package action
+package sink
 
 // MakeDev creates a new device code using the given major and minor number.
 func MakeDev(major, minor int) int {
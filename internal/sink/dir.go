@@ -0,0 +1,123 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Directory output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// modeChmod are the mode bits that chmod(2) sets.
+const modeChmod = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Dir writes jails to a directory on the host. Ownership is not changed,
+// files belong to the user running jailtime.
+type Dir struct {
+	root string
+}
+
+// NewDir returns a Sink that writes to the directory root.
+func NewDir(root string) *Dir {
+	return &Dir{root: root}
+}
+
+// Path returns the path on the host of the entry name.
+func (d *Dir) Path(name string) string {
+	return filepath.Join(d.root, name)
+}
+
+func (d *Dir) Mkdir(h *Header) error {
+	target := d.Path(h.Name)
+	if err := os.MkdirAll(target, h.Mode.Perm()); err != nil {
+		return err
+	}
+	if !h.ModeSet {
+		return nil
+	}
+	// Existing directories get the requested mode as well
+	return os.Chmod(target, h.Mode&modeChmod)
+}
+
+func (d *Dir) CopyFile(h *Header, source string,
+	opt *copy.Options) (copy.Result, error) {
+	target := d.Path(h.Name)
+	r, err := copy.FileResult(source, target, opt)
+	if err == nil && h.ModeSet {
+		err = os.Chmod(target, h.Mode&modeChmod)
+	}
+	return r, err
+}
+
+func (d *Dir) WriteFile(h *Header, data []byte, opt *copy.Options) error {
+	return copy.WriteFile(d.Path(h.Name), data, h.Mode&modeChmod, opt)
+}
+
+// remove removes the existing entry at target, if any.
+func remove(target string) error {
+	// Use Lstat, as links may point to files that only exist in the chroot
+	if _, err := os.Lstat(target); err == nil {
+		return os.Remove(target)
+	}
+	return nil
+}
+
+func (d *Dir) Symlink(h *Header) error {
+	target := d.Path(h.Name)
+	if err := remove(target); err != nil {
+		return err
+	}
+	return os.Symlink(h.Linkname, target)
+}
+
+func (d *Dir) Link(h *Header) error {
+	target := d.Path(h.Name)
+	if err := remove(target); err != nil {
+		return err
+	}
+	return os.Link(h.Linkname, target)
+}
+
+func (d *Dir) Mknod(h *Header) error {
+	target := d.Path(h.Name)
+	if err := remove(target); err != nil {
+		return err
+	}
+	if err := syscall.Mknod(target, UnixMode(h.Mode),
+		MakeDev(h.Major, h.Minor)); err != nil {
+		return err
+	}
+	// The mode given to mknod(2) is masked by the umask
+	return os.Chmod(target, h.Mode&modeChmod)
+}
+
+func (d *Dir) Close() error {
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * In-memory output for dry runs
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// Entry is an entry recorded by Memory.
+type Entry struct {
+	Header
+	Source   string        // Host file the contents are copied from
+	Data     []byte        // Contents added with WriteFile
+	Preserve copy.Preserve // Attributes to take from Source
+}
+
+// Memory records the entries added to it instead of writing them. Like in
+// a directory, adding an entry replaces the one with the same name. Dry runs
+// use it to find out what would be written.
+type Memory struct {
+	sync.Mutex
+	entries []Entry
+	index   map[string]int // Of entries by name
+}
+
+// NewMemory returns an empty Memory sink.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Entries returns the recorded entries in the order they were first added.
+func (m *Memory) Entries() []Entry {
+	m.Lock()
+	defer m.Unlock()
+	return append([]Entry(nil), m.entries...)
+}
+
+// add records e. If merge is not nil, it is called with the entry that e
+// replaces, if any.
+func (m *Memory) add(e Entry, merge func(old Entry, e *Entry)) {
+	e.Name = path.Clean(e.Name)
+	m.Lock()
+	defer m.Unlock()
+	if m.index == nil {
+		m.index = make(map[string]int)
+	}
+	i, ok := m.index[e.Name]
+	if !ok {
+		m.index[e.Name] = len(m.entries)
+		m.entries = append(m.entries, e)
+		return
+	}
+	if merge != nil {
+		merge(m.entries[i], &e)
+	}
+	m.entries[i] = e
+}
+
+func (m *Memory) Mkdir(h *Header) error {
+	m.add(Entry{Header: *h}, func(old Entry, e *Entry) {
+		if old.Mode.IsDir() && !h.ModeSet {
+			e.Mode = old.Mode
+		}
+	})
+	return nil
+}
+
+// preserve returns the attributes to take from the source with opt.
+func preserve(opt *copy.Options) copy.Preserve {
+	if opt == nil {
+		return 0
+	}
+	return opt.Preserve
+}
+
+func (m *Memory) CopyFile(h *Header, source string,
+	opt *copy.Options) (copy.Result, error) {
+	// Fail like a copy would if the source cannot be read
+	fi, err := os.Stat(source)
+	if err != nil {
+		return copy.Result{}, err
+	}
+	e := Entry{Header: *h, Source: source, Preserve: preserve(opt)}
+	if !h.ModeSet {
+		e.Mode = fi.Mode() & modeChmod
+	}
+	m.add(e, nil)
+	return copy.Result{}, nil
+}
+
+func (m *Memory) WriteFile(h *Header, data []byte, opt *copy.Options) error {
+	p := preserve(opt)
+	m.add(Entry{Header: *h, Data: data}, func(old Entry, e *Entry) {
+		if p != 0 && old.Mode.IsRegular() && old.Source != "" {
+			e.Source, e.Preserve = old.Source, p
+		}
+	})
+	return nil
+}
+
+func (m *Memory) Symlink(h *Header) error {
+	m.add(Entry{Header: *h}, nil)
+	return nil
+}
+
+// Link records the hard link as a copy of the host file that keeps all its
+// attributes, which is what the entry looks like in the jail.
+func (m *Memory) Link(h *Header) error {
+	fi, err := os.Stat(h.Linkname)
+	if err != nil {
+		return err
+	}
+	e := Entry{Header: *h, Source: h.Linkname, Preserve: copy.PreserveAll}
+	e.Mode, e.ModeSet, e.OwnerSet = fi.Mode()&modeChmod, true, false
+	m.add(e, nil)
+	return nil
+}
+
+func (m *Memory) Mknod(h *Header) error {
+	m.add(Entry{Header: *h}, nil)
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,385 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * OCI image layout output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Media types of the OCI image specification.
+const (
+	mediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// Annotation with the tag of an image in an index
+	annotationRefName = "org.opencontainers.image.ref.name"
+)
+
+// ImageConfig tells container runtimes how to run an image.
+type ImageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// descriptor refers to a blob of an image.
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// imageConfig is the configuration blob of an image.
+type imageConfig struct {
+	Created      time.Time   `json:"created"`
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	Config       ImageConfig `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []imageHistory `json:"history"`
+}
+
+type imageHistory struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// imageManifest lists the configuration and layers of an image.
+type imageManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// imageIndex lists the images of an image layout. Its manifests are kept as
+// they are, so that fields of other images are not lost.
+type imageIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []json.RawMessage `json:"manifests"`
+}
+
+// OCI writes jails as container images in the OCI image layout, either to a
+// directory or to a tar archive of one (oci-archive). The image has a single
+// layer with the jail, written like a Tar. Other images in the directory are
+// kept and stay in the index, except the one with the same tag, which is
+// replaced.
+type OCI struct {
+	Memory
+	dir     string    // Of the layout, empty for archives
+	w       io.Writer // For archives
+	tmpDir  string    // For the layer of archives
+	tag     string
+	config  ImageConfig
+	modTime time.Time
+}
+
+// NewOCI returns a Sink that writes an image named tag with the given
+// configuration to the image layout directory dir. The layer and the image
+// have the modification time modTime, which makes them reproducible.
+func NewOCI(dir, tag string, config ImageConfig, modTime time.Time) *OCI {
+	return &OCI{dir: dir, tag: tag, config: config, modTime: modTime}
+}
+
+// NewOCIArchive returns a Sink that writes an image named tag as a tar
+// archive of an image layout to w. The layer is kept in a temporary file in
+// tmpDir until the archive is written.
+func NewOCIArchive(w io.Writer, tmpDir, tag string, config ImageConfig,
+	modTime time.Time) *OCI {
+	return &OCI{w: w, tmpDir: tmpDir, tag: tag, config: config,
+		modTime: modTime}
+}
+
+// digest returns the digest of data and its descriptor.
+func digest(mediaType string, data []byte) descriptor {
+	sum := sha256.Sum256(data)
+	return descriptor{MediaType: mediaType, Size: int64(len(data)),
+		Digest: "sha256:" + hex.EncodeToString(sum[:])}
+}
+
+// blobName returns the path of the blob d in an image layout.
+func blobName(d descriptor) string {
+	return "/blobs/sha256/" + d.Digest[len("sha256:"):]
+}
+
+// elfArchs maps ELF machines to the architecture names of Go, which OCI
+// images use.
+var elfArchs = map[elf.Machine][2]string{ // 32-bit, 64-bit
+	elf.EM_386:     {"386", ""},
+	elf.EM_X86_64:  {"", "amd64"},
+	elf.EM_ARM:     {"arm", ""},
+	elf.EM_AARCH64: {"", "arm64"},
+	elf.EM_PPC64:   {"", "ppc64"},
+	elf.EM_S390:    {"", "s390x"},
+	elf.EM_RISCV:   {"", "riscv64"},
+	elf.EM_MIPS:    {"mips", "mips64"},
+}
+
+// elfArch returns the architecture of the ELF file f, or an empty string if
+// it is not one.
+func (f *file) elfArch() string {
+	r, err := f.open()
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	var ident [20]byte // Up to and including e_machine
+	if _, err := io.ReadFull(r, ident[:]); err != nil ||
+		string(ident[:4]) != elf.ELFMAG {
+		return ""
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(ident[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	names := elfArchs[elf.Machine(order.Uint16(ident[18:]))]
+	name := names[0]
+	if elf.Class(ident[elf.EI_CLASS]) == elf.ELFCLASS64 {
+		name = names[1]
+	}
+	if name == "ppc64" || name == "mips" || name == "mips64" {
+		if order == binary.LittleEndian {
+			name += "le"
+		}
+	}
+	return name
+}
+
+// architecture returns the architecture most of the ELF files in files are
+// built for. Without any, it is the one jailtime runs on.
+func architecture(files []file) string {
+	counts := make(map[string]int)
+	for i := range files {
+		f := &files[i]
+		if f.Mode.IsRegular() && f.Link == "" {
+			if arch := f.elfArch(); arch != "" {
+				counts[arch]++
+			}
+		}
+	}
+	archs := make([]string, 0, len(counts))
+	for arch := range counts {
+		archs = append(archs, arch)
+	}
+	if len(archs) == 0 {
+		return runtime.GOARCH
+	}
+	sort.Slice(archs, func(i, j int) bool {
+		if counts[archs[i]] != counts[archs[j]] {
+			return counts[archs[i]] > counts[archs[j]]
+		}
+		return archs[i] < archs[j]
+	})
+	return archs[0]
+}
+
+// writeLayer writes files as the compressed layer of an image to a
+// temporary file in dir. Returns the name of the file, its descriptor and
+// the digest of the uncompressed layer.
+func writeLayer(dir string, files []file) (name string, d descriptor,
+	diffID string, err error) {
+	t, err := ioutil.TempFile(dir, ".layer")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := t.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(t.Name())
+		}
+	}()
+	compressed, uncompressed := sha256.New(), sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(t, compressed))
+	zw := gzip.NewWriter(buf)
+	if err = writeTar(io.MultiWriter(zw, uncompressed), files); err != nil {
+		return
+	}
+	if err = zw.Close(); err != nil {
+		return
+	}
+	if err = buf.Flush(); err != nil {
+		return
+	}
+	fi, err := t.Stat()
+	if err != nil {
+		return
+	}
+	d = descriptor{MediaType: mediaTypeLayer, Size: fi.Size(),
+		Digest: "sha256:" + hex.EncodeToString(compressed.Sum(nil))}
+	diffID = "sha256:" + hex.EncodeToString(uncompressed.Sum(nil))
+	return t.Name(), d, diffID, nil
+}
+
+// index returns the index of the layout with the image manifest added. For
+// directories, the images of the existing index are kept, except the one
+// tagged like manifest, whose entry is replaced.
+func (o *OCI) index(manifest descriptor) ([]byte, error) {
+	index := imageIndex{SchemaVersion: 2, MediaType: mediaTypeIndex}
+	if o.dir != "" {
+		filename := filepath.Join(o.dir, "index.json")
+		data, err := ioutil.ReadFile(filename)
+		if err == nil {
+			err = json.Unmarshal(data, &index)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	entry, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	tag := manifest.Annotations[annotationRefName]
+	manifests := index.Manifests[:0]
+	replaced := false
+	for _, m := range index.Manifests {
+		var d descriptor
+		if json.Unmarshal(m, &d) == nil &&
+			d.Annotations[annotationRefName] == tag {
+			if replaced {
+				continue
+			}
+			m, replaced = entry, true
+		}
+		manifests = append(manifests, m)
+	}
+	if !replaced {
+		manifests = append(manifests, entry)
+	}
+	index.Manifests = manifests
+	return json.Marshal(index)
+}
+
+// Close writes the image.
+func (o *OCI) Close() error {
+	files, err := o.files(o.modTime)
+	if err != nil {
+		return err
+	}
+	var out Sink
+	tmpDir := o.tmpDir
+	if o.dir != "" {
+		// Written into place by renaming
+		tmpDir = filepath.Join(o.dir, "blobs", "sha256")
+		if err := os.MkdirAll(tmpDir, 0755); err != nil {
+			return err
+		}
+		out = NewDir(o.dir)
+	} else {
+		out = NewTar(o.w, o.modTime)
+	}
+	// Marks the directory as a layout first, even if writing fails
+	if err = out.WriteFile(&Header{Name: "/oci-layout", Mode: 0644,
+		ModeSet: true}, []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		nil); err != nil {
+		return err
+	}
+	layerFile, layer, diffID, err := writeLayer(tmpDir, files)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layerFile) // Unless renamed
+
+	c := imageConfig{Created: o.modTime.UTC(), OS: "linux",
+		Architecture: architecture(files), Config: o.config,
+		History: []imageHistory{{o.modTime.UTC(), "jailtime"}}}
+	c.RootFS.Type, c.RootFS.DiffIDs = "layers", []string{diffID}
+	config, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	configDesc := digest(mediaTypeConfig, config)
+	manifest, err := json.Marshal(imageManifest{SchemaVersion: 2,
+		MediaType: mediaTypeManifest, Config: configDesc,
+		Layers: []descriptor{layer}})
+	if err != nil {
+		return err
+	}
+	manifestDesc := digest(mediaTypeManifest, manifest)
+	manifestDesc.Annotations = map[string]string{annotationRefName: o.tag}
+	index, err := o.index(manifestDesc)
+	if err != nil {
+		return err
+	}
+
+	blobs := []struct {
+		name string
+		data []byte
+	}{
+		{blobName(configDesc), config},
+		{blobName(manifestDesc), manifest},
+		// Last, so that the index only lists complete images
+		{"/index.json", index},
+	}
+	if o.dir != "" {
+		// Temporary files are only readable by their owner
+		if err = os.Chmod(layerFile, 0644); err == nil {
+			err = os.Rename(layerFile, filepath.Join(o.dir,
+				blobName(layer)))
+		}
+	} else {
+		_, err = out.CopyFile(&Header{Name: blobName(layer), Mode: 0644,
+			ModeSet: true}, layerFile, nil)
+	}
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		err = out.WriteFile(&Header{Name: b.name, Mode: 0644, ModeSet: true},
+			b.data, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
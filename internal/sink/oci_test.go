@@ -0,0 +1,259 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for OCI image layout output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ociBlob reads the blob d from the image layout in dir and checks its
+// digest and size.
+func ociBlob(t *testing.T, dir string, d descriptor) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, blobName(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := digest(d.MediaType, data); actual.Digest != d.Digest ||
+		actual.Size != d.Size {
+		t.Errorf("expected %s (%d bytes), actual %s (%d bytes)", d.Digest,
+			d.Size, actual.Digest, actual.Size)
+	}
+	return data
+}
+
+// ociIndex returns the manifests in the index of the image layout in dir.
+func ociIndex(t *testing.T, dir string) []descriptor {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index struct {
+		Manifests []descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	return index.Manifests
+}
+
+func TestOCI(t *testing.T) {
+	td, err := ioutil.TempDir("", "sink_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	config := ImageConfig{Entrypoint: []string{"/bin/a"},
+		Cmd: []string{"-v"}, Env: []string{"PATH=/bin"}, User: "1000:100",
+		WorkingDir: "/home/user"}
+	modTime := time.Unix(1700000000, 0)
+	write := func(s *OCI) {
+		t.Helper()
+		if err := s.Mkdir(&Header{Name: "/home/user", Mode: os.ModeDir |
+			0700, ModeSet: true, UID: 1000, GID: 100,
+			OwnerSet: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteFile(&Header{Name: "/bin/a", Mode: 0755,
+			ModeSet: true}, []byte("data"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(td, "image")
+	write(NewOCI(dir, "v1", config, modTime))
+
+	layout, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"imageLayoutVersion":"1.0.0"}`; string(layout) !=
+		expected {
+		t.Errorf("expected %s, actual %s", expected, layout)
+	}
+	manifests := ociIndex(t, dir)
+	if len(manifests) != 1 {
+		t.Fatalf("expected 1 manifest, actual %d", len(manifests))
+	}
+	annotations := manifests[0].Annotations
+	if tag := annotations[annotationRefName]; tag != "v1" {
+		t.Errorf("expected tag v1, actual %s", tag)
+	}
+	var manifest imageManifest
+	if err := json.Unmarshal(ociBlob(t, dir, manifests[0]),
+		&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected 1 layer, actual %d", len(manifest.Layers))
+	}
+	var c imageConfig
+	if err := json.Unmarshal(ociBlob(t, dir, manifest.Config),
+		&c); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Config, config) {
+		t.Errorf("expected %v, actual %v", config, c.Config)
+	}
+	if c.OS != "linux" || !c.Created.Equal(modTime) {
+		t.Errorf("expected linux created at %s, actual %s created at %s",
+			modTime, c.OS, c.Created)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(ociBlob(t, dir,
+		manifest.Layers[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(layer)
+	if diffID := "sha256:" + hex.EncodeToString(sum[:]); len(
+		c.RootFS.DiffIDs) != 1 || c.RootFS.DiffIDs[0] != diffID {
+		t.Errorf("expected diff_ids [%s], actual %v", diffID,
+			c.RootFS.DiffIDs)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	expected := []string{"bin/", "bin/a", "home/", "home/user/"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, actual %v", expected, names)
+	}
+
+	// Archives contain the same layout
+	var buf bytes.Buffer
+	write(NewOCIArchive(&buf, td, "v1", config, modTime))
+	tr = tar.NewReader(&buf)
+	names = nil
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := ioutil.ReadFile(filepath.Join(dir, hdr.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Errorf("%s: expected the same contents as %s", hdr.Name,
+				filepath.Join(dir, hdr.Name))
+		}
+	}
+	if len(names) != 7 || !strings.HasPrefix(names[0], "blobs/") {
+		t.Errorf("expected 7 entries, actual %v", names)
+	}
+}
+
+func TestOCITags(t *testing.T) {
+	td, err := ioutil.TempDir("", "sink_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	modTime := time.Unix(1700000000, 0)
+	write := func(tag, content string) {
+		t.Helper()
+		s := NewOCI(td, tag, ImageConfig{}, modTime)
+		if err := s.WriteFile(&Header{Name: "/file", Mode: 0644,
+			ModeSet: true}, []byte(content), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tags := func() map[string]string {
+		t.Helper()
+		digests := make(map[string]string)
+		for _, m := range ociIndex(t, td) {
+			tag := m.Annotations[annotationRefName]
+			if _, ok := digests[tag]; ok {
+				t.Errorf("expected tag %s once", tag)
+			}
+			digests[tag] = m.Digest
+			ociBlob(t, td, m) // Still there
+		}
+		return digests
+	}
+
+	// Images with other tags are kept in the index
+	write("one", "1")
+	write("two", "2")
+	first := tags()
+	if len(first) != 2 || first["one"] == first["two"] {
+		t.Fatalf("expected two different images, actual %v", first)
+	}
+
+	// The image with the same tag is replaced
+	write("one", "3")
+	second := tags()
+	if len(second) != 2 || second["two"] != first["two"] ||
+		second["one"] == first["one"] {
+		t.Errorf("expected one to be replaced, actual %v (before %v)",
+			second, first)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Outputs that jails are written to
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package sink provides the outputs that the statements of a jailspec are
+// written to. Dir writes to a directory on the host, Memory only records
+// what would be written and Tar writes an archive.
+package sink
+
+import (
+	"os"
+
+	"blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// Header describes an entry of a jail.
+type Header struct {
+	Name    string      // Absolute path inside the jail
+	Mode    os.FileMode // Type and permission bits
+	ModeSet bool        // Whether Mode was given explicitly, see below
+	UID     int         // Owner user id
+	GID     int         // Owner group id
+
+	// OwnerSet is whether UID and GID were given explicitly. Otherwise,
+	// entries belong to the user running jailtime in directories and to
+	// root in archives.
+	OwnerSet bool
+
+	// Linkname is the value of a symlink, or the file on the host that a
+	// hard link refers to.
+	Linkname string
+
+	// Major and Minor are the device numbers of device nodes.
+	Major, Minor int
+}
+
+// Sink receives the entries of a jail. Methods may be called concurrently
+// for different entries. Parent directories are added before their
+// entries, except for Mkdir, which creates missing parents itself.
+type Sink interface {
+	// Mkdir adds the directory h.Name. If h.ModeSet is false and the
+	// directory exists already, its mode is left alone.
+	Mkdir(h *Header) error
+
+	// CopyFile adds the regular file h.Name with the contents of the host
+	// file source. If h.ModeSet is false, the mode of source is used.
+	CopyFile(h *Header, source string, opt *copy.Options) (copy.Result,
+		error)
+
+	// WriteFile adds the regular file h.Name with the contents data. With
+	// opt.Preserve, it keeps these attributes of the file it replaces.
+	WriteFile(h *Header, data []byte, opt *copy.Options) error
+
+	// Symlink adds h.Name as a symlink to h.Linkname, replacing any
+	// existing entry.
+	Symlink(h *Header) error
+
+	// Link adds h.Name as a hard link to the host file h.Linkname,
+	// replacing any existing entry. The owner in h is not used, as the
+	// entry shares all attributes with the host file.
+	Link(h *Header) error
+
+	// Mknod adds the device node, named pipe or socket h.Name, replacing
+	// any existing entry.
+	Mknod(h *Header) error
+
+	// Close finishes the output. No more entries can be added afterwards.
+	Close() error
+}
+
+// Mode bits as used by stat(2), which are the same on all Unix systems.
+const (
+	modeSocket  = 0140000
+	modeSymlink = 0120000
+	modeRegular = 0100000
+	modeBlock   = 0060000
+	modeDir     = 0040000
+	modeChar    = 0020000
+	modeFIFO    = 0010000
+	modeType    = 0170000
+	modeSetuid  = 04000
+	modeSetgid  = 02000
+	modeSticky  = 01000
+)
+
+// FileMode converts mode bits as used by stat(2) to an os.FileMode.
+func FileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode).Perm()
+	switch mode & modeType {
+	case modeSocket:
+		m |= os.ModeSocket
+	case modeSymlink:
+		m |= os.ModeSymlink
+	case modeBlock:
+		m |= os.ModeDevice
+	case modeDir:
+		m |= os.ModeDir
+	case modeChar:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case modeFIFO:
+		m |= os.ModeNamedPipe
+	}
+	if mode&modeSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&modeSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&modeSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// UnixMode converts m to mode bits as used by stat(2).
+func UnixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m&os.ModeSocket != 0:
+		mode |= modeSocket
+	case m&os.ModeSymlink != 0:
+		mode |= modeSymlink
+	case m&os.ModeCharDevice != 0:
+		mode |= modeChar
+	case m&os.ModeDevice != 0:
+		mode |= modeBlock
+	case m&os.ModeDir != 0:
+		mode |= modeDir
+	case m&os.ModeNamedPipe != 0:
+		mode |= modeFIFO
+	default:
+		mode |= modeRegular
+	}
+	if m&os.ModeSetuid != 0 {
+		mode |= modeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= modeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= modeSticky
+	}
+	return mode
+}
@@ -0,0 +1,178 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for the jail outputs
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	for _, mode := range []uint32{0100644, 040755, 041777, 0104755,
+		0102711, 0120777, 020666, 060660, 010600, 0140755} {
+		m := FileMode(mode)
+		if actual := UnixMode(m); actual != mode {
+			t.Errorf("expected 0%o, actual 0%o (%s)", mode, actual, m)
+		}
+	}
+	if m := FileMode(020666); m != os.ModeDevice|os.ModeCharDevice|0666 {
+		t.Errorf("expected character device, actual %s", m)
+	}
+}
+
+func TestDir(t *testing.T) {
+	td, err := ioutil.TempDir("", "sink_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	source := filepath.Join(td, "source")
+	if err := ioutil.WriteFile(source, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDir(filepath.Join(td, "jail"))
+	steps := []func() error{
+		func() error {
+			return d.Mkdir(&Header{Name: "/usr/bin", Mode: os.ModeDir | 0755})
+		},
+		func() error {
+			return d.Mkdir(&Header{Name: "/tmp",
+				Mode: os.ModeDir | os.ModeSticky | 0777, ModeSet: true})
+		},
+		func() error {
+			_, err := d.CopyFile(&Header{Name: "/usr/bin/a", Mode: 0755,
+				ModeSet: true}, source, nil)
+			return err
+		},
+		func() error {
+			return d.WriteFile(&Header{Name: "/usr/bin/b", Mode: 0640},
+				[]byte("written"), nil)
+		},
+		func() error {
+			return d.Symlink(&Header{Name: "/usr/bin/c", Linkname: "a"})
+		},
+		func() error {
+			return d.Link(&Header{Name: "/usr/bin/d", Linkname: source})
+		},
+		func() error {
+			// Named pipes can be created without root
+			return d.Mknod(&Header{Name: "/usr/bin/e",
+				Mode: os.ModeNamedPipe | 0600})
+		},
+		func() error {
+			// Replaces the existing symlink
+			return d.Symlink(&Header{Name: "/usr/bin/c", Linkname: "b"})
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, mode := range map[string]os.FileMode{
+		"/usr/bin":   os.ModeDir | 0755,
+		"/tmp":       os.ModeDir | os.ModeSticky | 0777,
+		"/usr/bin/a": 0755,
+		"/usr/bin/b": 0640,
+		"/usr/bin/c": os.ModeSymlink | 0777,
+		"/usr/bin/d": 0600,
+		"/usr/bin/e": os.ModeNamedPipe | 0600,
+	} {
+		fi, err := os.Lstat(d.Path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("%s: expected mode %s, actual %s", name, mode, fi.Mode())
+		}
+	}
+	if value, err := os.Readlink(d.Path("/usr/bin/c")); err != nil {
+		t.Fatal(err)
+	} else if value != "b" {
+		t.Errorf("expected symlink to b, actual %s", value)
+	}
+	if data, err := ioutil.ReadFile(d.Path("/usr/bin/a")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "data" {
+		t.Errorf("expected data, actual %s", data)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	td, err := ioutil.TempDir("", "sink_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	source := filepath.Join(td, "source")
+	if err := ioutil.WriteFile(source, []byte("data"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(source, 0750); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemory()
+	if err := m.Mkdir(&Header{Name: "/bin",
+		Mode: os.ModeDir | 0755}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CopyFile(&Header{Name: "/bin/a"}, source,
+		nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CopyFile(&Header{Name: "/bin/b"},
+		filepath.Join(td, "missing"), nil); !os.IsNotExist(err) {
+		t.Errorf("expected missing source to fail, actual %v", err)
+	}
+	if err := m.Mknod(&Header{Name: "/dev/null",
+		Mode: os.ModeDevice | os.ModeCharDevice | 0666, Major: 1,
+		Minor: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := m.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, actual %d", len(entries))
+	}
+	if e := entries[1]; e.Name != "/bin/a" || e.Source != source ||
+		e.Mode != 0750 {
+		t.Errorf("expected /bin/a from %s with mode 0750, actual %s from "+
+			"%s with mode %s", source, e.Name, e.Source, e.Mode)
+	}
+	if e := entries[2]; e.Major != 1 || e.Minor != 3 {
+		t.Errorf("expected device 1,3, actual %d,%d", e.Major, e.Minor)
+	}
+	if _, err := os.Stat(filepath.Join(td, "bin")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written, actual %v", err)
+	}
+}
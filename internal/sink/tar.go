@@ -0,0 +1,128 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tar archive output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Tar writes jails to a tar archive in the POSIX.1-2001 (PAX) format, which
+// records ownership, device nodes and extended attributes without needing
+// root. Entries are recorded first and written sorted by name on Close, so
+// that the same jail always results in the same archive.
+type Tar struct {
+	Memory
+	w       io.Writer
+	modTime time.Time
+}
+
+// NewTar returns a Sink that writes a tar archive to w. Entries have the
+// modification time modTime, unless the timestamps of their source are
+// preserved.
+func NewTar(w io.Writer, modTime time.Time) *Tar {
+	return &Tar{w: w, modTime: modTime}
+}
+
+// tarHeader returns the tar header for f.
+func tarHeader(f *file) (*tar.Header, error) {
+	hdr := &tar.Header{
+		Name:    strings.TrimPrefix(f.Name, "/"),
+		Mode:    int64(UnixMode(f.Mode) &^ modeType),
+		Uid:     f.UID,
+		Gid:     f.GID,
+		ModTime: f.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	switch m := f.Mode; {
+	case m.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case m&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = f.Linkname
+	case m&os.ModeCharDevice != 0:
+		hdr.Typeflag = tar.TypeChar
+	case m&os.ModeDevice != 0:
+		hdr.Typeflag = tar.TypeBlock
+	case m&os.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+	case m&os.ModeSocket != 0:
+		return nil, fmt.Errorf("%s: sockets cannot be archived", f.Name)
+	case f.Link != "":
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = strings.TrimPrefix(f.Link, "/")
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = f.Size
+	}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		hdr.Devmajor, hdr.Devminor = int64(f.Major), int64(f.Minor)
+	}
+	if len(f.Xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(f.Xattrs))
+		for name, value := range f.Xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+	}
+	return hdr, nil
+}
+
+// writeTar writes files as a tar archive to w.
+func writeTar(w io.Writer, files []file) error {
+	tw := tar.NewWriter(w)
+	for i := range files {
+		f := &files[i]
+		hdr, err := tarHeader(f)
+		if err != nil {
+			return err
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err = f.copyContents(tw); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// Close writes the archive. The underlying writer is not closed.
+func (t *Tar) Close() error {
+	files, err := t.files(t.modTime)
+	if err != nil {
+		return err
+	}
+	return writeTar(t.w, files)
+}
@@ -0,0 +1,161 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for the tar archive output
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sink
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// addEntries adds the same entries to s in the given order and closes it.
+// Regular files are copies of source.
+func addEntries(t *testing.T, s Sink, source string, order []int) {
+	t.Helper()
+	adds := []func() error{
+		func() error {
+			return s.Mkdir(&Header{Name: "/home/user", Mode: os.ModeDir |
+				0700, ModeSet: true, UID: 1000, GID: 100, OwnerSet: true})
+		},
+		func() error {
+			_, err := s.CopyFile(&Header{Name: "/bin/a"}, source, nil)
+			return err
+		},
+		func() error {
+			_, err := s.CopyFile(&Header{Name: "/bin/b"}, source, nil)
+			return err
+		},
+		func() error {
+			_, err := s.CopyFile(&Header{Name: "/bin/c"}, source, nil)
+			if err == nil {
+				// Stripped copies are rewritten and no longer the same
+				err = s.WriteFile(&Header{Name: "/bin/c", Mode: 0755},
+					[]byte("stripped"), &copy.Options{})
+			}
+			return err
+		},
+		func() error {
+			return s.Symlink(&Header{Name: "/bin/sh", Linkname: "a",
+				Mode: os.ModeSymlink | 0777})
+		},
+		func() error {
+			return s.Mknod(&Header{Name: "/dev/null", Mode: os.ModeDevice |
+				os.ModeCharDevice | 0666, ModeSet: true, Major: 1, Minor: 3})
+		},
+	}
+	for _, i := range order {
+		if err := adds[i](); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tarArchive adds entries to a new Tar in the given order and returns the
+// archive.
+func tarArchive(t *testing.T, source string, order []int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	addEntries(t, NewTar(&buf, time.Unix(1700000000, 0)), source, order)
+	return buf.Bytes()
+}
+
+func TestTar(t *testing.T) {
+	td, err := ioutil.TempDir("", "sink_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	source := filepath.Join(td, "source")
+	if err := ioutil.WriteFile(source, []byte("data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := tarArchive(t, source, []int{0, 1, 2, 3, 4, 5})
+	if other := tarArchive(t, source, []int{5, 3, 4, 2, 1,
+		0}); !bytes.Equal(archive, other) {
+		t.Error("expected the same archive regardless of order")
+	}
+
+	type entry struct {
+		name     string
+		typeflag byte
+		mode     int64
+		uid, gid int
+		linkname string
+		major    int64
+		content  string
+	}
+	expected := []entry{
+		{"bin/", tar.TypeDir, 0755, 0, 0, "", 0, ""},
+		{"bin/a", tar.TypeReg, 0755, 0, 0, "", 0, "data"},
+		{"bin/b", tar.TypeLink, 0755, 0, 0, "bin/a", 0, ""},
+		{"bin/c", tar.TypeReg, 0755, 0, 0, "", 0, "stripped"},
+		{"bin/sh", tar.TypeSymlink, 0777, 0, 0, "a", 0, ""},
+		{"dev/", tar.TypeDir, 0755, 0, 0, "", 0, ""},
+		{"dev/null", tar.TypeChar, 0666, 0, 0, "", 1, ""},
+		{"home/", tar.TypeDir, 0755, 0, 0, "", 0, ""},
+		{"home/user/", tar.TypeDir, 0700, 1000, 100, "", 0, ""},
+	}
+	var actual []entry
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.ModTime.Equal(time.Unix(1700000000, 0)) {
+			t.Errorf("%s: expected fixed modification time, actual %s",
+				hdr.Name, hdr.ModTime)
+		}
+		actual = append(actual, entry{hdr.Name, hdr.Typeflag, hdr.Mode,
+			hdr.Uid, hdr.Gid, hdr.Linkname, hdr.Devmajor, string(content)})
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, actual %v", expected, actual)
+	}
+}
@@ -33,8 +33,8 @@ import (
 )
 
 // ExpandLexical deduplicates and sorts a list of statements while expanding
-// directory paths. Run statements are never deduplicated are kept in order of
-// appearace in the list.
+// directory paths. Run and image statements are never deduplicated are kept in
+// order of appearace in the list.
 func ExpandLexical(stmts Statements) Statements {
 	done := make(map[string]bool)
 	// Expect at least half of the files to expand at least to their dir
@@ -45,8 +45,8 @@ func ExpandLexical(stmts Statements) Statements {
 		case Directory:
 			dir = stmt.Target()
 			expanded = append(expanded, stmt)
-		case Run:
-			// Do not deduplicate run statements
+		case Run, Image:
+			// Do not deduplicate run and image statements
 			expanded = append(expanded, stmt)
 			continue
 		}
@@ -61,12 +61,12 @@ func ExpandLexical(stmts Statements) Statements {
 		}
 		for dirLen := 0; dirLen != len(dir) && dir != "/"; {
 			if _, ok := done[dir]; !ok {
+				// Parents of directories get the same mode, others need
+				// to be searchable.
 				d := NewDirectory(dir)
-				d.fileAttr = *s.FileAttr()
-				if _, ok := s.(RegularFile); ok {
-					if s.FileAttr().Mode == -1 {
-						d.fileAttr.Mode = 0755
-					}
+				d.fileAttr.Mode = s.FileAttr().Mode
+				if _, isDir := s.(Directory); !isDir {
+					d.fileAttr.Mode = 0755
 				}
 				expanded = append(expanded, d)
 				done[dir] = true
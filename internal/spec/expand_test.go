@@ -30,6 +30,7 @@ package spec
 import (
 	"fmt"
 	"reflect"
+	"syscall"
 	"testing"
 )
 
@@ -45,6 +46,8 @@ func TestLexicalExpand(t *testing.T) {
 		NewRun("gzip ./test"),
 		NewRun("gunzip ./test.gz"),
 		NewRun("cat ./test"),
+		NewImage("env", []string{"A=1"}),
+		NewImage("env", []string{"A=1"}),         // Later values override
 		NewRegularFile("/z_source", "/z_target"), // Duplicate target
 		NewRegularFile("/e_source", "/e_target"),
 	})
@@ -63,12 +66,35 @@ func TestLexicalExpand(t *testing.T) {
 		NewRun("gzip ./test"),
 		NewRun("gunzip ./test.gz"),
 		NewRun("cat ./test"),
+		NewImage("env", []string{"A=1"}),
+		NewImage("env", []string{"A=1"}),
 	}
 	if !reflect.DeepEqual(expanded, expected) {
 		t.Errorf("expected %s, actual %s", expected, expanded)
 	}
 }
 
+func TestLexicalExpandParents(t *testing.T) {
+	dev := NewDevice("/dev/null", syscall.S_IFCHR, 1, 3)
+	dev.fileAttr = FileAttr{UID: 0, GID: 5, Mode: 0666}
+	home := NewDirectory("/home/user")
+	home.fileAttr = FileAttr{UID: 1000, GID: 100, Mode: 0700}
+	for _, s := range ExpandLexical(Statements{dev, home}) {
+		d, ok := s.(Directory)
+		if !ok || d.Target() == "/home/user" {
+			continue
+		}
+		expectMode := 0755
+		if d.Target() == "/home" {
+			expectMode = 0700
+		}
+		if fa := d.FileAttr(); fa.Mode != expectMode {
+			t.Errorf("%s: expected %o, actual %o", d.Target(), expectMode,
+				fa.Mode)
+		}
+	}
+}
+
 func TestLexicalExpandModes(t *testing.T) {
 	dir := NewDirectory("/target/directory/innermost/node")
 	dir.fileAttr.Mode = 0755 // Expect same mode on expanded directories
@@ -82,3 +108,23 @@ func TestLexicalExpandModes(t *testing.T) {
 		}
 	}
 }
+
+func TestLexicalExpandLinkParents(t *testing.T) {
+	// Links in directories that do not exist yet need searchable parents
+	for _, s := range []Statement{
+		NewLink("/bin/busybox", "/new/dir/sh", false),
+		NewLink("/bin/busybox", "/new/dir/ln", true),
+	} {
+		expanded := ExpandLexical(Statements{s})
+		if len(expanded) != 3 {
+			t.Fatalf("expected 3 statements, actual %s", expanded)
+		}
+		for _, e := range expanded[:2] {
+			if _, ok := e.(Directory); !ok {
+				t.Errorf("expected directory, actual %s", e)
+			} else if mode := e.FileAttr().Mode; mode != 0755 {
+				t.Errorf("%s: expected 755, actual %o", e.Target(), mode)
+			}
+		}
+	}
+}
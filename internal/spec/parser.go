@@ -29,6 +29,7 @@ package spec
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -43,8 +44,18 @@ var (
 	//                   enable better error reporting.
 	// Directives:
 	//   include /some/file
+	//   option keep-symlinks
+	//   option libdir=/lib
+	//   option strip-debug
 	//   run echo 'test'
-	directivesRe = regexp.MustCompile("^(include|run)\\s+(.+)$")
+	// Directives for container images:
+	//   entrypoint ["/bin/sh", "-c"]
+	//   cmd /bin/bash --login
+	//   env PATH=/bin:/usr/bin
+	//   user 1000:100
+	//   workdir /home/user
+	directivesRe = regexp.MustCompile(
+		"^(include|option|run|entrypoint|cmd|env|user|workdir)\\s+(.+)$")
 
 	// Links:
 	//   /path/symlink_name -> /bin/bash
@@ -83,8 +94,79 @@ func parseMode(s string) int {
 	return -1
 }
 
+// parseImage parses the value of an image directive. Commands are either a
+// JSON array or words separated by white-space. Returns nil if the value is
+// invalid.
+func parseImage(field, value string) []string {
+	switch field {
+	case "entrypoint", "cmd":
+		if !strings.HasPrefix(value, "[") {
+			return strings.Fields(value)
+		}
+		var args []string
+		if err := json.Unmarshal([]byte(value), &args); err != nil ||
+			len(args) == 0 {
+			return nil
+		}
+		return args
+	case "env":
+		if strings.Index(value, "=") <= 0 {
+			return nil
+		}
+	case "workdir":
+		if !filepath.IsAbs(value) {
+			return nil
+		}
+	}
+	return []string{value}
+}
+
+// parseOption sets the option with the given name in opts. Options that take
+// a value are given as name=value. Prefixing the name with "no-" clears the
+// option instead. Returns false if the option is unknown or its value is
+// invalid.
+func parseOption(name string, opts *Options) bool {
+	if i := strings.Index(name, "="); i >= 0 {
+		value := filepath.Clean(name[i+1:])
+		if !filepath.IsAbs(value) {
+			return false
+		}
+		switch name[:i] {
+		case "libdir":
+			opts.LibDir = value
+		case "prefix":
+			opts.Prefix = value
+		default:
+			return false
+		}
+		return true
+	}
+	value := !strings.HasPrefix(name, "no-")
+	switch strings.TrimPrefix(name, "no-") {
+	case "keep-symlinks":
+		opts.KeepSymlinks = value
+	case "strip-debug":
+		opts.StripDebug = value
+	case "strip-all":
+		opts.StripAll = value
+	case "libdir":
+		if value {
+			return false
+		}
+		opts.LibDir = ""
+	case "prefix":
+		if value {
+			return false
+		}
+		opts.Prefix = ""
+	default:
+		return false
+	}
+	return true
+}
+
 func parseSpecLine(filename string, lineNo int, line string,
-	includer func(filename string) (Statements, error)) (
+	includer func(filename string) (Statements, error), opts *Options) (
 	lineStmts Statements, err error) {
 	// Always strip white-space
 	line = strings.TrimSpace(line)
@@ -100,8 +182,20 @@ func parseSpecLine(filename string, lineNo int, line string,
 			if includer != nil {
 				lineStmts, err = includer(m[2])
 			}
+		case "option":
+			if opts != nil && !parseOption(m[2], opts) {
+				err = fmt.Errorf("%s:%d: unknown or invalid option: %s",
+					filename, lineNo, m[2])
+			}
 		case "run":
 			lineStmts = Statements{NewRun(m[2])}
+		default:
+			values := parseImage(m[1], m[2])
+			if values == nil {
+				return nil, fmt.Errorf("%s:%d: invalid %s: %s", filename,
+					lineNo, m[1], m[2])
+			}
+			lineStmts = Statements{NewImage(m[1], values)}
 		}
 	} else if m := linkRe.FindStringSubmatch(line); m != nil {
 		lineStmts = Statements{NewLink(m[3], strings.TrimSpace(m[1]),
@@ -165,6 +259,9 @@ func parseSpecLine(filename string, lineNo int, line string,
 		}
 		f := NewRegularFile(source, target)
 		f.fileAttr.Mode = mode
+		if opts != nil {
+			f.options = *opts
+		}
 		lineStmts = Statements{f}
 	} else {
 		err = fmt.Errorf("%s:%d: invalid spec statement: %s", filename,
@@ -173,8 +270,8 @@ func parseSpecLine(filename string, lineNo int, line string,
 	return
 }
 
-func parseFromFile(filename string, includeDepth int) (stmts Statements,
-	err error) {
+func parseFromFile(filename string, includeDepth int, opts Options) (
+	stmts Statements, err error) {
 	if includeDepth > 8 {
 		err = fmt.Errorf("nesting level too deep, including: %s", filename)
 		return
@@ -204,9 +301,10 @@ func parseFromFile(filename string, includeDepth int) (stmts Statements,
 		line = s.Text()
 		lineStmts, err = parseSpecLine(filename, lineNo, line,
 			func(filename string) (Statements, error) {
+				// Included files start out with the current options
 				return parseFromFile(filepath.Join(fromDir, filename),
-					includeDepth+1)
-			})
+					includeDepth+1, opts)
+			}, &opts)
 		if err != nil {
 			return
 		}
@@ -223,6 +321,8 @@ func parseFromFile(filename string, includeDepth int) (stmts Statements,
 // Parse parses a jailspec file, resolving all include directives. On success,
 // it returns a list of statements and a nil error. Otherwise it returns nil
 // for the list and the encountered error.
+// Option directives apply to the remainder of the file they appear in,
+// including any files it includes afterwards.
 func Parse(filename string) (Statements, error) {
-	return parseFromFile(filename, 0 /* Include depth */)
+	return parseFromFile(filename, 0 /* Include depth */, Options{})
 }
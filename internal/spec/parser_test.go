@@ -29,6 +29,7 @@ package spec
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -39,7 +40,8 @@ const (
 
 func checkParseSpecLineEmpty(line string, t *testing.T) {
 	t.Helper()
-	if stmts, err := parseSpecLine(testFile, testLine, line, nil); err != nil {
+	if stmts, err := parseSpecLine(testFile, testLine, line, nil,
+		nil); err != nil {
 		t.Errorf("expected no error, actual: %s", err)
 	} else if stmts != nil {
 		t.Errorf("expected empty stmts, actual: %s", stmts)
@@ -47,7 +49,7 @@ func checkParseSpecLineEmpty(line string, t *testing.T) {
 }
 
 func checkParseSpecLineSingleStmt(line string, t *testing.T) Statement {
-	stmts, err := parseSpecLine(testFile, testLine, line, nil)
+	stmts, err := parseSpecLine(testFile, testLine, line, nil, nil)
 	if err != nil {
 		t.Errorf("expected no error, actual: %s", err)
 	}
@@ -173,10 +175,112 @@ func TestParseSpecLineDirective(t *testing.T) {
 		func(filename string) (Statements, error) {
 			includeFile = filename
 			return nil, nil
-		})
+		}, nil)
 	if err != nil {
 		t.Errorf("expected no error, actual: %s", err)
 	} else if includeFile != expectInclude {
 		t.Errorf("expected %s, actual: %s", expectInclude, includeFile)
 	}
 }
+
+func TestParseSpecLineImage(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		field  string
+		values []string
+	}{
+		{`entrypoint ["/bin/sh", "-c", "echo hi"]`, "entrypoint",
+			[]string{"/bin/sh", "-c", "echo hi"}},
+		{"cmd /bin/bash  --login", "cmd", []string{"/bin/bash", "--login"}},
+		{"env PATH=/bin:/usr/bin", "env", []string{"PATH=/bin:/usr/bin"}},
+		{"user 1000:100", "user", []string{"1000:100"}},
+		{"workdir /home/user", "workdir", []string{"/home/user"}},
+	} {
+		stmt := checkParseSpecLineSingleStmt(test.line, t)
+		if i, ok := stmt.(Image); !ok {
+			t.Error("expected type Image")
+		} else if i.Field() != test.field {
+			t.Errorf("expected %s, actual: %s", test.field, i.Field())
+		} else if !reflect.DeepEqual(i.Values(), test.values) {
+			t.Errorf("expected %q, actual: %q", test.values, i.Values())
+		}
+	}
+	for _, line := range []string{`entrypoint ["/bin/sh"`, "cmd []",
+		"env PATH", "env =value", "workdir home"} {
+		if _, err := parseSpecLine(testFile, testLine, line, nil,
+			nil); err == nil {
+			t.Errorf("expected error for %s", line)
+		}
+	}
+}
+
+func TestParseSpecLineOption(t *testing.T) {
+	var opts Options
+	stmts, err := parseSpecLine(testFile, testLine, "option keep-symlinks",
+		nil, &opts)
+	if err != nil {
+		t.Errorf("expected no error, actual: %s", err)
+	} else if stmts != nil {
+		t.Errorf("expected empty stmts, actual: %s", stmts)
+	} else if !opts.KeepSymlinks {
+		t.Error("expected keep-symlinks to be set")
+	}
+
+	stmts, err = parseSpecLine(testFile, testLine, "/some/file", nil, &opts)
+	if err != nil {
+		t.Errorf("expected no error, actual: %s", err)
+	} else if f, ok := stmts[0].(RegularFile); !ok {
+		t.Error("expected type RegularFile")
+	} else if !f.Options().KeepSymlinks {
+		t.Error("expected keep-symlinks to be set on statement")
+	}
+
+	if _, err = parseSpecLine(testFile, testLine, "option no-keep-symlinks",
+		nil, &opts); err != nil {
+		t.Errorf("expected no error, actual: %s", err)
+	} else if opts.KeepSymlinks {
+		t.Error("expected keep-symlinks to be cleared")
+	}
+
+	for _, line := range []string{"option libdir=/lib/",
+		"option prefix=/srv/jail"} {
+		if _, err = parseSpecLine(testFile, testLine, line, nil,
+			&opts); err != nil {
+			t.Errorf("expected no error, actual: %s", err)
+		}
+	}
+	if opts.LibDir != "/lib" || opts.Prefix != "/srv/jail" {
+		t.Errorf("expected /lib and /srv/jail, actual: %s and %s",
+			opts.LibDir, opts.Prefix)
+	}
+	if _, err = parseSpecLine(testFile, testLine, "option no-libdir", nil,
+		&opts); err != nil {
+		t.Errorf("expected no error, actual: %s", err)
+	} else if opts.LibDir != "" {
+		t.Error("expected libdir to be cleared")
+	}
+
+	for _, line := range []string{"option strip-debug", "option strip-all",
+		"option no-strip-all"} {
+		if _, err = parseSpecLine(testFile, testLine, line, nil,
+			&opts); err != nil {
+			t.Errorf("expected no error, actual: %s", err)
+		}
+	}
+	if !opts.StripDebug || opts.StripAll {
+		t.Error("expected only strip-debug to be set")
+	}
+
+	for _, line := range []string{"option libdir=lib", "option libdir",
+		"option keep-symlinks=/x"} {
+		if _, err = parseSpecLine(testFile, testLine, line, nil,
+			&opts); err == nil {
+			t.Errorf("expected error for %s", line)
+		}
+	}
+
+	if _, err = parseSpecLine(testFile, testLine, "option no-such-option",
+		nil, &opts); err == nil {
+		t.Error("expected error for unknown option")
+	}
+}
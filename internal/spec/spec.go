@@ -27,19 +27,63 @@
 
 package spec
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // FileAttr General file attributes: if these are not specified in the spec,
 // the file permissions of the source will be used for regular files. For
 // directories, the default mode is 755.
-// In all cases, user and group id default to the values of the current user.
+// In all cases, user and group id default to the values of the current user
+// in directories and to root in archives.
 type FileAttr struct {
 	UID  int // User id
 	GID  int // Group id
 	Mode int // File mode
 }
 
-const FileModeUnspecified = -1
+const (
+	FileModeUnspecified = -1
+	OwnerUnspecified    = -1 // For both user and group id
+)
+
+// defaultFileAttr returns the attributes of statements that do not specify
+// any.
+func defaultFileAttr() FileAttr {
+	return FileAttr{UID: OwnerUnspecified, GID: OwnerUnspecified,
+		Mode: FileModeUnspecified}
+}
+
+// Options control how a statement is applied. They can be set for the rest of
+// a jailspec using the option directive or globally from the command-line.
+type Options struct {
+	// KeepSymlinks recreates symlinks to the source inside the chroot and
+	// only copies the file at the end of the chain.
+	KeepSymlinks bool
+
+	// StripDebug removes debug information and build notes from copies of
+	// ELF files.
+	StripDebug bool
+
+	// StripAll removes symbol tables from copies of ELF files as well.
+	StripAll bool
+
+	// LibDir places all shared libraries and dynamic loaders in this
+	// directory of the chroot, instead of their original locations.
+	LibDir string
+
+	// Prefix is the directory the chroot is mounted at, if it is used
+	// without chroot(2). Interpreter and library paths are rewritten to
+	// start with it.
+	Prefix string
+}
+
+// Relocated returns whether the options change where binaries find their
+// interpreter and libraries, which requires rewriting the copies.
+func (o Options) Relocated() bool {
+	return o.LibDir != "" || o.Prefix != ""
+}
 
 // Statement represents a single filesystem entity or command to be executed
 // inside the chroot.
@@ -74,11 +118,25 @@ func (t targetChrootObj) FileAttr() *FileAttr {
 type RegularFile struct {
 	source string
 	targetChrootObj
+	options Options
+	origin  string // Source of the file that needs this one, if any
 }
 
 func NewRegularFile(source, target string) RegularFile {
 	return RegularFile{source, targetChrootObj{target: target,
-		fileAttr: FileAttr{Mode: FileModeUnspecified}}}
+		fileAttr: defaultFileAttr()}, Options{}, ""}
+}
+
+// Dependency returns a new statement that copies the file at path, which is
+// needed by r, like a shared library or a script interpreter. The new
+// statement has the same options and file attributes as r and records r as
+// its origin.
+func (r RegularFile) Dependency(path string) RegularFile {
+	d := NewRegularFile(path, path)
+	d.fileAttr = r.fileAttr
+	d.options = r.options
+	d.origin = r.source
+	return d
 }
 
 func (r RegularFile) Source() string {
@@ -86,9 +144,41 @@ func (r RegularFile) Source() string {
 }
 
 func (r RegularFile) Verbose() string {
+	if r.origin != "" {
+		return fmt.Sprintf("copy file: %s > %s (needed by %s)", r.source,
+			r.target, r.origin)
+	}
 	return fmt.Sprintf("copy file: %s > %s", r.source, r.target)
 }
 
+// Origin returns the source of the file that this file is a dependency of.
+// For files listed in a jailspec, it is empty.
+func (r RegularFile) Origin() string {
+	return r.origin
+}
+
+func (r RegularFile) Options() Options {
+	return r.options
+}
+
+// WithSource returns a copy of r that copies the file at source instead.
+func (r RegularFile) WithSource(source string) RegularFile {
+	r.source = source
+	return r
+}
+
+// WithTarget returns a copy of r that copies to target instead.
+func (r RegularFile) WithTarget(target string) RegularFile {
+	r.target = target
+	return r
+}
+
+// WithOptions returns a copy of r that uses the given options.
+func (r RegularFile) WithOptions(o Options) RegularFile {
+	r.options = o
+	return r
+}
+
 type Device struct {
 	targetChrootObj
 	type_ int
@@ -98,7 +188,7 @@ type Device struct {
 
 func NewDevice(target string, type_, major, minor int) Device {
 	return Device{targetChrootObj{target: target,
-		fileAttr: FileAttr{Mode: FileModeUnspecified}}, type_, major, minor}
+		fileAttr: defaultFileAttr()}, type_, major, minor}
 }
 
 func (d Device) Source() string {
@@ -128,7 +218,7 @@ type Directory struct {
 
 func NewDirectory(target string) Directory {
 	return Directory{targetChrootObj{target: target,
-		fileAttr: FileAttr{Mode: FileModeUnspecified}}}
+		fileAttr: defaultFileAttr()}}
 }
 
 func (d Directory) Source() string {
@@ -143,10 +233,13 @@ type Link struct {
 	source string
 	targetChrootObj
 	hardLink bool
+	original string // Symlink that this link recreates, if any
 }
 
 func NewLink(source, target string, hardLink bool) Link {
-	return Link{source, targetChrootObj{target: target}, hardLink}
+	return Link{source: source, targetChrootObj: targetChrootObj{
+		target: target, fileAttr: defaultFileAttr()},
+		hardLink: hardLink}
 }
 
 func (l Link) Source() string {
@@ -171,6 +264,18 @@ func (l Link) HardLink() bool {
 	return l.hardLink
 }
 
+// Original returns the path of the existing symlink that l recreates, or
+// an empty string if l was given in the spec.
+func (l Link) Original() string {
+	return l.original
+}
+
+// WithOriginal returns a copy of l that recreates the symlink at original.
+func (l Link) WithOriginal(original string) Link {
+	l.original = original
+	return l
+}
+
 type Run struct {
 	// Command to be run outside the chroot with the current working directory
 	// set to the chroot.
@@ -201,6 +306,41 @@ func (r Run) Command() string {
 	return r.command
 }
 
+// Image sets a field of the configuration of container images built from
+// the jail, like their entrypoint. It does not change the jail itself.
+type Image struct {
+	field  string // "entrypoint", "cmd", "env", "user" or "workdir"
+	values []string
+}
+
+func NewImage(field string, values []string) Image {
+	return Image{field, values}
+}
+
+func (i Image) Source() string {
+	return ""
+}
+
+func (i Image) Target() string {
+	return ""
+}
+
+func (i Image) FileAttr() *FileAttr {
+	return nil
+}
+
+func (i Image) Verbose() string {
+	return fmt.Sprintf("image %s: %s", i.field, strings.Join(i.values, " "))
+}
+
+func (i Image) Field() string {
+	return i.field
+}
+
+func (i Image) Values() []string {
+	return i.values
+}
+
 // Statements is a sortable slice of Statement elements.
 type Statements []Statement
 
@@ -216,6 +356,8 @@ func statementToInt(s Statement) int {
 		return 40
 	case Run:
 		return 900
+	case Image:
+		return 950
 	default:
 		return 1000
 	}
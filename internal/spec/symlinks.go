@@ -0,0 +1,89 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Symlink chain expansion
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package spec
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+// Maximum number of symlinks to follow, same as MAXSYMLINKS on Linux.
+const maxSymlinks = 40
+
+// ExpandSymlinks recreates the chain of symlinks leading from the source of f
+// to a regular file. Each link in the chain results in a Link statement and
+// only the file at the end of the chain is copied. Intermediate links and the
+// file are placed at the same paths relative to the target of f as they have
+// relative to its source, which are their original paths if both are the
+// same. Relative link values are kept as-is, absolute ones are mapped the
+// same way and hence resolve relative to the chroot. Sources are looked up
+// inside root. If the source of f is not a symlink, the result only contains
+// f.
+func ExpandSymlinks(f RegularFile, root sysroot.Root) (Statements, error) {
+	stmts := Statements{}
+	source, target := f.source, f.target
+	sourceDir, targetDir := filepath.Dir(source), filepath.Dir(target)
+	mapTarget := func(p string) string {
+		rel, err := filepath.Rel(sourceDir, p)
+		if err != nil {
+			return p
+		}
+		return filepath.Join(targetDir, rel)
+	}
+	for i := 0; ; i++ {
+		if i > maxSymlinks {
+			return nil, fmt.Errorf("too many levels of symbolic links: %s",
+				f.source)
+		}
+		fi, err := root.Lstat(source)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		value, err := root.Readlink(source)
+		if err != nil {
+			return nil, err
+		}
+		next := value
+		if filepath.IsAbs(next) {
+			value = mapTarget(next)
+		} else {
+			next = filepath.Join(filepath.Dir(source), value)
+		}
+		stmts = append(stmts,
+			NewLink(value, target, false).WithOriginal(source))
+		source, target = next, mapTarget(next)
+	}
+	f.source, f.target = source, target
+	return append(stmts, f), nil
+}
@@ -0,0 +1,97 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Symlink chain expansion tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package spec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandSymlinks(t *testing.T) {
+	td, err := ioutil.TempDir("", "symlinks_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	lib := filepath.Join(td, "libfoo.so.1.2.3")
+	if err := ioutil.WriteFile(lib, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// libfoo.so -> libfoo.so.1 -> <td>/libfoo.so.1.2.3
+	if err := os.Symlink(lib, filepath.Join(td, "libfoo.so.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("libfoo.so.1",
+		filepath.Join(td, "libfoo.so")); err != nil {
+		t.Fatal(err)
+	}
+
+	source := filepath.Join(td, "libfoo.so")
+	stmts, err := ExpandSymlinks(NewRegularFile(source, source), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Statements{
+		NewLink("libfoo.so.1", source, false).WithOriginal(source),
+		NewLink(lib, filepath.Join(td, "libfoo.so.1"),
+			false).WithOriginal(filepath.Join(td, "libfoo.so.1")),
+		NewRegularFile(lib, lib),
+	}
+	if !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected %s, actual %s", expected, stmts)
+	}
+
+	// Copying to a different directory places the whole chain there
+	stmts, err = ExpandSymlinks(NewRegularFile(source, "/lib/libfoo.so"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Statements{
+		NewLink("libfoo.so.1", "/lib/libfoo.so", false).WithOriginal(source),
+		NewLink("/lib/libfoo.so.1.2.3", "/lib/libfoo.so.1",
+			false).WithOriginal(filepath.Join(td, "libfoo.so.1")),
+		NewRegularFile(lib, "/lib/libfoo.so.1.2.3"),
+	}
+	if !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected %s, actual %s", expected, stmts)
+	}
+
+	// Regular files are left alone
+	stmts, err = ExpandSymlinks(NewRegularFile(lib, lib), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Statements{NewRegularFile(lib, lib)}); !reflect.DeepEqual(
+		stmts, expected) {
+		t.Errorf("expected %s, actual %s", expected, stmts)
+	}
+}
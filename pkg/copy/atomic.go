@@ -0,0 +1,156 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Atomic file replacement
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package copy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrInterrupted is returned for writes started after RemoveTemporaries.
+var ErrInterrupted = errors.New("interrupted")
+
+// Temporary files that are still being written, see RemoveTemporaries
+var temporaries = struct {
+	sync.Mutex
+	files       map[string]bool
+	interrupted bool
+}{files: make(map[string]bool)}
+
+// createTemp creates a temporary file in the directory of dest that will
+// later replace it.
+func createTemp(dest string) (*os.File, error) {
+	temporaries.Lock()
+	defer temporaries.Unlock()
+	if temporaries.interrupted {
+		return nil, ErrInterrupted
+	}
+	t, err := ioutil.TempFile(filepath.Dir(dest),
+		"."+filepath.Base(dest)+".")
+	if err != nil {
+		return nil, err
+	}
+	temporaries.files[t.Name()] = true
+	return t, nil
+}
+
+// discardTemp closes and removes the temporary file t.
+func discardTemp(t *os.File) {
+	t.Close()
+	temporaries.Lock()
+	defer temporaries.Unlock()
+	if temporaries.files[t.Name()] {
+		os.Remove(t.Name())
+		delete(temporaries.files, t.Name())
+	}
+}
+
+// commitTemp closes the temporary file t and renames it to dest, replacing
+// any existing file. With opt.Sync, the data is flushed to disk first.
+// With opt.Force, a destination that cannot be replaced, like an empty
+// directory, is removed first. On error, t is removed.
+func commitTemp(t *os.File, dest string, opt *Options) (err error) {
+	if opt.Sync {
+		err = t.Sync()
+	}
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	temporaries.Lock()
+	defer temporaries.Unlock()
+	if temporaries.interrupted {
+		return ErrInterrupted // Already removed
+	}
+	delete(temporaries.files, t.Name())
+	if err == nil {
+		err = os.Rename(t.Name(), dest)
+		if err != nil && opt.Force && os.Remove(dest) == nil {
+			err = os.Rename(t.Name(), dest)
+		}
+	}
+	if err != nil {
+		os.Remove(t.Name())
+	}
+	return
+}
+
+// WriteFile atomically replaces the file filename with data, like
+// ioutil.WriteFile. The data is written to a temporary file first, which is
+// renamed over filename once complete. With opt.Preserve, the new file
+// keeps these attributes of the file it replaces. Only the Force, Preserve,
+// RemoveDestination and Sync options are used.
+func WriteFile(filename string, data []byte, perm os.FileMode,
+	opt *Options) error {
+	if opt == nil {
+		opt = &Options{}
+	}
+	var old os.FileInfo
+	if opt.Preserve != 0 {
+		fi, err := os.Lstat(filename)
+		if err == nil && fi.Mode().IsRegular() {
+			old = fi
+		}
+	}
+	if opt.RemoveDestination {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	t, err := createTemp(filename)
+	if err != nil {
+		return err
+	}
+	if err = t.Chmod(perm); err == nil {
+		_, err = t.Write(data)
+	}
+	if err == nil && old != nil {
+		err = setAttributes(filename, t.Name(), old, opt.Preserve)
+	}
+	if err != nil {
+		discardTemp(t)
+		return err
+	}
+	return commitTemp(t, filename, opt)
+}
+
+// RemoveTemporaries removes all temporary files that are still being
+// written and makes further writes fail with ErrInterrupted. Destination
+// files keep their previous contents. This is meant to be called from a
+// signal handler before exiting.
+func RemoveTemporaries() {
+	temporaries.Lock()
+	defer temporaries.Unlock()
+	temporaries.interrupted = true
+	for name := range temporaries.files {
+		os.Remove(name)
+	}
+	temporaries.files = nil
+}
@@ -0,0 +1,183 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Atomic file replacement
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package copy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkContent verifies the content of filename.
+func checkContent(t *testing.T, filename, expected string) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(b); actual != expected {
+		t.Errorf("%s: expected %q, actual %q", filename, expected, actual)
+	}
+}
+
+// checkNoTemporaries verifies that no temporary files are left in dir.
+func checkNoTemporaries(t *testing.T, dir string, expected int) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != expected {
+		t.Errorf("expected %d files, actual %d", expected, len(fis))
+	}
+}
+
+func TestFileReplace(t *testing.T) {
+	td, err := ioutil.TempDir("", "atomic_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	src := filepath.Join(td, "src")
+	dest := filepath.Join(td, "dest")
+	linked := filepath.Join(td, "linked")
+	if err := ioutil.WriteFile(src, []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dest, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(dest, linked); err != nil {
+		t.Fatal(err)
+	}
+
+	// Aborted copies leave the destination alone
+	if _, err := File(src, dest, &Options{
+		Progress: func(written, total int64) bool { return false },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, "old")
+	checkNoTemporaries(t, td, 3)
+
+	// The destination is replaced, not overwritten
+	if _, err := File(src, dest, &Options{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, "new")
+	checkContent(t, linked, "old")
+	checkNoTemporaries(t, td, 3)
+	if fi, err := os.Stat(dest); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0755 {
+		t.Errorf("expected %s, actual %s", os.FileMode(0755), fi.Mode())
+	}
+}
+
+func TestFileForce(t *testing.T) {
+	td, err := ioutil.TempDir("", "atomic_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	src := filepath.Join(td, "src")
+	dest := filepath.Join(td, "dest")
+	if err := ioutil.WriteFile(src, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := File(src, dest, nil); err == nil {
+		t.Errorf("expected error replacing a directory")
+	}
+	checkNoTemporaries(t, td, 2)
+	if _, err := File(src, dest, &Options{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, "file")
+
+	// Missing destinations are fine with RemoveDestination
+	os.Remove(dest)
+	if _, err := File(src, dest, &Options{
+		RemoveDestination: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, "file")
+}
+
+func TestWriteFile(t *testing.T) {
+	td, err := ioutil.TempDir("", "atomic_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	dest := filepath.Join(td, "dest")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFile(dest, []byte(content), 0600, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkContent(t, dest, content)
+	}
+	if fi, err := os.Stat(dest); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0600 {
+		t.Errorf("expected %s, actual %s", os.FileMode(0600), fi.Mode())
+	}
+	checkNoTemporaries(t, td, 1)
+}
+
+func TestRemoveTemporaries(t *testing.T) {
+	td, err := ioutil.TempDir("", "atomic_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	defer func() {
+		temporaries.files = make(map[string]bool)
+		temporaries.interrupted = false
+	}()
+
+	dest := filepath.Join(td, "dest")
+	tmp, err := createTemp(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoTemporaries(t, td, 1)
+	RemoveTemporaries()
+	checkNoTemporaries(t, td, 0)
+	if err := commitTemp(tmp, dest, &Options{}); err != ErrInterrupted {
+		t.Errorf("expected %s, actual %v", ErrInterrupted, err)
+	}
+	if err := WriteFile(dest, nil, 0644, nil); err != ErrInterrupted {
+		t.Errorf("expected %s, actual %v", ErrInterrupted, err)
+	}
+	checkNoTemporaries(t, td, 0)
+}
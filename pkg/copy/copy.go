@@ -28,7 +28,7 @@
 package copy
 
 import (
-	"bufio"
+	"fmt"
 	"io"
 	"os"
 )
@@ -45,18 +45,62 @@ type Options struct {
 	RemoveDestination bool
 	Progress          func(written, total int64) bool
 	BufSize           int64
+	Sync              bool     // Flush data to disk before replacing dest
+	Preserve          Preserve // Attributes to keep besides the mode
 }
 
 const defaultBufSize = 1 << 20 // 1 MiB
 
+// Method is the way the data of a file was copied.
+type Method int
+
+const (
+	MethodReadWrite Method = iota // read(2) and write(2), skipping holes
+	MethodCopyRange               // In-kernel copy via copy_file_range(2)
+	MethodClone                   // Copy-on-write clone sharing all data
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodCopyRange:
+		return "copy_file_range"
+	case MethodClone:
+		return "clone"
+	}
+	return "read/write"
+}
+
+// Result describes a completed copy.
+type Result struct {
+	Written int64  // Number of bytes copied, including holes
+	Method  Method // How the data was copied
+}
+
 // File copies the file named in src to a file named in dest. It returns the
-// number of bytes written and an error, if any. File uses buffered I/O and
-// delegates to io.Copy to do the actual work. The behavior can be optionally
-// influenced by setting options in opt.
+// number of bytes written and an error, if any. See FileResult for details.
 func File(src, dest string, opt *Options) (written int64, err error) {
-	if opt == nil {
-		opt = &Options{}
+	r, err := FileResult(src, dest, opt)
+	return r.Written, err
+}
+
+// FileResult copies the file named in src to a file named in dest. It
+// returns the number of bytes written and the copy method used, and an
+// error, if any. Depending on opt.Reflink and the platform, FileResult
+// clones the file, copies it in the kernel or reads and writes it using a
+// buffer. Holes in sparse files are preserved where possible. The copy is
+// written to a temporary file next to dest first and then renamed, so that
+// dest is replaced atomically and processes that use it never see partial
+// contents. The behavior can be optionally influenced by setting options in
+// opt. The mode of src is always kept, other attributes only if set in
+// opt.Preserve. If the copy is aborted by opt.Progress, dest is left
+// unchanged.
+func FileResult(src, dest string, opt *Options) (r Result, err error) {
+	// Work on a copy, so that concurrent copies can share opt
+	o := Options{}
+	if opt != nil {
+		o = *opt
 	}
+	opt = &o
 	if opt.Progress == nil {
 		opt.Progress = func(w, t int64) bool { return true }
 	}
@@ -74,63 +118,73 @@ func File(src, dest string, opt *Options) (written int64, err error) {
 	if fi, err = s.Stat(); err != nil {
 		return
 	}
-	total := fi.Size()
 
 	if opt.RemoveDestination {
-		if err = os.Remove(dest); err != nil {
+		if err = os.Remove(dest); err != nil && !os.IsNotExist(err) {
 			return
 		}
 	}
 
-	hardFail := false
-	reflink := HaveCoW() && opt.Reflink != ReflinkNo
-	var t *os.File
-Retry:
-	if reflink {
-		err = cloneFile(src, dest)
-		if err != nil && opt.Reflink == ReflinkAuto {
-			reflink = false
-			goto Retry
-		}
-		opt.Progress(total, total)
-		return
-	} else {
-		t, err = os.Create(dest)
-	}
+	t, err := createTemp(dest)
 	if err != nil {
-		if opt.Force && !hardFail {
-			hardFail = true
-			if err = os.Remove(dest); err == nil {
-				goto Retry
-			}
-		}
 		return
 	}
-	err = t.Chmod(fi.Mode())
-	if err != nil {
-		return
+	// Note whether the copy was aborted, as the source may also have shrunk
+	aborted := false
+	progress := *opt
+	progress.Progress = func(written, total int64) bool {
+		aborted = aborted || !opt.Progress(written, total)
+		return !aborted
 	}
-
-	r, w := bufio.NewReader(s), bufio.NewWriter(t)
-	var copied int64
-	for written = 0; opt.Progress(written, total) && written < total; {
-		copied, err = io.CopyN(w, r, opt.BufSize)
-		written += copied
-		if copied != opt.BufSize {
-			break
+	err = t.Chmod(fi.Mode())
+	if err == nil {
+		r, err = copyData(t, s, fi.Size(), &progress)
+		if err != nil && r.Method == MethodClone {
+			err = fmt.Errorf("failed to clone %s from %s: %s", dest, src,
+				err)
 		}
 	}
-	if err == io.EOF {
-		err = nil
+	if err == nil && !aborted && opt.Preserve != 0 {
+		err = setAttributes(src, t.Name(), fi, opt.Preserve|PreserveMode)
 	}
-	lastErr := err
-	if err := w.Flush(); lastErr == nil {
-		lastErr = err
-	}
-	if err := t.Close(); lastErr == nil {
-		lastErr = err
+	if err != nil || aborted {
+		discardTemp(t)
+		return
 	}
-
-	err = lastErr
+	err = commitTemp(t, dest, opt)
 	return
 }
+
+// readWrite copies the bytes from start to end of s to the same offsets in
+// t. The total size is only used to report progress. Returns the offset up
+// to which data was copied.
+func readWrite(t, s *os.File, start, end, total int64,
+	opt *Options) (int64, error) {
+	size := opt.BufSize
+	if end-start < size {
+		size = end - start
+	}
+	buf := make([]byte, size)
+	for off := start; off < end; {
+		if !opt.Progress(off, total) {
+			return off, nil
+		}
+		n := int64(len(buf))
+		if end-off < n {
+			n = end - off
+		}
+		read, err := s.ReadAt(buf[:n], off)
+		if read > 0 {
+			if _, werr := t.WriteAt(buf[:read], off); werr != nil {
+				return off, werr
+			}
+			off += int64(read)
+		}
+		if err == io.EOF {
+			return off, nil // File was truncated while copying
+		} else if err != nil {
+			return off, err
+		}
+	}
+	return end, nil
+}
@@ -28,6 +28,7 @@
 package copy
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -52,21 +53,24 @@ func TestFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var written int64
+	var r Result
 
 	// Simple copy with default settings
 	cf := filepath.Join(td, "copiedfile")
-	written, err = File(tf, cf, nil)
+	r, err = FileResult(tf, cf, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if written != int64(len(content)) {
-		t.Errorf("expected %d, actual %d", len(content), written)
+	if r.Written != int64(len(content)) {
+		t.Errorf("expected %d, actual %d", len(content), r.Written)
+	}
+	if r.Method != MethodReadWrite {
+		t.Errorf("expected %s, actual %s", MethodReadWrite, r.Method)
 	}
 
 	// Copy with progress callback and small buffer, overwrite
 	numCalled := 0
-	written, err = File(tf, cf, &Options{
+	written, err := File(tf, cf, &Options{
 		Progress: func(written, total int64) bool {
 			numCalled++
 			return true
@@ -83,3 +87,38 @@ func TestFile(t *testing.T) {
 		t.Errorf("expected at least %d, actual %d", 2, numCalled)
 	}
 }
+
+func TestFileReflink(t *testing.T) {
+	td, err := ioutil.TempDir("", "copy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	content := bytes.Repeat([]byte("reflink "), 1024)
+	tf := filepath.Join(td, "testfile")
+	if err := ioutil.WriteFile(tf, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cf := filepath.Join(td, "copiedfile")
+
+	// Whether cloning works depends on the filesystem
+	r, err := FileResult(tf, cf, &Options{Reflink: ReflinkAlways})
+	cloned := err == nil
+	if cloned && r.Method != MethodClone {
+		t.Errorf("expected %s, actual %s", MethodClone, r.Method)
+	}
+	r, err = FileResult(tf, cf, &Options{Reflink: ReflinkAuto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloned && r.Method != MethodClone ||
+		!cloned && r.Method == MethodClone {
+		t.Errorf("unexpected method %s", r.Method)
+	}
+	if b, err := ioutil.ReadFile(cf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, content) {
+		t.Errorf("expected identical content")
+	}
+}
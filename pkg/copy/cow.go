@@ -31,12 +31,22 @@ package copy
 
 import (
 	"errors"
+	"os"
 )
 
+// HaveCoW returns whether files can be cloned, which is never the case here.
 func HaveCoW() bool {
 	return false
 }
 
-func cloneFile(src, dest string) error {
-	return errors.New("not implemented")
+// copyData copies total bytes from s to t, which must be empty.
+func copyData(t, s *os.File, total int64, opt *Options) (Result, error) {
+	if opt.Reflink == ReflinkAlways {
+		return Result{Method: MethodClone}, errors.New("not implemented")
+	}
+	written, err := readWrite(t, s, 0, total, total, opt)
+	if err == nil && written == total {
+		opt.Progress(written, total)
+	}
+	return Result{Written: written}, err
 }
@@ -59,4 +59,6 @@ func ioctl(fd int, request, argp uintptr) error {
 	return nil
 }
 
-const btrfsIoCtlMagic = 0x94
+// FICLONE, see linux/fs.h. Originally BTRFS_IOC_CLONE, it is supported by
+// XFS, bcachefs and others as well.
+var fiClone = iow(0x94, 9, 4 /* sizeof(int) */)
@@ -28,26 +28,163 @@
 package copy
 
 import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
 	"syscall"
+	"unsafe"
 )
 
+// From linux/fs.h
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// System call numbers of copy_file_range(2), which the syscall package does
+// not define. Architectures not listed fall back to read(2)/write(2).
+var sysCopyFileRange = map[string]uintptr{
+	"386":      377,
+	"amd64":    326,
+	"arm":      391,
+	"arm64":    285,
+	"loong64":  285,
+	"mips":     4360,
+	"mipsle":   4360,
+	"mips64":   5320,
+	"mips64le": 5320,
+	"ppc64":    379,
+	"ppc64le":  379,
+	"riscv64":  285,
+	"s390x":    375,
+}[runtime.GOARCH]
+
+var (
+	haveCoWOnce sync.Once
+	haveCoW     bool
+)
+
+// HaveCoW returns whether the file system of the temporary directory
+// supports cloning files with FICLONE. Other file systems may differ. The
+// result is determined once, by cloning a temporary file.
 func HaveCoW() bool {
-	return true
+	haveCoWOnce.Do(func() {
+		s, err := ioutil.TempFile("", ".cow")
+		if err != nil {
+			return
+		}
+		defer os.Remove(s.Name())
+		defer s.Close()
+		t, err := ioutil.TempFile("", ".cow")
+		if err != nil {
+			return
+		}
+		defer os.Remove(t.Name())
+		defer t.Close()
+		if _, err = s.Write([]byte("jailtime")); err == nil {
+			haveCoW = cloneFile(t, s) == nil
+		}
+	})
+	return haveCoW
+}
+
+// cloneFile makes t share all data of s, if the filesystem supports it.
+func cloneFile(t, s *os.File) error {
+	return ioctl(int(t.Fd()), fiClone, s.Fd())
+}
+
+// copyFileRange copies up to n bytes at off from s to t in the kernel.
+func copyFileRange(t, s *os.File, off, n int64) (int64, error) {
+	if sysCopyFileRange == 0 {
+		return 0, syscall.ENOSYS
+	}
+	roff, woff := off, off
+	r, _, errno := syscall.Syscall6(sysCopyFileRange, s.Fd(),
+		uintptr(unsafe.Pointer(&roff)), t.Fd(),
+		uintptr(unsafe.Pointer(&woff)), uintptr(n), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(r), nil
+}
+
+// nextData returns the range of the next data extent of s at or after off.
+// Without support for SEEK_DATA, the rest of the file is a single extent.
+func nextData(s *os.File, off, total int64) (start, end int64) {
+	fd := int(s.Fd())
+	start, err := syscall.Seek(fd, off, seekData)
+	if err == syscall.ENXIO {
+		return total, total // Only a hole is left
+	} else if err != nil {
+		return off, total
+	}
+	if end, err = syscall.Seek(fd, start, seekHole); err != nil ||
+		end > total {
+		end = total
+	}
+	return
 }
 
-func cloneFile(src, dest string) error {
-	srcFd, err := syscall.Open(src, syscall.O_RDONLY, 0644)
-	if err != nil {
-		return err
+// copyData copies total bytes from s to t, which must be empty. It tries to
+// clone s first, then copies each data extent with copy_file_range(2) or
+// read(2)/write(2). Holes are recreated by leaving them out.
+func copyData(t, s *os.File, total int64, opt *Options) (r Result,
+	err error) {
+	if opt.Reflink != ReflinkNo {
+		if err = cloneFile(t, s); err == nil {
+			opt.Progress(total, total)
+			return Result{Written: total, Method: MethodClone}, nil
+		}
+		if opt.Reflink == ReflinkAlways {
+			return Result{Method: MethodClone}, err
+		}
+	}
+	// copy_file_range(2) may share data as well, so only use it if reflinks
+	// are allowed.
+	useRange := opt.Reflink != ReflinkNo
+	off := int64(0)
+	for off < total {
+		start, end := nextData(s, off, total)
+		if start >= total {
+			break
+		}
+		for off = start; useRange && off < end; {
+			if !opt.Progress(off, total) {
+				return Result{Written: off, Method: r.Method}, nil
+			}
+			n := end - off
+			if n > opt.BufSize {
+				n = opt.BufSize
+			}
+			n, err = copyFileRange(t, s, off, n)
+			if err != nil || n == 0 {
+				switch err {
+				case nil, syscall.ENOSYS, syscall.EXDEV, syscall.EINVAL,
+					syscall.EOPNOTSUPP, syscall.EBADF, syscall.EPERM,
+					syscall.ETXTBSY:
+					// Not supported for these files, or a pseudo file that
+					// reports a size of zero
+					useRange, err = false, nil
+					continue
+				}
+				return Result{Written: off, Method: r.Method}, err
+			}
+			off += n
+			r.Method = MethodCopyRange
+		}
+		if off < end {
+			done, err := readWrite(t, s, off, end, total, opt)
+			if err != nil || done < end {
+				return Result{Written: done, Method: r.Method}, err
+			}
+			off = end
+		}
 	}
-	defer syscall.Close(srcFd) // Safe to ignore close error on read-only files
-	destFd, err := syscall.Open(dest, syscall.O_WRONLY|syscall.O_CREAT, 0644)
-	if err != nil {
-		return err
+	// Trailing holes need an explicit size
+	if err = t.Truncate(total); err != nil {
+		return
 	}
-	defer syscall.Close(destFd)
-	return ioctl(destFd,
-		// BTRFS_IOC_CLONE, see linux/btrfs.h
-		iow(btrfsIoCtlMagic, 9, 4 /* sizeof(int) */),
-		uintptr(srcFd))
+	opt.Progress(total, total)
+	return Result{Written: total, Method: r.Method}, nil
 }
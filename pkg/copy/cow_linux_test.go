@@ -0,0 +1,122 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Linux-specific Copy-on-Write functionality
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package copy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// allocated returns the number of bytes allocated on disk for filename.
+func allocated(t *testing.T, filename string) int64 {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestFileSparse(t *testing.T) {
+	td, err := ioutil.TempDir("", "copy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// 8 MiB hole, some data, and a trailing hole
+	const size = 16 << 20
+	data := bytes.Repeat([]byte("data"), 1024)
+	tf := filepath.Join(td, "sparse")
+	f, err := os.Create(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(data, 8<<20)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated(t, tf) >= size {
+		t.Skip("filesystem does not support sparse files")
+	}
+
+	for _, reflink := range []int{ReflinkNo, ReflinkAuto} {
+		cf := filepath.Join(td, "copy")
+		r, err := FileResult(tf, cf, &Options{Reflink: reflink,
+			RemoveDestination: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Written != size {
+			t.Errorf("expected %d, actual %d", size, r.Written)
+		}
+		if reflink == ReflinkNo && r.Method != MethodReadWrite {
+			t.Errorf("expected %s, actual %s", MethodReadWrite, r.Method)
+		}
+		b, err := ioutil.ReadFile(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != size || !bytes.Equal(b[8<<20:8<<20+len(data)], data) {
+			t.Errorf("%s: expected identical content", r.Method)
+		}
+		if actual := allocated(t, cf); actual >= size/2 {
+			t.Errorf("%s: expected sparse copy, actual %d bytes allocated",
+				r.Method, actual)
+		}
+	}
+}
+
+func TestHaveCoW(t *testing.T) {
+	td, err := ioutil.TempDir("", "copy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// Cloning in the temporary directory works exactly if HaveCoW says so
+	tf := filepath.Join(td, "source")
+	if err := ioutil.WriteFile(tf, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = File(tf, filepath.Join(td, "clone"),
+		&Options{Reflink: ReflinkAlways})
+	if expected, actual := HaveCoW(), err == nil; expected != actual {
+		t.Errorf("expected clone to succeed: %t, actual %t (%v)", expected,
+			actual, err)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Preservation of file attributes
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package copy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Preserve is a set of file attributes that copies keep, like the
+// --preserve option of GNU cp.
+type Preserve int
+
+const (
+	PreserveMode       Preserve = 1 << iota // Permissions and set-id bits
+	PreserveOwnership                       // User and group
+	PreserveTimestamps                      // Access and modification times
+	PreserveXattr                           // Extended attributes
+
+	PreserveAll = PreserveMode | PreserveOwnership | PreserveTimestamps |
+		PreserveXattr
+)
+
+var preserveNames = []struct {
+	name string
+	p    Preserve
+}{
+	{"mode", PreserveMode},
+	{"ownership", PreserveOwnership},
+	{"timestamps", PreserveTimestamps},
+	{"xattr", PreserveXattr},
+}
+
+// ParsePreserve parses a comma-separated list of attribute names in the
+// format of GNU cp: mode, ownership, timestamps, xattr and all.
+func ParsePreserve(list string) (Preserve, error) {
+	var p Preserve
+	for _, name := range strings.Split(list, ",") {
+		found := name == "all"
+		if found {
+			p |= PreserveAll
+		}
+		for _, n := range preserveNames {
+			if name == n.name {
+				p |= n.p
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid attribute '%s'", name)
+		}
+	}
+	return p, nil
+}
+
+func (p Preserve) String() string {
+	var names []string
+	for _, n := range preserveNames {
+		if p&n.p != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Attributes gives dest the attributes in p of src. Symlinks are not
+// followed, so that if both are symlinks, the ownership and timestamps of
+// the links themselves are copied. Modes and extended attributes are not
+// changed on symlinks.
+func Attributes(src, dest string, p Preserve) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	return setAttributes(src, dest, fi, p)
+}
+
+// setAttributes gives the file dest the attributes in p of the file src,
+// which is described by fi. Failures to change the ownership or to set
+// extended attributes due to missing privileges are ignored unless running
+// as root, as GNU cp does.
+func setAttributes(src, dest string, fi os.FileInfo, p Preserve) error {
+	link := fi.Mode()&os.ModeSymlink != 0
+	if p&PreserveOwnership != 0 {
+		if uid, gid, ok := fileOwner(fi); ok {
+			err := os.Lchown(dest, uid, gid)
+			if err != nil && !unprivileged(err) {
+				return err
+			}
+		}
+	}
+	if link {
+		p &^= PreserveMode | PreserveXattr
+	}
+	// Changing the owner clears the set-id bits, so always restore the mode
+	// afterwards.
+	if p&PreserveMode != 0 {
+		if err := os.Chmod(dest, fi.Mode()); err != nil {
+			return err
+		}
+	}
+	if p&PreserveXattr != 0 {
+		if err := copyXattrs(src, dest); err != nil {
+			return err
+		}
+	}
+	if p&PreserveTimestamps != 0 {
+		atime, mtime := fileTimes(fi)
+		return lutimes(dest, atime, mtime)
+	}
+	return nil
+}
+
+// unprivileged returns whether err is a permission error of an unprivileged
+// process.
+func unprivileged(err error) bool {
+	return os.IsPermission(err) && os.Geteuid() != 0
+}
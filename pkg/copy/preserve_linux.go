@@ -0,0 +1,140 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Preservation of file attributes, Linux specific parts
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package copy
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	atFdCwd           = -100
+	atSymlinkNoFollow = 0x100
+)
+
+// fileOwner returns the user and group in fi.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// fileTimes returns the access and modification times in fi.
+func fileTimes(fi os.FileInfo) (atime, mtime time.Time) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime(), fi.ModTime()
+	}
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)),
+		time.Unix(int64(st.Mtim.Sec), int64(st.Mtim.Nsec))
+}
+
+// lutimes sets the access and modification times of the file path. If it is
+// a symlink, the times of the link itself are changed.
+func lutimes(path string, atime, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	dirfd := atFdCwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd),
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])),
+		atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// listXattrs returns the names of the extended attributes of the file path.
+func listXattrs(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+	var names []string
+	start := 0
+	for i, c := range buf[:size] {
+		if c == 0 {
+			names = append(names, string(buf[start:i]))
+			start = i + 1
+		}
+	}
+	return names, nil
+}
+
+// Xattrs returns the extended attributes of the file path. File systems
+// without extended attributes have none.
+func Xattrs(path string) (map[string][]byte, error) {
+	names, err := listXattrs(path)
+	if err == syscall.ENOTSUP {
+		return nil, nil // File system without extended attributes
+	} else if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	attrs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(path, name, value); err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		attrs[name] = value[:size]
+	}
+	return attrs, nil
+}
+
+// copyXattrs copies all extended attributes of the file src to dest.
+func copyXattrs(src, dest string) error {
+	attrs, err := Xattrs(src)
+	if err != nil {
+		return err
+	}
+	for name, value := range attrs {
+		err = syscall.Setxattr(dest, name, value, 0)
+		if err != nil && !unprivileged(err) {
+			return &os.PathError{Op: "setxattr", Path: dest, Err: err}
+		}
+	}
+	return nil
+}
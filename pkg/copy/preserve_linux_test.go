@@ -0,0 +1,71 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for preservation of extended attributes
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package copy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFileXattr(t *testing.T) {
+	td, err := ioutil.TempDir("", "preserve_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	src := filepath.Join(td, "src")
+	dest := filepath.Join(td, "dest")
+	if err := ioutil.WriteFile(src, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const name, expected = "user.jailtime", "value"
+	if err := syscall.Setxattr(src, name, []byte(expected),
+		0); err != nil {
+		t.Skipf("extended attributes not supported: %s", err)
+	}
+
+	opt := &Options{Preserve: PreserveXattr}
+	if _, err := File(src, dest, opt); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if n, err := syscall.Getxattr(dest, name, buf); err != nil {
+		t.Errorf("expected no error, actual %s", err)
+	} else if actual := string(buf[:n]); actual != expected {
+		t.Errorf("expected %s, actual %s", expected, actual)
+	}
+	if attrs, err := Xattrs(dest); err != nil {
+		t.Errorf("expected no error, actual %s", err)
+	} else if actual := string(attrs[name]); actual != expected {
+		t.Errorf("expected %s, actual %s", expected, actual)
+	}
+}
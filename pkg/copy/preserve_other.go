@@ -0,0 +1,66 @@
+// +build !linux
+
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Preservation of file attributes for other platforms
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package copy
+
+import (
+	"os"
+	"time"
+)
+
+// fileOwner returns no owner, ownership is only preserved on Linux.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// fileTimes returns the access and modification times in fi. Only the
+// modification time is available portably.
+func fileTimes(fi os.FileInfo) (atime, mtime time.Time) {
+	return fi.ModTime(), fi.ModTime()
+}
+
+// lutimes sets the access and modification times of the file path. The
+// times of symlinks are left unchanged.
+func lutimes(path string, atime, mtime time.Time) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+// Xattrs returns no extended attributes, they are only supported on Linux.
+func Xattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// copyXattrs is a no-op, extended attributes are only copied on Linux.
+func copyXattrs(src, dest string) error {
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Tests for preservation of file attributes
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package copy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checkModTime verifies the modification time of filename without
+// following symlinks.
+func checkModTime(t *testing.T, filename string, expected time.Time) {
+	t.Helper()
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := fi.ModTime(); !actual.Equal(expected) {
+		t.Errorf("%s: expected %s, actual %s", filename, expected, actual)
+	}
+}
+
+func TestParsePreserve(t *testing.T) {
+	for list, expected := range map[string]Preserve{
+		"mode":                      PreserveMode,
+		"timestamps,ownership":      PreserveOwnership | PreserveTimestamps,
+		"all":                       PreserveAll,
+		"xattr,mode,xattr":          PreserveMode | PreserveXattr,
+		"mode,ownership,timestamps": PreserveAll &^ PreserveXattr,
+	} {
+		if actual, err := ParsePreserve(list); err != nil {
+			t.Errorf("expected no error, actual %s", err)
+		} else if actual != expected {
+			t.Errorf("expected %s, actual %s", expected, actual)
+		}
+	}
+	for _, list := range []string{"", "links", "mode,"} {
+		if _, err := ParsePreserve(list); err == nil {
+			t.Errorf("expected error for %q", list)
+		}
+	}
+	const expected = "mode,ownership,timestamps,xattr"
+	if actual := PreserveAll.String(); actual != expected {
+		t.Errorf("expected %s, actual %s", expected, actual)
+	}
+}
+
+func TestFilePreserve(t *testing.T) {
+	td, err := ioutil.TempDir("", "preserve_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	src := filepath.Join(td, "src")
+	dest := filepath.Join(td, "dest")
+	if err := ioutil.WriteFile(src, []byte("file"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2015, 3, 1, 12, 0, 0, 500, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := File(src, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dest); err != nil {
+		t.Fatal(err)
+	} else if fi.ModTime().Equal(mtime) {
+		t.Errorf("expected new modification time, actual %s", mtime)
+	}
+
+	opt := &Options{Preserve: PreserveAll}
+	if _, err := File(src, dest, opt); err != nil {
+		t.Fatal(err)
+	}
+	checkModTime(t, dest, mtime)
+	if fi, err := os.Stat(dest); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0640 {
+		t.Errorf("expected %s, actual %s", os.FileMode(0640), fi.Mode())
+	}
+
+	// Rewriting the copy keeps its attributes
+	if err := WriteFile(dest, []byte("new"), 0640, opt); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, "new")
+	checkModTime(t, dest, mtime)
+}
+
+func TestAttributesSymlink(t *testing.T) {
+	td, err := ioutil.TempDir("", "preserve_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	file := filepath.Join(td, "file")
+	src := filepath.Join(td, "src")
+	dest := filepath.Join(td, "dest")
+	if err := ioutil.WriteFile(file, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{src, dest} {
+		if err := os.Symlink("file", link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := lutimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if lfi, err := os.Lstat(src); err != nil {
+		t.Fatal(err)
+	} else if !lfi.ModTime().Equal(mtime) {
+		t.Skip("cannot set the times of symlinks")
+	}
+
+	if err := Attributes(src, dest, PreserveAll); err != nil {
+		t.Fatal(err)
+	}
+	// The target of the links is left alone
+	checkModTime(t, file, fi.ModTime())
+	checkModTime(t, dest, mtime)
+}
@@ -0,0 +1,315 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Mach-O dynamic library resolution
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package dyld resolves the dynamic libraries that Mach-O binaries depend on,
+// following the search rules of the macOS dynamic loader. It only parses
+// files and can be used on any platform.
+package dyld
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+// LoaderExecutable is the dynamic loader, which all executables need.
+const LoaderExecutable = "/usr/lib/dyld"
+
+const (
+	// Load commands not defined in debug/macho
+	LoadCmdReqDyld         macho.LoadCmd = 0x80000000
+	LoadCmdIDDylib         macho.LoadCmd = 0xd
+	LoadCmdLoadWeakDylib   macho.LoadCmd = 0x18 | LoadCmdReqDyld
+	LoadCmdRpath           macho.LoadCmd = 0x1c | LoadCmdReqDyld
+	LoadCmdReExportDylib   macho.LoadCmd = 0x1f | LoadCmdReqDyld
+	LoadCmdLazyLoadDylib   macho.LoadCmd = 0x20
+	LoadCmdLoadUpwardDylib macho.LoadCmd = 0x23 | LoadCmdReqDyld
+
+	// CPU subtype for arm64 with pointer authentication
+	SubCpuArm64e = 2
+
+	subCpuMask = 0x00ffffff // Strips capability bits
+)
+
+// LoadKind describes how a dylib is loaded.
+type LoadKind int
+
+const (
+	LoadRegular  LoadKind = iota // LC_LOAD_DYLIB
+	LoadWeak                     // LC_LOAD_WEAK_DYLIB, may be missing
+	LoadReexport                 // LC_REEXPORT_DYLIB
+	LoadUpward                   // LC_LOAD_UPWARD_DYLIB
+	LoadLazy                     // LC_LAZY_LOAD_DYLIB
+)
+
+var loadKinds = map[macho.LoadCmd]LoadKind{
+	macho.LoadCmdDylib:     LoadRegular,
+	LoadCmdLoadWeakDylib:   LoadWeak,
+	LoadCmdReExportDylib:   LoadReexport,
+	LoadCmdLoadUpwardDylib: LoadUpward,
+	LoadCmdLazyLoadDylib:   LoadLazy,
+}
+
+// Image is a node in the dependency graph of a Mach-O binary. Images that
+// are loaded by several others share the same node.
+type Image struct {
+	Name string   // Path as referenced in the load command
+	Path string   // Resolved path inside the root, empty if not found
+	Kind LoadKind // How the image was loaded by the first image needing it
+	Deps []*Image
+}
+
+// Missing returns whether the image could not be resolved.
+func (i *Image) Missing() bool {
+	return i.Path == ""
+}
+
+// Resolver resolves Mach-O dependencies for a single architecture.
+type Resolver struct {
+	// Root is the directory that all paths are resolved in.
+	Root sysroot.Root
+
+	// Cpu selects the architecture to use from fat binaries. Thin binaries
+	// must match it.
+	Cpu macho.Cpu
+
+	// SubCpu is the preferred CPU subtype to select from fat binaries, like
+	// SubCpuArm64e. If zero or not available, any subtype is used.
+	SubCpu uint32
+}
+
+// isMachO returns whether b starts with the magic of a Mach-O file.
+func isMachO(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(b) {
+	case macho.Magic32, macho.Magic64, macho.MagicFat:
+		return true
+	}
+	switch binary.LittleEndian.Uint32(b) {
+	case macho.Magic32, macho.Magic64:
+		return true
+	}
+	return false
+}
+
+// open opens the Mach-O file at path inside the root and selects the slice
+// for the resolver's architecture from fat files. The returned file must be
+// closed by the caller.
+func (r *Resolver) open(path string) (*macho.File, *os.File, error) {
+	f, err := r.Root.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := make([]byte, 4)
+	if _, err := f.ReadAt(m, 0); err != nil || !isMachO(m) {
+		f.Close()
+		return nil, nil, fmt.Errorf("not a Mach-O file: %s", path)
+	}
+	if binary.BigEndian.Uint32(m) != macho.MagicFat {
+		mf, err := macho.NewFile(f)
+		if err == nil && mf.Cpu != r.Cpu {
+			err = fmt.Errorf("unexpected Mach-O arch %s: %s", mf.Cpu, path)
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return mf, f, nil
+	}
+	fat, err := macho.NewFatFile(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	var found *macho.File
+	for _, a := range fat.Arches {
+		if a.Cpu != r.Cpu {
+			continue
+		}
+		if found == nil || a.SubCpu&subCpuMask == r.SubCpu {
+			found = a.File
+		}
+	}
+	if found == nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("Mach-O arch %s not in file: %s", r.Cpu,
+			path)
+	}
+	return found, f, nil
+}
+
+// loadCommandPath returns the path argument of a raw load command, which is
+// stored at the offset given by the third 32-bit word.
+func loadCommandPath(bo binary.ByteOrder, raw []byte) string {
+	if len(raw) < 12 {
+		return ""
+	}
+	off := bo.Uint32(raw[8:12])
+	if off >= uint32(len(raw)) {
+		return ""
+	}
+	return strings.TrimRight(string(raw[off:]), "\x00")
+}
+
+// loadedImage holds the information needed to resolve the dependencies of
+// an image.
+type loadedImage struct {
+	img    *Image
+	dylibs []*Image // Unresolved dependencies, in load command order
+	rpaths []string // Run path stack, including the loaders' run paths
+	loader *loadedImage
+}
+
+// expand returns the candidate paths for name, as referenced by image l in
+// a binary with the given executable path.
+func expand(name string, l *loadedImage, executable string) []string {
+	switch {
+	case strings.HasPrefix(name, "@executable_path/"):
+		return []string{filepath.Join(filepath.Dir(executable),
+			name[len("@executable_path/"):])}
+	case strings.HasPrefix(name, "@loader_path/"):
+		return []string{filepath.Join(filepath.Dir(l.img.Path),
+			name[len("@loader_path/"):])}
+	case strings.HasPrefix(name, "@rpath/"):
+		var paths []string
+		for _, rp := range l.rpaths {
+			paths = append(paths, filepath.Join(rp, name[len("@rpath/"):]))
+		}
+		return paths
+	}
+	return []string{name}
+}
+
+// read parses the load commands of the image at path.
+func (r *Resolver) read(img *Image, loader *loadedImage,
+	executable string) (*loadedImage, error) {
+	f, file, err := r.open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	l := &loadedImage{img: img, loader: loader}
+	bo := f.ByteOrder
+	for _, load := range f.Loads {
+		raw := load.Raw()
+		if len(raw) < 8 {
+			continue
+		}
+		cmd := macho.LoadCmd(bo.Uint32(raw[0:4]))
+		if kind, ok := loadKinds[cmd]; ok {
+			if name := loadCommandPath(bo, raw); name != "" {
+				l.dylibs = append(l.dylibs, &Image{Name: name, Kind: kind})
+			}
+		} else if cmd == LoadCmdRpath {
+			// Run paths may be relative to the image or executable
+			l.rpaths = append(l.rpaths, expand(loadCommandPath(bo, raw), l,
+				executable)...)
+		}
+	}
+	if loader != nil {
+		l.rpaths = append(l.rpaths, loader.rpaths...)
+	}
+	return l, nil
+}
+
+// Resolve returns the dependency graph of the Mach-O binary in filename. If
+// filename is not a Mach-O file, the returned image has no dependencies.
+func (r *Resolver) Resolve(filename string) (*Image, error) {
+	root := &Image{Name: filename, Path: filename}
+	f, err := r.Root.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := make([]byte, 4)
+	_, err = f.ReadAt(m, 0)
+	f.Close()
+	if err != nil || !isMachO(m) {
+		// File is either too small or not a Mach-O
+		return root, nil
+	}
+
+	mf, file, err := r.open(filename)
+	if err != nil {
+		return nil, err
+	}
+	isExecutable := mf.Type == macho.TypeExec
+	file.Close()
+
+	l, err := r.read(root, nil, filename)
+	if err != nil {
+		return nil, err
+	}
+	nodes := map[string]*Image{filename: root}
+	if isExecutable {
+		// All executables need dyld
+		d := &Image{Name: LoaderExecutable}
+		if _, err := r.Root.Stat(LoaderExecutable); err == nil {
+			d.Path = LoaderExecutable
+		}
+		nodes[LoaderExecutable] = d
+		root.Deps = append(root.Deps, d)
+	}
+
+	for todo := []*loadedImage{l}; len(todo) > 0; todo = todo[1:] {
+		cur := todo[0]
+		for _, dep := range cur.dylibs {
+			var next *loadedImage
+			for _, c := range expand(dep.Name, cur, filename) {
+				c = filepath.Clean(c)
+				if n, ok := nodes[c]; ok {
+					dep = n
+					break
+				}
+				dep.Path = c
+				if next, err = r.read(dep, cur, filename); err == nil {
+					break
+				}
+				dep.Path = ""
+			}
+			if dep.Missing() {
+				if n, ok := nodes[dep.Name]; ok {
+					dep = n
+				} else {
+					nodes[dep.Name] = dep
+				}
+			} else if next != nil {
+				nodes[dep.Path] = dep
+				todo = append(todo, next)
+			}
+			cur.img.Deps = append(cur.img.Deps, dep)
+		}
+	}
+	return root, nil
+}
@@ -0,0 +1,183 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Mach-O dynamic library resolution tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package dyld
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+// cmdWithPath returns a load command that stores path after a fixed-size
+// part of size bytes. Fields after the path offset are left zero.
+func cmdWithPath(cmd macho.LoadCmd, size int, path string) []byte {
+	n := (size + len(path) + 1 + 7) &^ 7 // NUL-terminated, 8-byte aligned
+	b := make([]byte, n)
+	binary.LittleEndian.PutUint32(b[0:], uint32(cmd))
+	binary.LittleEndian.PutUint32(b[4:], uint32(n))
+	binary.LittleEndian.PutUint32(b[8:], uint32(size))
+	copy(b[size:], path)
+	return b
+}
+
+func dylibCmd(cmd macho.LoadCmd, name string) []byte {
+	return cmdWithPath(cmd, 24 /* sizeof(struct dylib_command) */, name)
+}
+
+func rpathCmd(path string) []byte {
+	return cmdWithPath(LoadCmdRpath, 12, /* sizeof(struct rpath_command) */
+		path)
+}
+
+// thin returns a minimal 64-bit Mach-O file with the given load commands.
+func thin(cpu macho.Cpu, subCpu uint32, typ macho.Type,
+	cmds ...[]byte) []byte {
+	var b bytes.Buffer
+	all := bytes.Join(cmds, nil)
+	for _, v := range []uint32{macho.Magic64, uint32(cpu), subCpu,
+		uint32(typ), uint32(len(cmds)), uint32(len(all)), 0, 0} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.Write(all)
+	return b.Bytes()
+}
+
+// fat returns a fat Mach-O file containing the given thin files.
+func fat(files ...[]byte) []byte {
+	var hdr, data bytes.Buffer
+	binary.Write(&hdr, binary.BigEndian, []uint32{macho.MagicFat,
+		uint32(len(files))})
+	base := (8 + 20*len(files) + 7) &^ 7
+	for _, f := range files {
+		binary.Write(&hdr, binary.BigEndian, []uint32{
+			binary.LittleEndian.Uint32(f[4:]), // CPU
+			binary.LittleEndian.Uint32(f[8:]), // Sub-CPU
+			uint32(base + data.Len()), uint32(len(f)), 3})
+		data.Write(f)
+		data.Write(make([]byte, (len(f)+7)&^7-len(f)))
+	}
+	hdr.Write(make([]byte, base-hdr.Len()))
+	return append(hdr.Bytes(), data.Bytes()...)
+}
+
+func TestResolve(t *testing.T) {
+	td, err := ioutil.TempDir("", "dyld_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	const (
+		app  = "/Applications/Test.app/Contents/MacOS/test"
+		libs = "/Applications/Test.app/Contents/Frameworks"
+	)
+	arm64 := macho.CpuArm64
+	files := map[string][]byte{
+		app: thin(arm64, 0, macho.TypeExec,
+			rpathCmd("@executable_path/../Frameworks"),
+			dylibCmd(macho.LoadCmdDylib, "@rpath/libfoo.dylib"),
+			dylibCmd(macho.LoadCmdDylib, "/usr/lib/libSystem.B.dylib"),
+			dylibCmd(LoadCmdLoadWeakDylib, "/usr/lib/libweak.dylib"),
+			dylibCmd(macho.LoadCmdDylib, "/usr/lib/libamd64.dylib")),
+		// Fat library, the arm64e slice has additional dependencies
+		libs + "/libfoo.dylib": fat(
+			thin(macho.CpuAmd64, 3, macho.TypeDylib),
+			thin(arm64, 0, macho.TypeDylib),
+			thin(arm64, SubCpuArm64e, macho.TypeDylib,
+				dylibCmd(macho.LoadCmdDylib, "@loader_path/libbar.dylib"))),
+		libs + "/libbar.dylib": thin(arm64, 0, macho.TypeDylib,
+			dylibCmd(LoadCmdLoadUpwardDylib, "@rpath/libfoo.dylib"),
+			dylibCmd(LoadCmdReExportDylib,
+				"@executable_path/../Frameworks/libbaz.dylib")),
+		libs + "/libbaz.dylib":       thin(arm64, 0, macho.TypeDylib),
+		"/usr/lib/libSystem.B.dylib": thin(arm64, 0, macho.TypeDylib),
+		"/usr/lib/libamd64.dylib":    thin(macho.CpuAmd64, 3, macho.TypeDylib),
+		LoaderExecutable:             thin(arm64, 0, macho.TypeExec),
+	}
+	for name, b := range files {
+		p := filepath.Join(td, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &Resolver{Root: sysroot.Root(td), Cpu: arm64, SubCpu: SubCpuArm64e}
+	root, err := r.Resolve(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		path string
+		kind LoadKind
+	}
+	actual := make(map[string]result)
+	visited := make(map[*Image]bool)
+	var walk func(i *Image)
+	walk = func(i *Image) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		actual[i.Name] = result{i.Path, i.Kind}
+		for _, d := range i.Deps {
+			walk(d)
+		}
+	}
+	walk(root)
+
+	for name, expected := range map[string]result{
+		app:                          {app, LoadRegular},
+		LoaderExecutable:             {LoaderExecutable, LoadRegular},
+		"@rpath/libfoo.dylib":        {libs + "/libfoo.dylib", LoadRegular},
+		"@loader_path/libbar.dylib":  {libs + "/libbar.dylib", LoadRegular},
+		"/usr/lib/libSystem.B.dylib": {"/usr/lib/libSystem.B.dylib", 0},
+		"/usr/lib/libweak.dylib":     {"", LoadWeak},
+		"/usr/lib/libamd64.dylib":    {"", LoadRegular}, // Wrong arch
+		"@executable_path/../Frameworks/libbaz.dylib": {
+			libs + "/libbaz.dylib", LoadReexport},
+	} {
+		if a, ok := actual[name]; !ok {
+			t.Errorf("expected %s in graph", name)
+		} else if a != expected {
+			t.Errorf("%s: expected %v, actual %v", name, expected, a)
+		}
+	}
+	if len(actual) != 8 {
+		t.Errorf("expected %d images, actual %d", 8, len(actual))
+	}
+}
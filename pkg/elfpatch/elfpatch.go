@@ -0,0 +1,450 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * ELF interpreter and run path rewriting
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package elfpatch rewrites the dynamic linking information of ELF files,
+// similar to the patchelf utility. It can change the interpreter (PT_INTERP)
+// and the library run path (DT_RUNPATH) of executables and shared libraries.
+// It can also strip debug information and symbol tables, like strip(1).
+//
+// Values that fit are changed in place. Otherwise, the new values are
+// appended to the file in a new loadable segment, which takes the place of a
+// PT_NOTE program header. The dynamic string table and, if needed, the
+// dynamic section are moved into that segment as well.
+package elfpatch
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	filecopy "blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// Patch describes the changes to make to an ELF file.
+type Patch struct {
+	// Interp is the new interpreter. If empty, the interpreter is unchanged.
+	Interp string
+
+	// RunPath lists the new library search directories. It replaces any
+	// existing DT_RUNPATH or DT_RPATH. If nil, the run path is unchanged.
+	RunPath []string
+}
+
+// Errors returned by Rewrite
+var (
+	ErrNoInterp  = errors.New("ELF file has no interpreter")
+	ErrNoDynamic = errors.New("ELF file is not dynamically linked")
+	ErrNoRoom    = errors.New("no program header available for new segment")
+
+	errInvalidStrtab = errors.New("invalid dynamic string table")
+)
+
+// layout holds the field offsets of the ELF structures for one class.
+type layout struct {
+	word int // Size of addresses and offsets
+
+	// File header
+	phoff, shoff, phentsize, shentsize, shnum, shstrndx int
+
+	// Program headers
+	pFlags, pOffset, pVaddr, pPaddr, pFilesz, pMemsz, pAlign int
+
+	// Section headers
+	shAddr, shOffset, shSize, shLink, shInfo, shAlign int
+
+	// Symbols
+	stShndx, symSize int
+}
+
+var (
+	layout32 = layout{word: 4,
+		phoff: 28, shoff: 32, phentsize: 42, shentsize: 46,
+		shnum: 48, shstrndx: 50,
+		pOffset: 4, pVaddr: 8, pPaddr: 12, pFilesz: 16, pMemsz: 20,
+		pFlags: 24, pAlign: 28,
+		shAddr: 12, shOffset: 16, shSize: 20, shLink: 24, shInfo: 28,
+		shAlign: 32,
+		stShndx: 14, symSize: 16,
+	}
+	layout64 = layout{word: 8,
+		phoff: 32, shoff: 40, phentsize: 54, shentsize: 58,
+		shnum: 60, shstrndx: 62,
+		pFlags: 4, pOffset: 8, pVaddr: 16, pPaddr: 24, pFilesz: 32,
+		pMemsz: 40, pAlign: 48,
+		shAddr: 16, shOffset: 24, shSize: 32, shLink: 40, shInfo: 44,
+		shAlign: 48,
+		stShndx: 6, symSize: 24,
+	}
+)
+
+// editor provides access to the raw fields of an ELF file.
+type editor struct {
+	b  []byte
+	bo binary.ByteOrder
+	layout
+}
+
+func (e *editor) half(off int) int {
+	return int(e.bo.Uint16(e.b[off:]))
+}
+
+func (e *editor) addr(off int) uint64 {
+	if e.word == 4 {
+		return uint64(e.bo.Uint32(e.b[off:]))
+	}
+	return e.bo.Uint64(e.b[off:])
+}
+
+func (e *editor) putAddr(off int, v uint64) {
+	if e.word == 4 {
+		e.bo.PutUint32(e.b[off:], uint32(v))
+	} else {
+		e.bo.PutUint64(e.b[off:], v)
+	}
+}
+
+// prog returns the file offset of program header i.
+func (e *editor) prog(i int) int {
+	return int(e.addr(e.phoff)) + i*e.half(e.phentsize)
+}
+
+// section returns the file offset of section header i.
+func (e *editor) section(i int) int {
+	return int(e.addr(e.shoff)) + i*e.half(e.shentsize)
+}
+
+// moveProg changes the location of the segment of program header i.
+func (e *editor) moveProg(i int, off, vaddr, size uint64) {
+	p := e.prog(i)
+	e.putAddr(p+e.pOffset, off)
+	e.putAddr(p+e.pVaddr, vaddr)
+	e.putAddr(p+e.pPaddr, vaddr)
+	e.putAddr(p+e.pFilesz, size)
+	e.putAddr(p+e.pMemsz, size)
+}
+
+// moveSection changes the location of section i.
+func (e *editor) moveSection(i int, off, addr, size uint64) {
+	s := e.section(i)
+	e.putAddr(s+e.shOffset, off)
+	e.putAddr(s+e.shAddr, addr)
+	e.putAddr(s+e.shSize, size)
+}
+
+// dyn is a single entry of the dynamic section.
+type dyn struct {
+	tag elf.DynTag
+	val uint64
+}
+
+// readDynamic returns the entries of the dynamic section at off, up to and
+// including the first DT_NULL.
+func (e *editor) readDynamic(off, size uint64) (dyns []dyn) {
+	entSize := uint64(2 * e.word)
+	for p := off; p+entSize <= off+size; p += entSize {
+		d := dyn{elf.DynTag(e.addr(int(p))), e.addr(int(p) + e.word)}
+		dyns = append(dyns, d)
+		if d.tag == elf.DT_NULL {
+			break
+		}
+	}
+	return
+}
+
+// writeDynamic writes dynamic section entries to the file at off.
+func (e *editor) writeDynamic(off uint64, dyns []dyn) {
+	for i, d := range dyns {
+		p := int(off) + i*2*e.word
+		e.putAddr(p, uint64(d.tag))
+		e.putAddr(p+e.word, d.val)
+	}
+}
+
+func alignUp(v, align uint64) uint64 {
+	return (v + align - 1) &^ (align - 1)
+}
+
+// Rewrite returns a copy of the ELF file in b with the changes from p
+// applied.
+func Rewrite(b []byte, p Patch) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	e := &editor{b: append([]byte(nil), b...), bo: f.ByteOrder,
+		layout: layout32}
+	if f.Class == elf.ELFCLASS64 {
+		e.layout = layout64
+	}
+
+	interpIdx, dynIdx, lastLoad := -1, -1, -1
+	var loadEnd, align, propOff uint64 = 0, 0x1000, 0
+	var notes []int
+	for i, prog := range f.Progs {
+		switch prog.Type {
+		case elf.PT_INTERP:
+			interpIdx = i
+		case elf.PT_DYNAMIC:
+			dynIdx = i
+		case elf.PT_LOAD:
+			lastLoad = i
+			if end := prog.Vaddr + prog.Memsz; end > loadEnd {
+				loadEnd = end
+			}
+			if prog.Align > align {
+				align = prog.Align
+			}
+		case elf.PT_NOTE:
+			notes = append(notes, i)
+		case elf.PT_GNU_PROPERTY:
+			propOff = prog.Off
+		}
+	}
+	if p.Interp != "" && interpIdx < 0 {
+		return nil, ErrNoInterp
+	}
+	if p.RunPath != nil && dynIdx < 0 {
+		return nil, ErrNoDynamic
+	}
+
+	// offset converts a virtual address to a file offset.
+	offset := func(vaddr uint64) (uint64, bool) {
+		for _, prog := range f.Progs {
+			if prog.Type == elf.PT_LOAD && vaddr >= prog.Vaddr &&
+				vaddr < prog.Vaddr+prog.Filesz {
+				return prog.Off + vaddr - prog.Vaddr, true
+			}
+		}
+		return 0, false
+	}
+	// sectionAt returns the index of the section at the given file offset.
+	sectionAt := func(typ elf.SectionType, off uint64) int {
+		for i, s := range f.Sections {
+			if s.Type == typ && s.Offset == off {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// Contents of the new segment. Fixups update the headers once its
+	// location is known.
+	var seg bytes.Buffer
+	var fixups []func(off, vaddr uint64)
+
+	if p.Interp != "" {
+		prog := f.Progs[interpIdx]
+		if uint64(len(p.Interp)) < prog.Filesz {
+			// Fits in place, the rest is padded with NULs
+			copy(e.b[prog.Off:prog.Off+prog.Filesz],
+				append([]byte(p.Interp), make([]byte, prog.Filesz)...))
+		} else {
+			start := uint64(seg.Len())
+			seg.WriteString(p.Interp)
+			seg.WriteByte(0)
+			size := uint64(seg.Len()) - start
+			shIdx := sectionAt(elf.SHT_PROGBITS, prog.Off)
+			fixups = append(fixups, func(off, vaddr uint64) {
+				e.moveProg(interpIdx, off+start, vaddr+start, size)
+				if shIdx > 0 {
+					e.moveSection(shIdx, off+start, vaddr+start, size)
+				}
+			})
+		}
+	}
+
+	if p.RunPath != nil {
+		prog := f.Progs[dynIdx]
+		var strtab, strsz uint64
+		// Keep a single run path entry, DT_RPATH is ignored if there is a
+		// DT_RUNPATH anyway
+		var dyns []dyn
+		pathIdx, nullIdx := -1, -1
+		for _, d := range e.readDynamic(prog.Off, prog.Filesz) {
+			switch d.tag {
+			case elf.DT_STRTAB:
+				strtab = d.val
+			case elf.DT_STRSZ:
+				strsz = d.val
+			case elf.DT_RPATH, elf.DT_RUNPATH:
+				if pathIdx >= 0 {
+					continue
+				}
+				pathIdx = len(dyns)
+			case elf.DT_NULL:
+				nullIdx = len(dyns)
+			}
+			dyns = append(dyns, d)
+		}
+		strOff, ok := offset(strtab)
+		if !ok || nullIdx < 0 || strOff+strsz > uint64(len(b)) {
+			return nil, errInvalidStrtab
+		}
+
+		// The string table is copied, so that existing offsets stay valid
+		strStart := uint64(seg.Len())
+		seg.Write(b[strOff : strOff+strsz])
+		pathOff := uint64(seg.Len()) - strStart
+		seg.WriteString(strings.Join(p.RunPath, ":"))
+		seg.WriteByte(0)
+		newStrsz := uint64(seg.Len()) - strStart
+		if pathIdx >= 0 {
+			dyns[pathIdx] = dyn{elf.DT_RUNPATH, pathOff}
+		} else {
+			dyns = append(dyns[:nullIdx], append([]dyn{{elf.DT_RUNPATH,
+				pathOff}}, dyns[nullIdx:]...)...)
+		}
+		for i := range dyns {
+			if dyns[i].tag == elf.DT_STRSZ {
+				dyns[i].val = newStrsz
+			}
+		}
+
+		// The dynamic section is moved if it has no room for a new entry
+		dynOff := prog.Off
+		var dynStart uint64
+		moveDynamic := uint64(len(dyns)*2*e.word) > prog.Filesz
+		if moveDynamic {
+			dynStart = alignUp(uint64(seg.Len()), uint64(e.word))
+			seg.Write(make([]byte, dynStart-uint64(seg.Len())+
+				uint64(len(dyns)*2*e.word)))
+		}
+		strShIdx := sectionAt(elf.SHT_STRTAB, strOff)
+		dynShIdx := sectionAt(elf.SHT_DYNAMIC, prog.Off)
+		fixups = append(fixups, func(off, vaddr uint64) {
+			for i := range dyns {
+				if dyns[i].tag == elf.DT_STRTAB {
+					dyns[i].val = vaddr + strStart
+				}
+			}
+			if moveDynamic {
+				dynOff = off + dynStart
+				size := uint64(len(dyns) * 2 * e.word)
+				e.moveProg(dynIdx, dynOff, vaddr+dynStart, size)
+				if dynShIdx > 0 {
+					e.moveSection(dynShIdx, dynOff, vaddr+dynStart, size)
+				}
+			}
+			e.writeDynamic(dynOff, dyns)
+			if strShIdx > 0 {
+				e.moveSection(strShIdx, off+strStart, vaddr+strStart,
+					newStrsz)
+			}
+		})
+	}
+
+	if seg.Len() == 0 {
+		return e.b, nil
+	}
+
+	off := alignUp(uint64(len(e.b)), 16)
+	e.b = append(e.b, make([]byte, off-uint64(len(e.b)))...)
+	e.b = append(e.b, seg.Bytes()...)
+
+	// A writable segment at the end of the file, like one added by an
+	// earlier rewrite, is extended instead of adding another one
+	if last := f.Progs[lastLoad]; last.Off+last.Filesz == uint64(len(b)) &&
+		last.Filesz == last.Memsz && last.Flags&elf.PF_W != 0 {
+		vaddr := last.Vaddr + off - last.Off
+		size := off - last.Off + uint64(seg.Len())
+		e.putAddr(e.prog(lastLoad)+e.pFilesz, size)
+		e.putAddr(e.prog(lastLoad)+e.pMemsz, size)
+		for _, fix := range fixups {
+			fix(off, vaddr)
+		}
+		return e.b, nil
+	}
+
+	// Reuse a PT_NOTE for the new segment. Prefer the one that duplicates
+	// PT_GNU_PROPERTY, so that no information is lost.
+	if len(notes) == 0 {
+		return nil, ErrNoRoom
+	}
+	note := notes[len(notes)-1]
+	for _, i := range notes {
+		if propOff != 0 && f.Progs[i].Off == propOff {
+			note = i
+		}
+	}
+	vaddr := alignUp(loadEnd, align) + off%align
+
+	// Loadable segments must be sorted by address, so the new one is moved
+	// right after the last one
+	if note < lastLoad {
+		entSize := e.half(e.phentsize)
+		saved := append([]byte(nil), e.b[e.prog(note):e.prog(note)+entSize]...)
+		copy(e.b[e.prog(note):], e.b[e.prog(note+1):e.prog(lastLoad+1)])
+		copy(e.b[e.prog(lastLoad):], saved)
+		if interpIdx > note && interpIdx <= lastLoad {
+			interpIdx--
+		}
+		if dynIdx > note && dynIdx <= lastLoad {
+			dynIdx--
+		}
+		note = lastLoad
+	}
+	ph := e.prog(note)
+	e.bo.PutUint32(e.b[ph:], uint32(elf.PT_LOAD))
+	e.bo.PutUint32(e.b[ph+e.pFlags:], uint32(elf.PF_R|elf.PF_W))
+	e.moveProg(note, off, vaddr, uint64(seg.Len()))
+	e.putAddr(ph+e.pAlign, align)
+	for _, fix := range fixups {
+		fix(off, vaddr)
+	}
+	return e.b, nil
+}
+
+// Apply rewrites the ELF file filename. The rewritten file replaces the
+// original, so that other hard links to it are left unchanged. Permissions
+// are kept. Opt controls how the file is replaced, see copy.WriteFile. It
+// may be nil.
+func Apply(filename string, p Patch, opt *filecopy.Options) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	out, err := Rewrite(b, p)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	return replaceFile(filename, out, opt)
+}
+
+// replaceFile atomically replaces the contents of filename with b, keeping
+// its permissions.
+func replaceFile(filename string, b []byte, opt *filecopy.Options) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	return filecopy.WriteFile(filename, b, fi.Mode(), opt)
+}
@@ -0,0 +1,249 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * ELF interpreter and run path rewriting tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package elfpatch
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Fixture shared with the loader package
+const testBinary = "../loader/testdata/nc.openbsd"
+
+// progIndex returns the index of the first program header of type typ.
+func progIndex(f *elf.File, typ elf.ProgType) int {
+	for i, p := range f.Progs {
+		if p.Type == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkELF parses b and verifies the interpreter, run path and that the
+// rest of the dynamic linking information is unchanged from orig.
+func checkELF(t *testing.T, orig *elf.File, b []byte, interp,
+	runPath string) {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := progIndex(f, elf.PT_INTERP); i < 0 {
+		t.Errorf("expected PT_INTERP")
+	} else {
+		data := make([]byte, f.Progs[i].Filesz)
+		f.Progs[i].ReadAt(data, 0)
+		if actual := strings.TrimRight(string(data), "\x00"); actual != interp {
+			t.Errorf("expected %s, actual %s", interp, actual)
+		}
+	}
+	if actual, _ := f.DynString(elf.DT_RUNPATH); runPath != "" &&
+		(len(actual) != 1 || actual[0] != runPath) {
+		t.Errorf("expected [%s], actual %v", runPath, actual)
+	}
+	if actual, _ := f.DynString(elf.DT_RPATH); len(actual) != 0 {
+		t.Errorf("expected no DT_RPATH, actual %v", actual)
+	}
+	expectedLibs, _ := orig.ImportedLibraries()
+	if actual, _ := f.ImportedLibraries(); !reflect.DeepEqual(actual,
+		expectedLibs) {
+		t.Errorf("expected %v, actual %v", expectedLibs, actual)
+	}
+	expectedSyms, _ := orig.DynamicSymbols()
+	if actual, _ := f.DynamicSymbols(); !reflect.DeepEqual(actual,
+		expectedSyms) {
+		t.Errorf("dynamic symbols changed")
+	}
+	var last uint64
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		if p.Vaddr < last {
+			t.Errorf("PT_LOAD at %#x not sorted by address", p.Vaddr)
+		}
+		if p.Off%p.Align != p.Vaddr%p.Align {
+			t.Errorf("PT_LOAD at %#x misaligned", p.Vaddr)
+		}
+		last = p.Vaddr
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	b, err := ioutil.ReadFile(testBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shorter interpreter is changed in place
+	out, err := Rewrite(b, Patch{Interp: "/lib/ld.so"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(b) {
+		t.Errorf("expected size %d, actual %d", len(b), len(out))
+	}
+	checkELF(t, orig, out, "/lib/ld.so", "")
+
+	const (
+		interp  = "/srv/jail/lib64/ld-linux-x86-64.so.2"
+		runPath = "/srv/jail/lib:/srv/jail/usr/lib"
+	)
+	patch := Patch{Interp: interp, RunPath: strings.Split(runPath, ":")}
+	out, err = Rewrite(b, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkELF(t, orig, out, interp, runPath)
+
+	// Rewriting again replaces the existing run path
+	if out, err = Rewrite(out, Patch{RunPath: []string{"/lib"}}); err != nil {
+		t.Fatal(err)
+	}
+	checkELF(t, orig, out, interp, "/lib")
+}
+
+func TestRewriteMoveDynamic(t *testing.T) {
+	b, err := ioutil.ReadFile(testBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave no room for additional dynamic entries and move the PT_NOTE
+	// before the loadable segments, like some linkers do
+	dynIdx := progIndex(orig, elf.PT_DYNAMIC)
+	noteIdx := progIndex(orig, elf.PT_NOTE)
+	loadIdx := progIndex(orig, elf.PT_LOAD)
+	if dynIdx < 0 || noteIdx < loadIdx {
+		t.Fatalf("unexpected program headers in %s", testBinary)
+	}
+	var n int
+	for _, d := range dynEntries(t, orig) {
+		n++
+		if d == elf.DT_NULL {
+			break
+		}
+	}
+	le := binary.LittleEndian
+	const phoff, phentsize = 64, 56
+	le.PutUint64(b[phoff+dynIdx*phentsize+32:], uint64(n*16))
+	note := append([]byte(nil), b[phoff+noteIdx*phentsize:][:phentsize]...)
+	copy(b[phoff+(loadIdx+1)*phentsize:],
+		b[phoff+loadIdx*phentsize:phoff+noteIdx*phentsize])
+	copy(b[phoff+loadIdx*phentsize:], note)
+
+	out, err := Rewrite(b, Patch{RunPath: []string{"/opt/lib"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkELF(t, orig, out, "/lib64/ld-linux-x86-64.so.2", "/opt/lib")
+	f, _ := elf.NewFile(bytes.NewReader(out))
+	if i := progIndex(f, elf.PT_DYNAMIC); f.Progs[i].Off ==
+		orig.Progs[dynIdx].Off {
+		t.Errorf("expected dynamic section to move")
+	}
+}
+
+// dynEntries returns the tags of the dynamic section of f.
+func dynEntries(t *testing.T, f *elf.File) (tags []elf.DynTag) {
+	data, err := f.SectionByType(elf.SHT_DYNAMIC).Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+16 <= len(data); i += 16 {
+		tags = append(tags, elf.DynTag(binary.LittleEndian.Uint64(data[i:])))
+	}
+	return
+}
+
+func TestRewriteErrors(t *testing.T) {
+	b, err := ioutil.ReadFile(testBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rewrite(b[:100], Patch{}); err == nil {
+		t.Errorf("expected error for truncated file")
+	}
+	// Remove all PT_NOTE headers
+	f, _ := elf.NewFile(bytes.NewReader(b))
+	for i, p := range f.Progs {
+		if p.Type == elf.PT_NOTE {
+			binary.LittleEndian.PutUint32(b[64+i*56:], uint32(elf.PT_NULL))
+		}
+	}
+	_, err = Rewrite(b, Patch{RunPath: []string{"/lib"}})
+	if err != ErrNoRoom {
+		t.Errorf("expected %s, actual %v", ErrNoRoom, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	td, err := ioutil.TempDir("", "elfpatch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	b, err := ioutil.ReadFile(testBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := filepath.Join(td, "orig")
+	linked := filepath.Join(td, "linked")
+	if err := ioutil.WriteFile(orig, b, 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(orig, linked); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Apply(linked, Patch{RunPath: []string{"/lib"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := ioutil.ReadFile(orig); !bytes.Equal(actual, b) {
+		t.Errorf("expected hard linked file to be unchanged")
+	}
+	if fi, err := os.Stat(linked); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0555 {
+		t.Errorf("expected mode %s, actual %s", os.FileMode(0555), fi.Mode())
+	}
+}
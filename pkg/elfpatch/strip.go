@@ -0,0 +1,224 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Removal of debug information from ELF files
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package elfpatch
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	filecopy "blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// strippable returns whether s is not needed at run time and removed by
+// Strip. Sections that are loaded into memory are always kept.
+func strippable(s *elf.Section, symbols bool) bool {
+	if s.Flags&elf.SHF_ALLOC != 0 {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(s.Name, ".debug_"),
+		strings.HasPrefix(s.Name, ".zdebug_"),
+		strings.HasPrefix(s.Name, ".gnu.build.attributes"),
+		s.Type == elf.SHT_NOTE:
+		return true
+	case s.Type == elf.SHT_SYMTAB:
+		return symbols
+	}
+	return false
+}
+
+// Strip returns a copy of the ELF file in b without debug sections and
+// build notes that are not loaded at run time. If symbols is set, the
+// symbol table and its string table are removed as well. Only executables
+// and shared objects are stripped, other files are returned unchanged.
+func Strip(b []byte, symbols bool) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	e := &editor{b: b, bo: f.ByteOrder, layout: layout32}
+	if f.Class == elf.ELFCLASS64 {
+		e.layout = layout64
+	}
+	// Extended section numbering is only used by huge object files
+	if (f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN) ||
+		e.half(e.shnum) == 0 {
+		return b, nil
+	}
+
+	n := len(f.Sections)
+	remove := make([]bool, n)
+	for i, s := range f.Sections {
+		remove[i] = i > 0 && strippable(s, symbols)
+	}
+	// Drop sections that only describe removed ones, like the string table
+	// of the symbol table or relocations of debug sections.
+	shstrndx := e.half(e.shstrndx)
+	wasLinked := make([]bool, n)
+	for _, s := range f.Sections {
+		if int(s.Link) < n {
+			wasLinked[s.Link] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		linked := make([]bool, n)
+		for i, s := range f.Sections {
+			if !remove[i] && int(s.Link) < n {
+				linked[s.Link] = true
+			}
+		}
+		for i, s := range f.Sections {
+			if remove[i] || i == 0 || s.Flags&elf.SHF_ALLOC != 0 {
+				continue
+			}
+			orphan := int(s.Link) < n && remove[s.Link]
+			switch s.Type {
+			case elf.SHT_STRTAB:
+				orphan = orphan || (wasLinked[i] && !linked[i] &&
+					i != shstrndx)
+			case elf.SHT_REL, elf.SHT_RELA:
+				orphan = orphan || (int(s.Info) < n && remove[s.Info])
+			}
+			if orphan {
+				remove[i] = true
+				changed = true
+			}
+		}
+	}
+	newIdx := make([]int, n)
+	var kept []int
+	for i := range f.Sections {
+		if !remove[i] {
+			newIdx[i] = len(kept)
+			kept = append(kept, i)
+		}
+	}
+	if len(kept) == n {
+		return b, nil
+	}
+
+	// Everything up to the end of the last segment stays in place, the
+	// remaining sections are packed after it.
+	end := uint64(e.addr(e.phoff)) +
+		uint64(len(f.Progs)*e.half(e.phentsize))
+	for _, prog := range f.Progs {
+		if pe := prog.Off + prog.Filesz; pe > end {
+			end = pe
+		}
+	}
+	out := &editor{b: append([]byte(nil), b[:end]...), bo: e.bo,
+		layout: e.layout}
+	offsets := make(map[int]uint64)
+	var moved []int
+	for _, i := range kept {
+		if s := f.Sections[i]; s.Offset < end || i == 0 {
+			offsets[i] = s.Offset
+		} else {
+			moved = append(moved, i)
+		}
+	}
+	sort.Slice(moved, func(a, b int) bool {
+		return f.Sections[moved[a]].Offset < f.Sections[moved[b]].Offset
+	})
+	for _, i := range moved {
+		s := f.Sections[i]
+		off := uint64(len(out.b))
+		if s.Addralign > 1 {
+			off = alignUp(off, s.Addralign)
+		}
+		out.b = append(out.b, make([]byte, off-uint64(len(out.b)))...)
+		offsets[i] = off
+		if s.Type != elf.SHT_NOBITS {
+			out.b = append(out.b, b[s.Offset:s.Offset+s.FileSize]...)
+		}
+	}
+
+	// Section header table, with links to other sections renumbered
+	shoff := alignUp(uint64(len(out.b)), uint64(e.word))
+	shentsize := e.half(e.shentsize)
+	out.b = append(out.b, make([]byte, int(shoff)-len(out.b)+
+		len(kept)*shentsize)...)
+	for j, i := range kept {
+		s := f.Sections[i]
+		dst := int(shoff) + j*shentsize
+		copy(out.b[dst:dst+shentsize], b[e.section(i):])
+		out.putAddr(dst+e.shOffset, offsets[i])
+		if int(s.Link) < n {
+			e.bo.PutUint32(out.b[dst+e.shLink:], uint32(newIdx[s.Link]))
+		}
+		if (s.Type == elf.SHT_REL || s.Type == elf.SHT_RELA ||
+			s.Flags&elf.SHF_INFO_LINK != 0) && int(s.Info) < n {
+			e.bo.PutUint32(out.b[dst+e.shInfo:], uint32(newIdx[s.Info]))
+		}
+	}
+	out.putAddr(e.shoff, shoff)
+	e.bo.PutUint16(out.b[e.shnum:], uint16(len(kept)))
+	e.bo.PutUint16(out.b[e.shstrndx:], uint16(newIdx[shstrndx]))
+
+	// Symbols refer to sections by index as well
+	for _, i := range kept {
+		s := f.Sections[i]
+		if s.Type != elf.SHT_SYMTAB && s.Type != elf.SHT_DYNSYM {
+			continue
+		}
+		off := int(offsets[i])
+		for p := off; p+e.symSize <= off+int(s.FileSize); p += e.symSize {
+			shndx := int(e.bo.Uint16(out.b[p+e.stShndx:]))
+			if shndx == 0 || shndx >= int(elf.SHN_LORESERVE) ||
+				shndx >= n {
+				continue
+			}
+			v := uint16(newIdx[shndx])
+			if remove[shndx] {
+				v = uint16(elf.SHN_ABS)
+			}
+			e.bo.PutUint16(out.b[p+e.stShndx:], v)
+		}
+	}
+	return out.b, nil
+}
+
+// StripFile strips the ELF file filename, see Strip. Like Apply, it replaces
+// the file instead of modifying it, opt may be nil. Files that are not ELF
+// are left alone. Returns the number of bytes saved.
+func StripFile(filename string, symbols bool,
+	opt *filecopy.Options) (saved int64, err error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil || !bytes.HasPrefix(b, []byte(elf.ELFMAG)) {
+		return 0, err
+	}
+	out, err := Strip(b, symbols)
+	if err != nil || len(out) == len(b) {
+		return 0, err
+	}
+	return int64(len(b) - len(out)), replaceFile(filename, out, opt)
+}
@@ -0,0 +1,137 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Removal of debug information from ELF files
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package elfpatch
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sectionNames returns the names of all sections of the ELF file in b.
+func sectionNames(t *testing.T, b []byte) map[string]bool {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, s := range f.Sections {
+		names[s.Name] = true
+	}
+	return names
+}
+
+func TestStripUnchanged(t *testing.T) {
+	b, err := ioutil.ReadFile(testBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Already stripped, only the debug link is left
+	out, err := Strip(b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, b) {
+		t.Errorf("expected unchanged file")
+	}
+	if _, err := Strip([]byte("#!/bin/sh\n"), false); err == nil {
+		t.Errorf("expected error for non-ELF file")
+	}
+}
+
+func TestStripFile(t *testing.T) {
+	// Binaries built by the Go toolchain have DWARF and a symbol table
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	td, err := ioutil.TempDir("", "strip_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	src := filepath.Join(td, "hello.go")
+	if err := ioutil.WriteFile(src, []byte("package main\n\n"+
+		"func main() { println(\"hello\") }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(td, "hello")
+	cmd := exec.Command(goTool, "build", "-o", exe, src)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GO111MODULE=off")
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, msg)
+	}
+	b, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sectionNames(t, b)[".debug_info"] {
+		t.Skip("binary has no debug information")
+	}
+
+	for _, symbols := range []bool{false, true} {
+		name := filepath.Join(td, "hello-debug")
+		if symbols {
+			name = filepath.Join(td, "hello-all")
+		}
+		if err := ioutil.WriteFile(name, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := StripFile(name, symbols, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := int64(len(b) - len(out)); saved <= 0 ||
+			saved != actual {
+			t.Errorf("expected %d bytes saved, actual %d", actual, saved)
+		}
+		names := sectionNames(t, out)
+		for n := range names {
+			if strings.HasPrefix(n, ".debug_") {
+				t.Errorf("%s: expected no %s", name, n)
+			}
+		}
+		if names[".symtab"] == symbols {
+			t.Errorf("%s: expected .symtab only if symbols are kept", name)
+		}
+		// The stripped copy must still run
+		if msg, err := exec.Command(name).CombinedOutput(); err != nil ||
+			string(msg) != "hello\n" {
+			t.Errorf("%s: %v: %s", name, err, msg)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Architecture names and multiarch directories
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"debug/elf"
+	"strings"
+)
+
+// Arch identifies the architecture of an ELF binary. Binaries can only load
+// libraries of the same architecture.
+type Arch struct {
+	Class   elf.Class
+	Machine elf.Machine
+}
+
+// String returns a short name for the architecture, like "x86_64" or "i386",
+// following the names used by uname(1) where possible.
+func (a Arch) String() string {
+	switch a.Machine {
+	case elf.EM_386:
+		return "i386"
+	case elf.EM_X86_64:
+		if a.Class == elf.ELFCLASS32 {
+			return "x32"
+		}
+		return "x86_64"
+	case elf.EM_ARM:
+		return "arm"
+	case elf.EM_AARCH64:
+		return "aarch64"
+	case elf.EM_S390:
+		if a.Class == elf.ELFCLASS64 {
+			return "s390x"
+		}
+	}
+	name := strings.ToLower(strings.TrimPrefix(a.Machine.String(), "EM_"))
+	if a.Class == elf.ELFCLASS64 && !strings.HasSuffix(name, "64") {
+		name += "64"
+	}
+	return name
+}
+
+// multiarchDirs lists the library directories of each architecture that are
+// built into the glibc dynamic loader on multiarch (Debian-style) and
+// biarch (lib32/libx32) distributions. These are searched in addition to
+// the directories from ld.so.conf, so that libraries of other architectures
+// are found even if their configuration is not installed.
+var multiarchDirs = map[string][]string{
+	"i386": {"/lib/i386-linux-gnu", "/usr/lib/i386-linux-gnu", "/lib32",
+		"/usr/lib32"},
+	"x86_64": {"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu"},
+	"x32": {"/lib/x86_64-linux-gnux32", "/usr/lib/x86_64-linux-gnux32",
+		"/libx32", "/usr/libx32"},
+	"arm": {"/lib/arm-linux-gnueabihf", "/usr/lib/arm-linux-gnueabihf",
+		"/lib/arm-linux-gnueabi", "/usr/lib/arm-linux-gnueabi"},
+	"aarch64": {"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu"},
+}
+
+// arch returns the architecture of f.
+func (f *elfFile) arch() Arch {
+	return Arch{f.Class, f.Machine}
+}
@@ -0,0 +1,312 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Architecture tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+// testELF returns a minimal little-endian ELF shared object for the given
+// architecture, with an optional interpreter and needed libraries.
+func testELF(arch Arch, interp string, needed ...string) []byte {
+	return testELFSoname(arch, "", interp, needed...)
+}
+
+// testELFSoname is like testELF, but also sets the soname if not empty.
+func testELFSoname(arch Arch, soname, interp string,
+	needed ...string) []byte {
+	is64 := arch.Class == elf.ELFCLASS64
+	ehSize, phSize, shSize, dynSize := 52, 32, 40, 8
+	if is64 {
+		ehSize, phSize, shSize, dynSize = 64, 56, 64, 16
+	}
+	dynstr := []byte{0}
+	var dyn []uint64
+	for _, n := range needed {
+		dyn = append(dyn, uint64(elf.DT_NEEDED), uint64(len(dynstr)))
+		dynstr = append(append(dynstr, n...), 0)
+	}
+	if soname != "" {
+		dyn = append(dyn, uint64(elf.DT_SONAME), uint64(len(dynstr)))
+		dynstr = append(append(dynstr, soname...), 0)
+	}
+	dyn = append(dyn, uint64(elf.DT_NULL), 0)
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	// Layout: header, program header, interpreter, .dynstr, .dynamic,
+	// .shstrtab, section headers
+	interpOff := ehSize + phSize
+	interpLen := len(interp) + 1
+	dynstrOff := interpOff + interpLen
+	dynOff := (dynstrOff + len(dynstr) + 7) &^ 7
+	shstrOff := dynOff + len(dyn)/2*dynSize
+	shOff := (shstrOff + len(shstrtab) + 7) &^ 7
+	phNum := 0
+	if interp != "" {
+		phNum = 1
+	}
+
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	w := func(vs ...interface{}) {
+		for _, v := range vs {
+			binary.Write(&b, le, v)
+		}
+	}
+	// word writes an address-sized value
+	word := func(v int) {
+		if is64 {
+			w(uint64(v))
+		} else {
+			w(uint32(v))
+		}
+	}
+	pad := func(off int) { b.Write(make([]byte, off-b.Len())) }
+
+	b.Write([]byte{0x7f, 'E', 'L', 'F', byte(arch.Class),
+		byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)})
+	pad(16)
+	w(uint16(elf.ET_DYN), uint16(arch.Machine), uint32(elf.EV_CURRENT))
+	word(0)      // Entry
+	word(ehSize) // Program headers
+	word(shOff)
+	w(uint32(0), uint16(ehSize), uint16(phSize), uint16(phNum),
+		uint16(shSize), uint16(4), uint16(3))
+	if interp != "" {
+		if is64 {
+			w(uint32(elf.PT_INTERP), uint32(elf.PF_R), uint64(interpOff),
+				uint64(0), uint64(0), uint64(interpLen), uint64(interpLen),
+				uint64(1))
+		} else {
+			w(uint32(elf.PT_INTERP), uint32(interpOff), uint32(0), uint32(0),
+				uint32(interpLen), uint32(interpLen), uint32(elf.PF_R),
+				uint32(1))
+		}
+		b.WriteString(interp)
+	}
+	pad(dynstrOff)
+	b.Write(dynstr)
+	pad(dynOff)
+	for _, v := range dyn {
+		word(int(v))
+	}
+	b.Write(shstrtab)
+	pad(shOff)
+	section := func(name int, typ elf.SectionType, off, size, link,
+		entSize int) {
+		w(uint32(name), uint32(typ))
+		word(0) // Flags
+		word(0) // Address
+		word(off)
+		word(size)
+		w(uint32(link), uint32(0))
+		word(1) // Alignment
+		word(entSize)
+	}
+	section(0, elf.SHT_NULL, 0, 0, 0, 0)
+	section(1, elf.SHT_STRTAB, dynstrOff, len(dynstr), 0, 0)
+	section(9, elf.SHT_DYNAMIC, dynOff, len(dyn)/2*dynSize, 1, dynSize)
+	section(18, elf.SHT_STRTAB, shstrOff, len(shstrtab), 0, 0)
+	return b.Bytes()
+}
+
+func TestArchString(t *testing.T) {
+	for _, tc := range []struct {
+		arch     Arch
+		expected string
+	}{
+		{Arch{elf.ELFCLASS32, elf.EM_386}, "i386"},
+		{Arch{elf.ELFCLASS64, elf.EM_X86_64}, "x86_64"},
+		{Arch{elf.ELFCLASS32, elf.EM_X86_64}, "x32"},
+		{Arch{elf.ELFCLASS32, elf.EM_ARM}, "arm"},
+		{Arch{elf.ELFCLASS64, elf.EM_AARCH64}, "aarch64"},
+		{Arch{elf.ELFCLASS64, elf.EM_RISCV}, "riscv64"},
+		{Arch{elf.ELFCLASS64, elf.EM_PPC64}, "ppc64"},
+	} {
+		if actual := tc.arch.String(); actual != tc.expected {
+			t.Errorf("expected %s, actual %s", tc.expected, actual)
+		}
+	}
+}
+
+func TestMixedArchitectures(t *testing.T) {
+	td, err := ioutil.TempDir("", "arch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	amd64 := Arch{elf.ELFCLASS64, elf.EM_X86_64}
+	i386 := Arch{elf.ELFCLASS32, elf.EM_386}
+	arm64 := Arch{elf.ELFCLASS64, elf.EM_AARCH64}
+	const (
+		ld64   = "/lib64/ld-linux-x86-64.so.2"
+		ld32   = "/lib/ld-linux.so.2"
+		ldA    = "/lib/ld-linux-aarch64.so.1"
+		libc64 = "/lib/x86_64-linux-gnu/libc.so.6"
+		libc32 = "/lib/i386-linux-gnu/libc.so.6"
+		libz   = "/usr/lib/libz.so.1"
+	)
+	for name, b := range map[string][]byte{
+		"/bin/tool64": testELF(amd64, ld64, "libc.so.6", "libz.so.1"),
+		"/bin/tool32": testELF(i386, ld32, "libc.so.6", "libz.so.1"),
+		"/bin/toolA":  testELF(arm64, ldA, "libc.so.6"),
+		ld64:          testELF(amd64, ""),
+		ld32:          testELF(i386, ""),
+		ldA:           testELF(amd64, ""), // Wrong loader installed
+		libc64:        testELF(amd64, ""),
+		libc32:        testELF(i386, ""),
+		libz:          testELF(amd64, ""),
+	} {
+		p := filepath.Join(td, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type result struct {
+		path, arch string
+		skipped    []string
+	}
+	c := NewConfig(sysroot.Root(td))
+	for binary, expected := range map[string]map[string]result{
+		"/bin/tool64": {
+			"/bin/tool64":          {"/bin/tool64", "x86_64", nil},
+			"ld-linux-x86-64.so.2": {ld64, "x86_64", nil},
+			"libc.so.6":            {libc64, "x86_64", nil},
+			"libz.so.1":            {libz, "x86_64", nil},
+		},
+		"/bin/tool32": {
+			"/bin/tool32":   {"/bin/tool32", "i386", nil},
+			"ld-linux.so.2": {ld32, "i386", nil},
+			"libc.so.6":     {libc32, "i386", nil},
+			"libz.so.1":     {"", "", []string{libz + " x86_64"}},
+		},
+		"/bin/toolA": {
+			"/bin/toolA": {"/bin/toolA", "aarch64", nil},
+			// Binaries run via qemu-user need a loader of their own
+			"ld-linux-aarch64.so.1": {"", "", []string{ldA + " x86_64"}},
+			"libc.so.6":             {"", "", nil},
+		},
+	} {
+		root, err := c.DependencyGraph(binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := make(map[string]result)
+		root.Walk(func(l *Library) {
+			r := result{path: l.Path, arch: l.Arch}
+			for _, s := range l.Skipped {
+				r.skipped = append(r.skipped, s.Path+" "+s.Arch)
+			}
+			actual[l.Name] = r
+		})
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %v, actual %v", binary, expected, actual)
+		}
+	}
+}
+
+func TestUnprefix(t *testing.T) {
+	c := &Config{PathPrefix: "/opt/app"}
+	for _, tc := range []struct{ path, expected string }{
+		{"/opt/app/lib/ld.so", "/lib/ld.so"},
+		{"/opt/app", "/"},
+		{"/opt/app/../lib", ""},
+		{"/opt/application/lib", ""},
+		{"/lib", ""},
+		{"", ""},
+	} {
+		if actual := c.unprefix(tc.path); actual != tc.expected {
+			t.Errorf("%s: expected %q, actual %q", tc.path, tc.expected,
+				actual)
+		}
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	td, err := ioutil.TempDir("", "arch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	amd64 := Arch{elf.ELFCLASS64, elf.EM_X86_64}
+	const ld = "/lib64/ld-linux-x86-64.so.2"
+	for name, b := range map[string][]byte{
+		"/bin/tool":      testELF(amd64, "/opt/app"+ld, "libc.so.6"),
+		"/bin/host":      testELF(amd64, ld),
+		ld:               testELF(amd64, ""),
+		"/lib/libc.so.6": testELF(amd64, ""),
+	} {
+		p := filepath.Join(td, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewConfig(sysroot.Root(td))
+	c.PathPrefix = "/opt/app"
+	for binary, expected := range map[string]map[string]string{
+		// Without a run path, only the host's directories would be searched
+		"/bin/tool": {
+			"/bin/tool":            "/bin/tool",
+			"ld-linux-x86-64.so.2": ld,
+			"libc.so.6":            "",
+		},
+		"/bin/host": {
+			"/bin/host":            "/bin/host",
+			"ld-linux-x86-64.so.2": "",
+		},
+	} {
+		root, err := c.DependencyGraph(binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := make(map[string]string)
+		root.Walk(func(l *Library) { actual[l.Name] = l.Path })
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %v, actual %v", binary, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Library resolution configuration
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+// Config specifies where shared libraries are searched for.
+type Config struct {
+	// Root is the directory that all paths are resolved in. Libraries are
+	// never looked up outside of it.
+	Root sysroot.Root
+
+	// SearchPaths lists the directories to search for libraries, usually
+	// read from ld.so.conf.
+	SearchPaths []string
+
+	// Cache maps sonames to library paths, usually read from ld.so.cache.
+	// There may be several paths for libraries of different architectures.
+	Cache map[string][]string
+
+	// PathPrefix is the directory the files inside the root expect to be
+	// installed in, as recorded in their interpreter and run paths. If set,
+	// these paths are looked up with the prefix removed and libraries are
+	// only searched in the run paths, as the remaining directories of the
+	// dynamic loader refer to the host.
+	PathPrefix string
+
+	files *fileCache // Memoized file lookups, nil if not shared
+}
+
+// DefaultConfig resolves libraries on the host.
+var DefaultConfig = &Config{
+	SearchPaths: LdSearchPaths,
+	Cache:       readLdCache("", loaderCache),
+}
+
+// NewConfig returns a configuration that resolves libraries inside root,
+// using the loader configuration and cache found there.
+func NewConfig(root sysroot.Root) *Config {
+	return &Config{
+		Root:        root,
+		SearchPaths: parseLdConfig(root, loaderConfig),
+		Cache:       readLdCache(root, loaderCache),
+	}
+}
+
+// readLdCache reads the loader cache inside root. A missing or unsupported
+// cache is not an error, the result will be empty in that case.
+func readLdCache(root sysroot.Root, cache string) map[string][]string {
+	m := make(map[string][]string)
+	f, err := root.Open(cache)
+	if err != nil {
+		return m
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return m
+	}
+	entries, _ := ParseLdCache(b)
+	for _, e := range entries {
+		m[e.Name] = append(m[e.Name], e.Path)
+	}
+	return m
+}
+
+// newLibrary returns a dependency graph node for the library at path inside
+// the root. If path does not exist, the library is marked as missing.
+func (c *Config) newLibrary(name, path string) *Library {
+	l := &Library{Name: name}
+	if path == "" {
+		return l
+	}
+	if fi, err := c.stat(path); err == nil {
+		l.Path = path
+		l.Size = fi.Size()
+	}
+	return l
+}
+
+// unprefix returns path with PathPrefix removed. Paths outside of the prefix
+// are not part of the root and yield an empty string.
+func (c *Config) unprefix(path string) string {
+	if c.PathPrefix == "" || path == "" {
+		return path
+	}
+	rel, err := filepath.Rel(c.PathPrefix, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return ""
+	}
+	return filepath.Join("/", rel)
+}
+
+// findLibrary searches a list of directories inside the root for a file
+// given by its base name, like FindLibraryFunc. Each file is only checked
+// once, even if its directory is listed more than once.
+func (c *Config) findLibrary(basename string, paths []string,
+	usable func(path string) bool) string {
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		full := filepath.Join(p, basename)
+		if seen[full] {
+			continue
+		}
+		seen[full] = true
+		if fi, err := c.stat(full); err == nil && !fi.IsDir() &&
+			usable(full) {
+			return full
+		}
+	}
+	return ""
+}
+
+// ImportedLibraries returns the paths of all shared libraries the binary in
+// filename depends on, directly or indirectly. Libraries that cannot be
+// found are skipped. All paths are relative to the root.
+func (c *Config) ImportedLibraries(filename string) (deps []string,
+	err error) {
+	root, err := c.DependencyGraph(filename)
+	if err != nil {
+		return
+	}
+	return root.Dependencies(), nil
+}
+
+// ImportedLibraries returns the paths of all shared libraries the binary in
+// filename depends on using the host's configuration.
+func ImportedLibraries(filename string) ([]string, error) {
+	return DefaultConfig.ImportedLibraries(filename)
+}
+
+// DependencyGraph returns the graph of shared libraries the binary in
+// filename depends on using the host's configuration.
+func DependencyGraph(filename string) (*Library, error) {
+	return DefaultConfig.DependencyGraph(filename)
+}
@@ -0,0 +1,117 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * ELF dynamic linking information
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"debug/elf"
+	"strings"
+)
+
+// elfFile holds the parts of an ELF file's headers needed to resolve its
+// dependencies. It is kept separate from the file so that it can be shared
+// between lookups and stored in a cache.
+type elfFile struct {
+	Class   elf.Class
+	Data    elf.Data
+	Machine elf.Machine
+	Flags   uint32   // Processor-specific flags, like the ARM float ABI
+	Interp  string   // PT_INTERP, empty if not set
+	Soname  string   // DT_SONAME, empty if not set
+	Needed  []string // DT_NEEDED
+	RPath   []string // DT_RPATH, not yet expanded
+	RunPath []string // DT_RUNPATH, not yet expanded
+}
+
+// readELFInterpreter returns the value of the interpreter (dynamic loader)
+// listed in the ELF program header of f. If there is no interpreter set,
+// returns the empty string.
+func readELFInterpreter(f *elf.File) string {
+	const pathMax = 4096
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			r := p.Open()
+			m := p.Filesz
+			if m > pathMax {
+				m = pathMax
+			}
+			b := make([]byte, m)
+			r.Read(b)
+			return strings.TrimRight(string(b), "\x00")
+		}
+	}
+	return ""
+}
+
+// readELFFile reads the dynamic linking information of the file at path
+// inside the configured root. If the file is not an ELF file, returns nil
+// and no error.
+func (c *Config) readELFFile(path string) (*elfFile, error) {
+	f, err := c.Root.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, len(elf.ELFMAG))
+	if _, err := f.Read(b); err != nil || string(b) != elf.ELFMAG {
+		// File is either too small or not an ELF
+		return nil, nil
+	}
+	e, err := elf.NewFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+
+	needed, err := e.ImportedLibraries()
+	if err != nil {
+		return nil, err
+	}
+	ef := &elfFile{
+		Class:   e.Class,
+		Data:    e.Data,
+		Machine: e.Machine,
+		Interp:  readELFInterpreter(e),
+		Needed:  needed,
+	}
+	// The file header in debug/elf lacks the flags
+	flagsOff := int64(36)
+	if e.Class == elf.ELFCLASS64 {
+		flagsOff = 48
+	}
+	b = make([]byte, 4)
+	if _, err := f.ReadAt(b, flagsOff); err == nil {
+		ef.Flags = e.ByteOrder.Uint32(b)
+	}
+	ef.RPath, _ = e.DynString(elf.DT_RPATH)
+	ef.RunPath, _ = e.DynString(elf.DT_RUNPATH)
+	if soname, _ := e.DynString(elf.DT_SONAME); len(soname) > 0 {
+		ef.Soname = soname[0]
+	}
+	return ef, nil
+}
@@ -0,0 +1,77 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Library dependency graph
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+// Library is a node in a library dependency graph. Libraries needed by more
+// than one other library share the same node.
+type Library struct {
+	Name   string     // Name as listed by the dependent, e.g. the soname
+	Path   string     // Resolved path, empty if the library was not found
+	Arch   string     // Architecture, like "x86_64", empty if unknown
+	Size   int64      // File size in bytes
+	Needed []*Library // Direct dependencies
+
+	// Skipped lists the files that have the right name, but were not used
+	// because they are for a different architecture. Only set for missing
+	// libraries.
+	Skipped []*Library
+}
+
+// Missing returns whether the library could not be resolved.
+func (l *Library) Missing() bool {
+	return l.Path == ""
+}
+
+// Walk calls fn for l and all of its direct and indirect dependencies. Each
+// node is visited exactly once, in depth-first order.
+func (l *Library) Walk(fn func(l *Library)) {
+	visited := make(map[*Library]bool)
+	var walk func(l *Library)
+	walk = func(l *Library) {
+		if visited[l] {
+			return
+		}
+		visited[l] = true
+		fn(l)
+		for _, n := range l.Needed {
+			walk(n)
+		}
+	}
+	walk(l)
+}
+
+// Dependencies returns the resolved paths of all direct and indirect
+// dependencies of l. Missing libraries are skipped.
+func (l *Library) Dependencies() (paths []string) {
+	l.Walk(func(d *Library) {
+		if d != l && !d.Missing() {
+			paths = append(paths, d.Path)
+		}
+	})
+	return
+}
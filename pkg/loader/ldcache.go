@@ -0,0 +1,337 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Dynamic loader cache parsing
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+)
+
+// Default loader cache path. This file maps library sonames to paths and is
+// generated by ldconfig(8).
+const loaderCache = "/etc/ld.so.cache"
+
+const (
+	ldCacheMagic    = "glibc-ld.so.cache1.1" // Includes version
+	ldCacheOldMagic = "ld.so-1.7.0"
+
+	ldCacheHeaderSize   = 48
+	ldCacheEntrySize    = 24
+	ldCacheOldEntrySize = 12
+
+	// Header flags for the byte order, since glibc 2.33
+	ldCacheLittleEndian = 2
+	ldCacheBigEndian    = 3
+)
+
+// Flags of cache entries, see ldconfig.h in glibc
+const (
+	ldCacheFlagELFLibc6     = 0x0003
+	ldCacheFlagX8664Lib64   = 0x0300
+	ldCacheFlagS390Lib64    = 0x0400
+	ldCacheFlagPowerPCLib64 = 0x0500
+	ldCacheFlagX8664LibX32  = 0x0800
+	ldCacheFlagARMLibHF     = 0x0900
+	ldCacheFlagAArch64Lib64 = 0x0a00
+	ldCacheFlagARMLibSF     = 0x0b00
+	ldCacheFlagRISCVSoft    = 0x0f00
+	ldCacheFlagRISCVDouble  = 0x1000
+
+	ldCacheUnsupportedFlags = -1
+)
+
+// Processor-specific ELF header flags that select the float ABI
+const (
+	efARMABIFloatSoft     = 0x200
+	efARMABIFloatHard     = 0x400
+	efRISCVFloatABIMask   = 0x6
+	efRISCVFloatABIDouble = 0x4
+)
+
+// LdCacheEntry is a single library in the dynamic loader cache.
+type LdCacheEntry struct {
+	Flags int32  // Library type and architecture, see ldconfig.h in glibc
+	Name  string // Soname of the library
+	Path  string // Full path to the library
+	HWCap uint64 // Required hardware capabilities
+}
+
+var errInvalidLdCache = errors.New("invalid ld.so.cache")
+
+// cString returns the NUL-terminated string at offset off in b.
+func cString(b []byte, off uint32) (string, error) {
+	if int(off) >= len(b) {
+		return "", errInvalidLdCache
+	}
+	s := b[off:]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		return string(s[:i]), nil
+	}
+	return "", errInvalidLdCache
+}
+
+// ParseLdCache parses the contents of a dynamic loader cache file as written
+// by glibc's ldconfig. Both the current format and the older combined format
+// are supported. Entries are returned in order of precedence.
+func ParseLdCache(b []byte) ([]LdCacheEntry, error) {
+	if bytes.HasPrefix(b, []byte(ldCacheOldMagic)) {
+		// Skip the old format entries, the new format follows 8-byte aligned
+		if len(b) < 16 {
+			return nil, errInvalidLdCache
+		}
+		n := int(binary.LittleEndian.Uint32(b[12:16]))
+		if binary.LittleEndian.Uint32(b[12:16]) > uint32(len(b)) {
+			n = int(binary.BigEndian.Uint32(b[12:16]))
+		}
+		off := (16 + n*ldCacheOldEntrySize + 7) &^ 7
+		if n < 0 || off > len(b) {
+			return nil, errInvalidLdCache
+		}
+		b = b[off:]
+	}
+	if len(b) < ldCacheHeaderSize ||
+		!bytes.HasPrefix(b, []byte(ldCacheMagic)) {
+		return nil, errInvalidLdCache
+	}
+
+	// The cache uses the byte order of the machine it was generated for
+	var bo binary.ByteOrder = binary.LittleEndian
+	if n := bo.Uint32(b[20:24]); uint64(n)*ldCacheEntrySize > uint64(len(b)) {
+		bo = binary.BigEndian
+	}
+	n := bo.Uint32(b[20:24])
+	if uint64(n)*ldCacheEntrySize+ldCacheHeaderSize > uint64(len(b)) {
+		return nil, errInvalidLdCache
+	}
+
+	entries := make([]LdCacheEntry, n)
+	for i := range entries {
+		e := b[ldCacheHeaderSize+i*ldCacheEntrySize:]
+		name, err := cString(b, bo.Uint32(e[4:8]))
+		if err != nil {
+			return nil, err
+		}
+		path, err := cString(b, bo.Uint32(e[8:12]))
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = LdCacheEntry{
+			Flags: int32(bo.Uint32(e[0:4])),
+			Name:  name,
+			Path:  path,
+			HWCap: bo.Uint64(e[16:24]),
+		}
+	}
+	return entries, nil
+}
+
+// ldCacheFlags returns the flags of the cache entry for a library, which the
+// loader uses to tell the architectures apart. Returns
+// ldCacheUnsupportedFlags for 64-bit architectures that glibc does not know.
+func ldCacheFlags(f *elfFile) int32 {
+	switch f.Machine {
+	case elf.EM_X86_64:
+		if f.Class == elf.ELFCLASS32 {
+			return ldCacheFlagX8664LibX32 | ldCacheFlagELFLibc6
+		}
+		return ldCacheFlagX8664Lib64 | ldCacheFlagELFLibc6
+	case elf.EM_AARCH64:
+		return ldCacheFlagAArch64Lib64 | ldCacheFlagELFLibc6
+	case elf.EM_ARM:
+		switch {
+		case f.Flags&efARMABIFloatHard != 0:
+			return ldCacheFlagARMLibHF | ldCacheFlagELFLibc6
+		case f.Flags&efARMABIFloatSoft != 0:
+			return ldCacheFlagARMLibSF | ldCacheFlagELFLibc6
+		}
+	case elf.EM_PPC64:
+		return ldCacheFlagPowerPCLib64 | ldCacheFlagELFLibc6
+	case elf.EM_S390:
+		if f.Class == elf.ELFCLASS64 {
+			return ldCacheFlagS390Lib64 | ldCacheFlagELFLibc6
+		}
+	case elf.EM_RISCV:
+		if f.Class != elf.ELFCLASS64 {
+			break
+		}
+		switch f.Flags & efRISCVFloatABIMask {
+		case 0:
+			return ldCacheFlagRISCVSoft | ldCacheFlagELFLibc6
+		case efRISCVFloatABIDouble:
+			return ldCacheFlagRISCVDouble | ldCacheFlagELFLibc6
+		}
+		return ldCacheUnsupportedFlags
+	}
+	if f.Class == elf.ELFCLASS64 {
+		return ldCacheUnsupportedFlags
+	}
+	return ldCacheFlagELFLibc6
+}
+
+// ldCacheLibCmp compares library names like the loader does, treating runs
+// of digits as numbers, so that "libfoo.so.10" sorts after "libfoo.so.9".
+func ldCacheLibCmp(a, b string) int {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case isDigit(a[i]) && isDigit(b[j]):
+			var va, vb int
+			for ; i < len(a) && isDigit(a[i]); i++ {
+				va = va*10 + int(a[i]-'0')
+			}
+			for ; j < len(b) && isDigit(b[j]); j++ {
+				vb = vb*10 + int(b[j]-'0')
+			}
+			if va != vb {
+				return va - vb
+			}
+		case isDigit(a[i]):
+			return 1
+		case isDigit(b[j]):
+			return -1
+		case a[i] != b[j]:
+			return int(a[i]) - int(b[j])
+		default:
+			i++
+			j++
+		}
+	}
+	return (len(a) - i) - (len(b) - j)
+}
+
+// WriteLdCache writes a dynamic loader cache containing entries to w, in the
+// current glibc format and byte order bo. Entries are sorted the way the
+// loader expects, entries for the same soname are sorted by flags.
+func WriteLdCache(w io.Writer, entries []LdCacheEntry,
+	bo binary.ByteOrder) error {
+	sorted := make([]LdCacheEntry, len(entries))
+	copy(sorted, entries)
+	// The loader does a binary search on names in descending order
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := ldCacheLibCmp(sorted[i].Name, sorted[j].Name); c != 0 {
+			return c > 0
+		}
+		return sorted[i].Flags > sorted[j].Flags
+	})
+
+	// String offsets are relative to the start of the header
+	var strs bytes.Buffer
+	offsets := make(map[string]uint32)
+	strOff := func(s string) uint32 {
+		if off, ok := offsets[s]; ok {
+			return off
+		}
+		off := uint32(ldCacheHeaderSize + len(sorted)*ldCacheEntrySize +
+			strs.Len())
+		offsets[s] = off
+		strs.WriteString(s)
+		strs.WriteByte(0)
+		return off
+	}
+	var table bytes.Buffer
+	for _, e := range sorted {
+		b := make([]byte, ldCacheEntrySize)
+		bo.PutUint32(b[0:4], uint32(e.Flags))
+		bo.PutUint32(b[4:8], strOff(e.Name))
+		bo.PutUint32(b[8:12], strOff(e.Path))
+		bo.PutUint64(b[16:24], e.HWCap)
+		table.Write(b)
+	}
+
+	hdr := make([]byte, ldCacheHeaderSize)
+	copy(hdr, ldCacheMagic)
+	bo.PutUint32(hdr[20:24], uint32(len(sorted)))
+	bo.PutUint32(hdr[24:28], uint32(strs.Len()))
+	hdr[28] = ldCacheLittleEndian
+	if bo == binary.BigEndian {
+		hdr[28] = ldCacheBigEndian
+	}
+	for _, b := range [][]byte{hdr, table.Bytes(), strs.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LdCacheEntries returns the loader cache entries for all libraries in the
+// dependency graphs roots, in the byte order of the libraries. The binaries
+// at the roots of the graphs and missing libraries are left out.
+func (c *Config) LdCacheEntries(roots []*Library) (entries []LdCacheEntry,
+	bo binary.ByteOrder, err error) {
+	bo = binary.LittleEndian
+	var data elf.Data
+	seen := make(map[LdCacheEntry]bool)
+	for _, r := range roots {
+		r.Walk(func(l *Library) {
+			if err != nil || l == r || l.Missing() {
+				return
+			}
+			f, ferr := c.elfFile(l.Path)
+			if ferr != nil || f == nil {
+				err = ferr
+				return
+			}
+			flags := ldCacheFlags(f)
+			if flags == ldCacheUnsupportedFlags {
+				err = fmt.Errorf("cannot add %s to ld.so.cache: unsupported "+
+					"architecture %s", l.Path, f.arch())
+				return
+			}
+			if data == elf.ELFDATANONE {
+				data = f.Data
+			} else if f.Data != data {
+				err = fmt.Errorf("cannot add %s to ld.so.cache: mixed byte "+
+					"orders", l.Path)
+				return
+			}
+			// ld.so looks up libraries by their soname, which need not
+			// be the name they were needed by
+			name := f.Soname
+			if name == "" {
+				name = path.Base(l.Path)
+			}
+			e := LdCacheEntry{Flags: flags, Name: name, Path: l.Path}
+			if !seen[e] {
+				seen[e] = true
+				entries = append(entries, e)
+			}
+		})
+	}
+	if data == elf.ELFDATA2MSB {
+		bo = binary.BigEndian
+	}
+	return
+}
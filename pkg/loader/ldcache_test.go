@@ -0,0 +1,182 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Dynamic loader cache parsing tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+func TestParseLdCache(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/ld.so.cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ParseLdCache(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LdCacheEntry{
+		{0x0303, "libfoo.so.1", "/opt/foo/lib/libfoo.so.1", 0},
+		{0x0303, "libbar.so.2", "/usr/lib/x86_64-linux-gnu/libbar.so.2", 0},
+		{0x0003, "libbar.so.2", "/usr/lib/i386-linux-gnu/libbar.so.2", 0},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %v, actual %v", expected, entries)
+	}
+
+	if _, err := ParseLdCache(b[:40]); err == nil {
+		t.Error("expected error for truncated cache")
+	}
+}
+
+func TestLdCacheLibCmp(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		sign int
+	}{
+		{"libfoo.so.1", "libfoo.so.1", 0},
+		{"libfoo.so.9", "libfoo.so.10", -1},
+		{"libfoo.so", "libfoo.so.1", -1},
+		{"libbar.so.1", "libfoo.so.1", -1},
+		{"lib2.so", "liba.so", 1},
+	} {
+		c := ldCacheLibCmp(tc.a, tc.b)
+		if (c > 0) != (tc.sign > 0) || (c < 0) != (tc.sign < 0) {
+			t.Errorf("%s vs %s: expected sign %d, actual %d", tc.a, tc.b,
+				tc.sign, c)
+		}
+	}
+}
+
+func TestWriteLdCache(t *testing.T) {
+	entries := []LdCacheEntry{
+		{0x0003, "libbar.so.2", "/usr/lib/i386-linux-gnu/libbar.so.2", 0},
+		{0x0303, "libfoo.so.9", "/opt/foo/lib/libfoo.so.9", 0},
+		{0x0303, "libbar.so.2", "/usr/lib/x86_64-linux-gnu/libbar.so.2", 0},
+		{0x0303, "libfoo.so.10", "/opt/foo/lib/libfoo.so.10", 0},
+	}
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian,
+		binary.BigEndian} {
+		var b bytes.Buffer
+		if err := WriteLdCache(&b, entries, bo); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ParseLdCache(b.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []LdCacheEntry{entries[3], entries[1], entries[2],
+			entries[0]}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %v, actual %v", bo, expected, actual)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := WriteLdConfig(&b, entries); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Generated by jailtime\n" +
+		"/usr/lib/i386-linux-gnu\n" +
+		"/opt/foo/lib\n" +
+		"/usr/lib/x86_64-linux-gnu\n"
+	if actual := b.String(); actual != expected {
+		t.Errorf("expected %q, actual %q", expected, actual)
+	}
+}
+
+func TestLdCacheEntries(t *testing.T) {
+	td, err := ioutil.TempDir("", "ldcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	amd64 := Arch{elf.ELFCLASS64, elf.EM_X86_64}
+	i386 := Arch{elf.ELFCLASS32, elf.EM_386}
+	const (
+		ld64 = "/lib64/ld-linux-x86-64.so.2"
+		ld32 = "/lib/ld-linux.so.2"
+	)
+	for name, b := range map[string][]byte{
+		"/bin/tool32":               testELF(i386, ld32, "libfoo.so.1"),
+		ld64:                        testELF(amd64, ""),
+		ld32:                        testELF(i386, ""),
+		"/opt/foo/lib/libfoo.so.1":  testELF(amd64, ""),
+		"/usr/lib32/libfoo.so.1":    testELF(i386, ""),
+		"/usr/lib32/libunused.so.1": testELF(i386, ""),
+		"/bin/tool64": testELF(amd64, ld64, "libfoo.so.1",
+			"libbar.so"),
+		// Needed by its link name instead of its soname
+		"/opt/foo/lib/libbar.so": testELFSoname(amd64, "libbar.so.2", ""),
+	} {
+		p := filepath.Join(td, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewConfig(sysroot.Root(td))
+	c.SearchPaths = []string{"/opt/foo/lib"}
+	var roots []*Library
+	for _, binary := range []string{"/bin/tool64", "/bin/tool32"} {
+		r, err := c.DependencyGraph(binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, r)
+	}
+	entries, bo, err := c.LdCacheEntries(append(roots, roots[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LdCacheEntry{
+		{0x0303, "ld-linux-x86-64.so.2", ld64, 0},
+		{0x0303, "libfoo.so.1", "/opt/foo/lib/libfoo.so.1", 0},
+		{0x0303, "libbar.so.2", "/opt/foo/lib/libbar.so", 0},
+		{0x0003, "ld-linux.so.2", ld32, 0},
+		{0x0003, "libfoo.so.1", "/usr/lib32/libfoo.so.1", 0},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %v, actual %v", expected, entries)
+	}
+	if bo != binary.LittleEndian {
+		t.Errorf("expected %s, actual %s", binary.LittleEndian, bo)
+	}
+}
@@ -29,22 +29,40 @@ package loader
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
 )
 
 // Default loader config path. This file contains a list of directories, one
 // per line, in which to search for libraries.
 const loaderConfig = "/etc/ld.so.conf"
 
+// Directories the dynamic loader always searches, which need not be listed
+// in the loader config
+var trustedDirs = map[string]bool{
+	"/lib":       true,
+	"/lib64":     true,
+	"/usr/lib":   true,
+	"/usr/lib64": true,
+}
+
 // Default search paths for the dynamic loader
 var LdSearchPaths []string = ParseLdConfig(loaderConfig)
 
 func ParseLdConfig(conf string) (paths []string) {
+	return parseLdConfig("", conf)
+}
+
+// parseLdConfig parses the loader config conf inside root, including all
+// files it includes.
+func parseLdConfig(root sysroot.Root, conf string) (paths []string) {
 	paths = []string{}
-	f, err := os.Open(conf)
+	f, err := root.Open(conf)
 	if err != nil {
 		return
 	}
@@ -66,12 +84,12 @@ func ParseLdConfig(conf string) (paths []string) {
 		}
 		comp := strings.SplitN(line, " ", 2)
 		if len(comp) == 2 && comp[0] == "include" {
-			m, err := filepath.Glob(strings.TrimSpace(comp[1]))
+			m, err := root.Glob(strings.TrimSpace(comp[1]))
 			if err != nil {
 				continue
 			}
 			for _, p := range m {
-				if newPaths := ParseLdConfig(p); len(newPaths) > 0 {
+				if newPaths := parseLdConfig(root, p); len(newPaths) > 0 {
 					paths = append(paths, newPaths...)
 				}
 			}
@@ -96,3 +114,24 @@ func FindLibraryFunc(basename string, paths []string,
 	}
 	return ""
 }
+
+// WriteLdConfig writes a loader config to w that lists the directories of
+// all cache entries, in order of first use. Directories that the loader
+// always searches are left out.
+func WriteLdConfig(w io.Writer, entries []LdCacheEntry) error {
+	if _, err := fmt.Fprintf(w, "# Generated by jailtime\n"); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		dir := filepath.Dir(e.Path)
+		if trustedDirs[dir] || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if _, err := fmt.Fprintf(w, "%s\n", dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -29,20 +29,19 @@ package loader
 
 import (
 	"debug/macho"
-	"encoding/binary"
 	"fmt"
-	"os"
 	"runtime"
-	"strings"
+
+	"blichmann.eu/code/jailtime/pkg/dyld"
 )
 
-const LoaderExecutable = "/usr/lib/dyld"
+const LoaderExecutable = dyld.LoaderExecutable
 
 const (
 	// Extra constants since macOS 10.1
-	LoadCmdReqDyld         macho.LoadCmd = 0x80000000
-	LoadCmdReExportDylib   macho.LoadCmd = 0x1f | LoadCmdReqDyld
-	LoadCmdLoadUpwardDylib macho.LoadCmd = 0x23 | LoadCmdReqDyld
+	LoadCmdReqDyld         = dyld.LoadCmdReqDyld
+	LoadCmdReExportDylib   = dyld.LoadCmdReExportDylib
+	LoadCmdLoadUpwardDylib = dyld.LoadCmdLoadUpwardDylib
 )
 
 var machoCpu macho.Cpu = 0
@@ -54,101 +53,40 @@ func init() {
 		"386":   macho.Cpu386,
 		"amd64": macho.CpuAmd64,
 		"arm":   macho.CpuArm,
-		// TODO(cblichmann): Enable once AArch64 is officially supported.
-		//"arm64": macho.CpuArm64,
+		"arm64": macho.CpuArm64,
 	}[runtime.GOARCH]; ok {
 		machoCpu = c
 	}
 }
 
-func openMachO(binary string) (*macho.File, error) {
+// DependencyGraph returns the dependency graph of the Mach-O binary in
+// filename. Weak dylibs that cannot be found are left out, as dyld skips
+// them as well.
+func (c *Config) DependencyGraph(filename string) (*Library, error) {
 	if machoCpu == 0 {
 		return nil, fmt.Errorf("no Mach-O arch matching GOARCH: %s",
 			runtime.GOARCH)
 	}
-	// Try to open as non-fat binary first
-	if f, err := macho.Open(binary); err == nil {
-		if f.Cpu != machoCpu {
-			return nil, fmt.Errorf("unexpected Mach-O arch: %s", machoCpu)
-		}
-		return f, nil
-	}
-	fat, err := macho.OpenFat(binary)
+	r := &dyld.Resolver{Root: c.Root, Cpu: machoCpu}
+	img, err := r.Resolve(filename)
 	if err != nil {
 		return nil, err
 	}
-	for _, a := range fat.Arches {
-		if a.FatArchHeader.Cpu == machoCpu {
-			return a.File, nil
+	nodes := make(map[*dyld.Image]*Library)
+	var convert func(i *dyld.Image) *Library
+	convert = func(i *dyld.Image) *Library {
+		if l, ok := nodes[i]; ok {
+			return l
 		}
-	}
-	return nil, fmt.Errorf("Mach-O arch not in file: %s", machoCpu)
-}
-
-func ImportedLibraries(filename string) (deps []string, err error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-
-	m := make([]byte, 4 /* uint32 */)
-	f.Read(m) // Ignore errors
-	be := binary.BigEndian.Uint32(m[:])
-	le := binary.LittleEndian.Uint32(m[:])
-	if be != macho.Magic32 && be != macho.Magic64 &&
-		le != macho.Magic32 && le != macho.Magic64 {
-		// File is either too small or not a Mach-O
-		return
-	}
-
-	resolved := map[string]bool{
-		// On macOS, all binaries need "dyld"
-		LoaderExecutable: true,
-		filename:         false}
-	for {
-		todo := []string{}
-		for l, r := range resolved {
-			if r {
+		l := c.newLibrary(i.Name, i.Path)
+		nodes[i] = l
+		for _, d := range i.Deps {
+			if d.Missing() && d.Kind == dyld.LoadWeak {
 				continue
 			}
-			var f *macho.File
-			if f, err = openMachO(l); err != nil {
-				return
-			}
-			defer f.Close()
-			var newLibs []string
-			bo := f.ByteOrder
-			for _, cmd := range f.Loads {
-				raw := cmd.Raw()
-				// TODO(cblichmann): Optionally handle weak dylibs.
-				c := macho.LoadCmd(bo.Uint32(raw[0:4]))
-				if c == LoadCmdReExportDylib || c == LoadCmdLoadUpwardDylib {
-					n := bo.Uint32(raw[8:12])
-					if n < uint32(len(raw)) {
-						path := strings.TrimRight(string(raw[n:]), "\x00")
-						todo = append(todo, path)
-					}
-				}
-			}
-			if newLibs, err = f.ImportedLibraries(); err != nil {
-				return
-			}
-			todo = append(todo, newLibs...)
-			resolved[l] = true
+			l.Needed = append(l.Needed, convert(d))
 		}
-		if len(todo) == 0 {
-			break
-		}
-		for _, l := range todo {
-			if _, ok := resolved[l]; !ok {
-				resolved[l] = false
-			}
-		}
-	}
-	deps = []string{}
-	for l, _ := range resolved {
-		deps = append(deps, l)
+		return l
 	}
-	return
+	return convert(img), nil
 }
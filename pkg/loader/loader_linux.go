@@ -29,90 +29,212 @@ package loader
 
 import (
 	"debug/elf"
-	"os"
 	"path/filepath"
 	"strings"
 )
 
-// readELFInterpreter returns the value of the interpreter (dynamic loader)
-// listed in the ELF program header of f. If there is no interpreter set,
-// returns the empty string.
-func readELFInterpreter(f *elf.File) string {
-	const pathMax = 4096
-	for _, p := range f.Progs {
-		if p.Type == elf.PT_INTERP {
-			r := p.Open()
-			m := p.Filesz
-			if m > pathMax {
-				m = pathMax
+// dynPaths returns the search paths listed in dynamic section values, like
+// those of DT_RUNPATH. The $ORIGIN variable is replaced by origin, paths
+// using other variables are skipped.
+func dynPaths(values []string, origin string) (paths []string) {
+	for _, v := range values {
+		for _, p := range filepath.SplitList(v) {
+			p = strings.Replace(p, "${ORIGIN}", origin, -1)
+			p = strings.Replace(p, "$ORIGIN", origin, -1)
+			if p != "" && !strings.Contains(p, "$") {
+				paths = append(paths, p)
 			}
-			b := make([]byte, m)
-			r.Read(b)
-			return strings.TrimRight(string(b), "\x00")
 		}
 	}
-	return ""
+	return
 }
 
-func ImportedLibraries(filename string) (deps []string, err error) {
-	// Note: The code below will likely work for the BSDs/Solaris as well, but
-	//       is untested on those patforms.
-	f, err := os.Open(filename)
-	if err != nil {
-		return
+// elfObject holds the dynamic linking information of an ELF file that is
+// needed to resolve its dependencies.
+type elfObject struct {
+	needed  []string
+	rpath   []string   // DT_RPATH, only set if there is no DT_RUNPATH
+	runpath []string   // DT_RUNPATH
+	loader  *elfObject // Object that loaded this one, nil for executables
+}
+
+// newELFObject returns the dynamic linking information of f, which was
+// loaded from path. Loader is the object that loaded f, or nil for
+// executables.
+func (c *Config) newELFObject(f *elfFile, path string,
+	loader *elfObject) *elfObject {
+	origin := filepath.Join(c.PathPrefix, filepath.Dir(path))
+	o := &elfObject{
+		needed:  f.Needed,
+		runpath: c.unprefixAll(dynPaths(f.RunPath, origin)),
+		loader:  loader,
+	}
+	if len(o.runpath) == 0 {
+		o.rpath = c.unprefixAll(dynPaths(f.RPath, origin))
 	}
-	defer f.Close()
+	return o
+}
 
-	b := make([]byte, len(elf.ELFMAG))
-	if _, err2 := f.Read(b); err2 != nil || string(b) != elf.ELFMAG {
-		// File is either too small or not an ELF
-		return
+// unprefixAll removes the PathPrefix from paths, dropping those outside of
+// it.
+func (c *Config) unprefixAll(paths []string) (result []string) {
+	for _, p := range paths {
+		if p = c.unprefix(p); p != "" {
+			result = append(result, p)
+		}
 	}
+	return
+}
 
-	e, err := elf.NewFile(f)
-	if err != nil {
+// searchPaths returns the directories to search for the library name needed
+// by o, in the order used by the glibc dynamic loader.
+func (c *Config) searchPaths(name string, o *elfObject, interpDir string,
+	arch Arch) (paths []string) {
+	// DT_RPATH is ignored if DT_RUNPATH is present. Otherwise, the RPATHs of
+	// all loading objects are searched as well.
+	if len(o.runpath) == 0 {
+		for p := o; p != nil; p = p.loader {
+			paths = append(paths, p.rpath...)
+		}
+	}
+	paths = append(paths, o.runpath...)
+	if c.PathPrefix != "" {
 		return
 	}
-	defer e.Close()
+	for _, p := range c.Cache[name] {
+		paths = append(paths, filepath.Dir(p))
+	}
+	if interpDir != "" {
+		paths = append(paths, interpDir)
+	}
+	paths = append(paths, c.SearchPaths...)
+	paths = append(paths, multiarchDirs[arch.String()]...)
+	if arch.Class == elf.ELFCLASS64 {
+		paths = append(paths, "/lib64", "/usr/lib64")
+	}
+	return append(paths, "/lib", "/usr/lib")
+}
+
+// muslSearchPaths returns the directories to search for libraries needed by
+// o, in the order used by the musl dynamic loader. The musl loader does not
+// distinguish between DT_RPATH and DT_RUNPATH and always searches the paths
+// of the loading objects, followed by the system paths.
+func muslSearchPaths(o *elfObject, sysPaths []string) (paths []string) {
+	for p := o; p != nil; p = p.loader {
+		paths = append(paths, p.rpath...)
+		paths = append(paths, p.runpath...)
+	}
+	return append(paths, sysPaths...)
+}
+
+// wrongArch returns a node for the file at path if it is an ELF file of a
+// different architecture than arch, or nil otherwise.
+func (c *Config) wrongArch(name, path string, arch Arch) *Library {
+	f, err := c.elfFile(path)
+	if err != nil || f == nil || f.arch() == arch {
+		return nil
+	}
+	l := c.newLibrary(name, path)
+	l.Arch = f.arch().String()
+	return l
+}
 
-	libs, err := e.ImportedLibraries()
+// DependencyGraph returns the graph of shared libraries the ELF binary in
+// filename depends on, including its interpreter. Libraries are only
+// considered if they match the architecture of the binary, files of other
+// architectures are listed as skipped in the missing library's node. If
+// filename is not an ELF binary, the returned node has no dependencies.
+func (c *Config) DependencyGraph(filename string) (root *Library,
+	err error) {
+	// Note: The code below will likely work for the BSDs/Solaris as well, but
+	//       is untested on those patforms.
+	e, err := c.elfFile(filename)
 	if err != nil {
+		return nil, err
+	}
+	root = c.newLibrary(filename, filename)
+	if e == nil {
+		// Not an ELF file
 		return
 	}
+	obj := c.newELFObject(e, filename, nil)
+	arch := e.arch()
+	root.Arch = arch.String()
 
-	interp := readELFInterpreter(e)
-	interpBase := filepath.Base(interp)
-	resolved := map[string]string{interpBase: interp}
-	paths := append([]string{filepath.Dir(interp)}, LdSearchPaths...)
-	for {
-		numResolved := len(resolved)
-		for _, l := range libs {
-			if _, ok := resolved[l]; ok {
+	nodes := make(map[string]*Library)
+	var interpLib *Library
+	var interpDir string
+	interp := c.unprefix(e.Interp)
+	if e.Interp != "" {
+		interpLib = c.newLibrary(filepath.Base(e.Interp), interp)
+		if w := c.wrongArch(interpLib.Name, interp, arch); w != nil {
+			interpLib = &Library{Name: w.Name, Skipped: []*Library{w}}
+		} else if !interpLib.Missing() {
+			interpLib.Arch = root.Arch
+		}
+		nodes[interpLib.Name] = interpLib
+		root.Needed = append(root.Needed, interpLib)
+		if interp != "" {
+			interpDir = filepath.Dir(interp)
+		}
+	}
+	// The libc flavor determines the search rules
+	muslArch, musl := muslArchFromInterp(interp)
+	var sysPaths []string
+	if musl && c.PathPrefix == "" {
+		sysPaths = c.muslSysPaths(muslArch)
+	}
+	searchPaths := func(name string, o *elfObject) []string {
+		if musl {
+			return muslSearchPaths(o, sysPaths)
+		}
+		return c.searchPaths(name, o, interpDir, arch)
+	}
+
+	type item struct {
+		lib *Library
+		obj *elfObject
+	}
+	for todo := []item{{root, obj}}; len(todo) > 0; todo = todo[1:] {
+		cur := todo[0]
+		for _, name := range cur.obj.needed {
+			if l, ok := nodes[name]; ok {
+				cur.lib.Needed = append(cur.lib.Needed, l)
 				continue
 			}
-			r := FindLibraryFunc(l, paths, func(path string) bool {
-				g, err := elf.Open(path)
-				if err != nil {
-					return false
-				}
-				defer g.Close()
-				if g.Class == e.Class && g.Machine == e.Machine {
-					newLibs, err := g.ImportedLibraries()
-					libs = append(libs, newLibs...)
-					return err == nil
-				}
-				return false
-			})
-			if r != "" {
-				resolved[l] = r
+			if musl && interpLib != nil && isMuslReserved(name) {
+				// Provided by the musl loader itself
+				nodes[name] = interpLib
+				cur.lib.Needed = append(cur.lib.Needed, interpLib)
+				continue
+			}
+			var o *elfObject
+			var skipped []*Library
+			path := c.findLibrary(name, searchPaths(name, cur.obj),
+				func(path string) bool {
+					if w := c.wrongArch(name, path, arch); w != nil {
+						skipped = append(skipped, w)
+						return false
+					}
+					g, err := c.elfFile(path)
+					if err != nil || g == nil {
+						return false
+					}
+					o = c.newELFObject(g, path, cur.obj)
+					return true
+				})
+			l := c.newLibrary(name, path)
+			if l.Missing() {
+				l.Skipped = skipped
+			} else {
+				l.Arch = root.Arch
+			}
+			nodes[name] = l
+			cur.lib.Needed = append(cur.lib.Needed, l)
+			if !l.Missing() {
+				todo = append(todo, item{l, o})
 			}
 		}
-		if numResolved == len(resolved) {
-			break
-		}
-	}
-	for _, v := range resolved {
-		deps = append(deps, v)
 	}
 	return
 }
@@ -28,9 +28,13 @@
 package loader
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"testing"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
 )
 
 func TestImportedLibaries(t *testing.T) {
@@ -61,3 +65,66 @@ func TestImportedLibaries(t *testing.T) {
 		}
 	}
 }
+
+func TestDependencyGraph(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir("testdata"); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := DependencyGraph("nc.openbsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Missing() {
+		t.Fatal("expected binary to be resolved")
+	}
+	names := make(map[string]int)
+	root.Walk(func(l *Library) {
+		names[l.Name]++
+	})
+	for _, n := range []string{"libbsd.so.0", "libc.so.6",
+		"ld-linux-x86-64.so.2"} {
+		if names[n] != 1 {
+			t.Errorf("expected %s to be visited once, actual %d", n, names[n])
+		}
+	}
+}
+
+func TestDependencyGraphSysroot(t *testing.T) {
+	td, err := ioutil.TempDir("", "loader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	b, err := ioutil.ReadFile("testdata/nc.openbsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(td, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(td, "bin/nc"), b,
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sysroot contains no libraries, so none must be found on the host
+	root, err := NewConfig(sysroot.Root(td)).DependencyGraph("/bin/nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Missing() {
+		t.Fatal("expected binary to be resolved")
+	}
+	if len(root.Needed) == 0 {
+		t.Fatal("expected dependencies")
+	}
+	for _, l := range root.Needed {
+		if !l.Missing() {
+			t.Errorf("expected %s to be missing, actual %s", l.Name, l.Path)
+		}
+	}
+}
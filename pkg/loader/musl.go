@@ -0,0 +1,85 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * musl libc loader conventions
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The musl dynamic loader is named ld-musl-$ARCH.so.1
+var muslInterpRe = regexp.MustCompile(`^ld-musl-(.+)\.so\.1$`)
+
+// Default search path of the musl loader if no path file exists.
+var muslDefaultPaths = []string{"/lib", "/usr/local/lib", "/usr/lib"}
+
+// muslArchFromInterp returns the musl architecture name, like "x86_64" or
+// "aarch64", if interp is the path of a musl dynamic loader.
+func muslArchFromInterp(interp string) (arch string, ok bool) {
+	m := muslInterpRe.FindStringSubmatch(filepath.Base(interp))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// isMuslReserved returns whether name refers to a library that is part of
+// musl's libc.so and thus provided by the loader itself, see load_library()
+// in ldso/dynlink.c.
+func isMuslReserved(name string) bool {
+	if !strings.HasPrefix(name, "lib") {
+		return false
+	}
+	for _, r := range []string{"c.", "pthread.", "rt.", "m.", "dl.", "util.",
+		"xnet."} {
+		if strings.HasPrefix(name[3:], r) {
+			return true
+		}
+	}
+	return false
+}
+
+// muslSysPaths returns the system library search paths of the musl loader
+// for arch. These are read from /etc/ld-musl-$ARCH.path inside the root,
+// which lists directories separated by colons or newlines.
+func (c *Config) muslSysPaths(arch string) []string {
+	f, err := c.Root.Open("/etc/ld-musl-" + arch + ".path")
+	if err != nil {
+		return muslDefaultPaths
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return muslDefaultPaths
+	}
+	return strings.FieldsFunc(string(b), func(r rune) bool {
+		return r == ':' || r == '\n'
+	})
+}
@@ -0,0 +1,91 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * musl libc loader convention tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+func TestMuslArchFromInterp(t *testing.T) {
+	if arch, ok := muslArchFromInterp("/lib/ld-musl-x86_64.so.1"); !ok {
+		t.Error("expected musl loader")
+	} else if arch != "x86_64" {
+		t.Errorf("expected %s, actual %s", "x86_64", arch)
+	}
+	if _, ok := muslArchFromInterp("/lib64/ld-linux-x86-64.so.2"); ok {
+		t.Error("expected glibc loader")
+	}
+}
+
+func TestIsMuslReserved(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"libc.musl-x86_64.so.1": true,
+		"libc.so":               true,
+		"libpthread.so.0":       true,
+		"libm.so.6":             true,
+		"libcrypto.so.3":        false,
+		"libmagic.so.1":         false,
+	} {
+		if actual := isMuslReserved(name); actual != expected {
+			t.Errorf("%s: expected %t, actual %t", name, expected, actual)
+		}
+	}
+}
+
+func TestMuslSysPaths(t *testing.T) {
+	td, err := ioutil.TempDir("", "musl_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	c := NewConfig(sysroot.Root(td))
+	if paths := c.muslSysPaths("x86_64"); !reflect.DeepEqual(paths,
+		muslDefaultPaths) {
+		t.Errorf("expected %s, actual %s", muslDefaultPaths, paths)
+	}
+
+	if err := os.Mkdir(filepath.Join(td, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(td, "etc/ld-musl-x86_64.path"),
+		[]byte("/lib:/usr/local/lib\n/opt/lib\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/lib", "/usr/local/lib", "/opt/lib"}
+	if paths := c.muslSysPaths("x86_64"); !reflect.DeepEqual(paths,
+		expected) {
+		t.Errorf("expected %s, actual %s", expected, paths)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Shared dependency resolver
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// cacheVersion is incremented whenever the format of elfFile changes.
+const cacheVersion = 3
+
+// statEntry and elfEntry memoize the result of a single lookup. The once
+// makes concurrent lookups of the same path wait for the first one.
+type statEntry struct {
+	once sync.Once
+	fi   os.FileInfo
+	err  error
+}
+
+type elfEntry struct {
+	once sync.Once
+	f    *elfFile
+	err  error
+}
+
+// fileCache memoizes file system lookups and parsed ELF headers. Headers are
+// additionally indexed by file identity, so that they can be persisted.
+// Lookups are only kept for a single run.
+type fileCache struct {
+	mu    sync.Mutex
+	stats map[string]*statEntry
+	elfs  map[string]*elfEntry
+	disk  map[string]*elfFile // Loaded from the on-disk cache
+	used  map[string]*elfFile // Looked up during this run
+}
+
+func newFileCache() *fileCache {
+	return &fileCache{
+		stats: make(map[string]*statEntry),
+		elfs:  make(map[string]*elfEntry),
+		disk:  make(map[string]*elfFile),
+		used:  make(map[string]*elfFile),
+	}
+}
+
+// stat is like Root.Stat, but memoizes the result if the configuration
+// belongs to a Resolver.
+func (c *Config) stat(path string) (os.FileInfo, error) {
+	if c.files == nil {
+		return c.Root.Stat(path)
+	}
+	c.files.mu.Lock()
+	e, ok := c.files.stats[path]
+	if !ok {
+		e = &statEntry{}
+		c.files.stats[path] = e
+	}
+	c.files.mu.Unlock()
+	e.once.Do(func() { e.fi, e.err = c.Root.Stat(path) })
+	return e.fi, e.err
+}
+
+// elfFile is like readELFFile, but memoizes the result if the configuration
+// belongs to a Resolver.
+func (c *Config) elfFile(path string) (*elfFile, error) {
+	if c.files == nil {
+		return c.readELFFile(path)
+	}
+	c.files.mu.Lock()
+	e, ok := c.files.elfs[path]
+	if !ok {
+		e = &elfEntry{}
+		c.files.elfs[path] = e
+	}
+	c.files.mu.Unlock()
+	e.once.Do(func() { e.f, e.err = c.cachedELFFile(path) })
+	return e.f, e.err
+}
+
+// cachedELFFile reads the ELF headers of path from the on-disk cache, if the
+// file is unchanged, or from the file itself.
+func (c *Config) cachedELFFile(path string) (*elfFile, error) {
+	fi, err := c.stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := fileKey(fi)
+	if !ok {
+		return c.readELFFile(path)
+	}
+	c.files.mu.Lock()
+	f, found := c.files.disk[key]
+	c.files.mu.Unlock()
+	if !found {
+		if f, err = c.readELFFile(path); err != nil {
+			return nil, err
+		}
+	}
+	c.files.mu.Lock()
+	c.files.used[key] = f
+	c.files.mu.Unlock()
+	return f, nil
+}
+
+// Resolver resolves the dependencies of many binaries, sharing parsed ELF
+// headers and file lookups between them. All methods of the embedded Config
+// use the shared state as well. A Resolver is safe for concurrent use.
+// Parsed headers can be kept across runs with SaveCache and LoadCache, while
+// searching for libraries always checks the file system again.
+type Resolver struct {
+	*Config
+
+	// Workers is the maximum number of binaries resolved in parallel.
+	Workers int
+}
+
+// NewResolver returns a resolver that uses a copy of the configuration c.
+func NewResolver(c *Config) *Resolver {
+	shared := *c
+	shared.files = newFileCache()
+	return &Resolver{Config: &shared, Workers: runtime.NumCPU()}
+}
+
+// ResolveAll returns the dependency graphs of the binaries in filenames, like
+// DependencyGraph, in the same order as filenames. If resolving any of the
+// binaries fails, the first such error is returned.
+func (r *Resolver) ResolveAll(filenames []string) ([]*Library, error) {
+	graphs := make([]*Library, len(filenames))
+	errs := make([]error, len(filenames))
+	workers := r.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				graphs[i], errs[i] = r.DependencyGraph(filenames[i])
+			}
+		}()
+	}
+	for i := range filenames {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return graphs, nil
+}
+
+// cacheFile is the on-disk format of the resolver cache.
+type cacheFile struct {
+	Version int
+	Files   map[string]*elfFile // Keyed by fileKey, nil if not an ELF
+}
+
+// LoadCache reads parsed headers from a cache written by SaveCache. They are
+// used for files with the same device, inode, size and modification time. A
+// missing cache or one written by a different version is not an error.
+func (r *Resolver) LoadCache(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var cf cacheFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return fmt.Errorf("invalid cache %s: %s", filename, err)
+	}
+	if cf.Version != cacheVersion {
+		return nil
+	}
+	r.files.mu.Lock()
+	defer r.files.mu.Unlock()
+	for k, f := range cf.Files {
+		r.files.disk[k] = f
+	}
+	return nil
+}
+
+// SaveCache writes the parsed headers of all files looked up so far to
+// filename. Entries of files that were not looked up are dropped. The results
+// of library searches are not saved.
+func (r *Resolver) SaveCache(filename string) error {
+	r.files.mu.Lock()
+	b, err := json.Marshal(cacheFile{Version: cacheVersion,
+		Files: r.files.used})
+	r.files.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a concurrent run never sees
+	// a partially written cache
+	f, err := ioutil.TempFile(filepath.Dir(filename),
+		"."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
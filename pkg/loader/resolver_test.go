@@ -0,0 +1,121 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Shared dependency resolver tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestResolveAll(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir("testdata"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ImportedLibraries("nc.openbsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(expected)
+
+	r := NewResolver(DefaultConfig)
+	r.Workers = 2
+	graphs, err := r.ResolveAll([]string{"nc.openbsd", "ld.so.conf",
+		"nc.openbsd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 2} {
+		deps := graphs[i].Dependencies()
+		sort.Strings(deps)
+		if !reflect.DeepEqual(deps, expected) {
+			t.Errorf("%d: expected %v, actual %v", i, expected, deps)
+		}
+	}
+	if deps := graphs[1].Dependencies(); len(deps) != 0 {
+		t.Errorf("expected no dependencies for non-ELF, actual %v", deps)
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	td, err := ioutil.TempDir("", "resolver_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	cache := filepath.Join(td, "deps.cache")
+
+	r := NewResolver(DefaultConfig)
+	if err := r.LoadCache(cache); err != nil {
+		t.Errorf("expected missing cache to be ignored, actual %s", err)
+	}
+	nc := filepath.Join("testdata", "nc.openbsd")
+	if _, err := r.ResolveAll([]string{nc}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SaveCache(cache); err != nil {
+		t.Fatal(err)
+	}
+
+	r = NewResolver(DefaultConfig)
+	if err := r.LoadCache(cache); err != nil {
+		t.Fatal(err)
+	}
+	// Headers from the cache are used in place of the file's own
+	fi, err := os.Stat(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := fileKey(fi)
+	f, ok := r.files.disk[key]
+	if !ok || f == nil {
+		t.Fatalf("expected %s in cache", nc)
+	}
+	f.Needed = nil
+	graphs, err := r.ResolveAll([]string{nc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deps := graphs[0].Dependencies(); len(deps) != 1 ||
+		deps[0] != f.Interp {
+		t.Errorf("expected [%s], actual %v", f.Interp, deps)
+	}
+
+	if err := ioutil.WriteFile(cache, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewResolver(DefaultConfig).LoadCache(cache); err == nil {
+		t.Errorf("expected error for invalid cache")
+	}
+}
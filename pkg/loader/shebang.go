@@ -0,0 +1,132 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Script interpreter detection
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+// Maximum length of the "#!" line, see BINPRM_BUF_SIZE in linux/binfmts.h.
+const maxShebang = 256
+
+// Interpreter returns the interpreter and its optional argument as listed in
+// the "#!" line of the script in filename. If the file is not a script,
+// returns empty strings.
+func Interpreter(filename string) (interp, arg string, err error) {
+	return interpreter("", filename)
+}
+
+func interpreter(root sysroot.Root, filename string) (interp, arg string,
+	err error) {
+	f, err := root.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	b := make([]byte, maxShebang)
+	n, _ := f.Read(b) // Ignore errors, short files are not scripts
+	b = b[:n]
+	if !bytes.HasPrefix(b, []byte("#!")) {
+		return
+	}
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[:i]
+	}
+	// Like the kernel, split into interpreter and a single argument
+	line := strings.TrimSpace(string(b[2:]))
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		interp, arg = line[:i], strings.TrimSpace(line[i+1:])
+	} else {
+		interp = line
+	}
+	return
+}
+
+// envCommand returns the command that env(1) would execute for the given
+// arguments. Options and variable assignments are skipped.
+func envCommand(arg string) string {
+	fields := strings.Fields(arg)
+	for i := 0; i < len(fields); i++ {
+		switch f := fields[i]; {
+		case f == "-u" || f == "--unset" || f == "-C" || f == "--chdir":
+			i++ // Skip option argument
+		case strings.HasPrefix(f, "-"), strings.Contains(f, "="):
+			// Includes -S, which only changes how arguments are split
+		default:
+			return f
+		}
+	}
+	return ""
+}
+
+// ScriptInterpreters returns the executables needed to run the script in
+// filename. For scripts that use env(1) to find their interpreter, like
+// "#!/usr/bin/env python3", this includes both env itself and the result of
+// searching paths for the interpreter. Returns an empty list if filename is
+// not a script and an error if the interpreter is not found in paths.
+func ScriptInterpreters(filename string, paths []string) ([]string, error) {
+	return DefaultConfig.ScriptInterpreters(filename, paths)
+}
+
+// ScriptInterpreters is like the function of the same name, but resolves
+// all paths inside the root.
+func (c *Config) ScriptInterpreters(filename string, paths []string) (
+	interps []string, err error) {
+	interp, arg, err := interpreter(c.Root, filename)
+	if err != nil || interp == "" {
+		return
+	}
+	interps = []string{interp}
+	if filepath.Base(interp) != "env" {
+		return
+	}
+	cmd := envCommand(arg)
+	switch {
+	case cmd == "":
+	case strings.Contains(cmd, "/"):
+		interps = append(interps, cmd)
+	default:
+		p := c.findLibrary(cmd, paths, func(path string) bool {
+			fi, err := c.stat(path)
+			return err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0
+		})
+		if p == "" {
+			return nil, fmt.Errorf("%s: interpreter %s not found in %s",
+				filename, cmd,
+				strings.Join(paths, string(filepath.ListSeparator)))
+		}
+		interps = append(interps, p)
+	}
+	return
+}
@@ -0,0 +1,87 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Script interpreter detection tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScriptInterpreters(t *testing.T) {
+	td, err := ioutil.TempDir("", "shebang_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	python := filepath.Join(td, "python3")
+	if err := ioutil.WriteFile(python, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{filepath.Join(td, "nonexistent"), td}
+
+	for _, tc := range []struct {
+		script   string
+		expected []string
+	}{
+		{"#!/bin/sh\necho\n", []string{"/bin/sh"}},
+		{"#! /bin/bash -e\n", []string{"/bin/bash"}},
+		{"#!/usr/bin/env python3\n", []string{"/usr/bin/env", python}},
+		{"#!/usr/bin/env -S PYTHONPATH=. python3 -u\n",
+			[]string{"/usr/bin/env", python}},
+		{"\x7fELF", nil},
+		{"", nil},
+	} {
+		script := filepath.Join(td, "script")
+		if err := ioutil.WriteFile(script, []byte(tc.script),
+			0755); err != nil {
+			t.Fatal(err)
+		}
+		interps, err := ScriptInterpreters(script, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(interps, tc.expected) {
+			t.Errorf("%q: expected %s, actual %s", tc.script, tc.expected,
+				interps)
+		}
+	}
+
+	// Interpreters that env(1) would not find are an error
+	script := filepath.Join(td, "script")
+	if err := ioutil.WriteFile(script,
+		[]byte("#!/usr/bin/env no-such-interpreter\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ScriptInterpreters(script, paths); err == nil {
+		t.Errorf("expected error for missing interpreter, actual nil")
+	}
+}
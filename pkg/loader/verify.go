@@ -0,0 +1,368 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Symbol-level verification of resolved libraries
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Flags of version definitions and needs, see elf.h
+const (
+	verFlagWeak   = 0x2
+	versymHidden  = 0x8000
+	versymIdxMask = 0x7fff
+)
+
+// stbGNUUnique is the binding of symbols that are unique in the whole
+// process, like static members of C++ templates in libstdc++.
+const stbGNUUnique = elf.STB_LOOS
+
+var errInvalidVersion = errors.New("invalid ELF symbol version section")
+
+// Problem describes a symbol or symbol version that a binary needs, but none
+// of the libraries it resolved to provides.
+type Problem struct {
+	Binary  string // Path of the object that needs the symbol or version
+	Library string // Library the version is needed from, if known
+	Symbol  string // Symbol name, empty for version needs
+	Version string // Required version, may be empty
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Symbol == "" && p.Version == "":
+		return fmt.Sprintf("%s: library not found (required by %s)",
+			p.Library, p.Binary)
+	case p.Symbol == "":
+		return fmt.Sprintf("%s: version %s not found (required by %s)",
+			p.Library, p.Version, p.Binary)
+	case p.Version == "":
+		return fmt.Sprintf("%s: undefined symbol: %s", p.Binary, p.Symbol)
+	default:
+		return fmt.Sprintf("%s: undefined symbol: %s, version %s", p.Binary,
+			p.Symbol, p.Version)
+	}
+}
+
+// versionNeed is a version needed from a library, from .gnu.version_r.
+type versionNeed struct {
+	file string
+	name string
+	weak bool
+}
+
+// elfVersions holds the symbol versioning information of an ELF file.
+type elfVersions struct {
+	defs   map[uint16]string      // Index to name, from .gnu.version_d
+	needs  map[uint16]versionNeed // Index to need, from .gnu.version_r
+	versym []uint16               // Version index per dynamic symbol
+}
+
+// cStringAt returns the NUL-terminated string at off in b.
+func cStringAt(b []byte, off uint32) string {
+	if uint64(off) >= uint64(len(b)) {
+		return ""
+	}
+	end := off
+	for end < uint32(len(b)) && b[end] != 0 {
+		end++
+	}
+	return string(b[off:end])
+}
+
+// sectionStrings returns the string table linked from s.
+func sectionStrings(e *elf.File, s *elf.Section) ([]byte, error) {
+	if int(s.Link) >= len(e.Sections) {
+		return nil, errInvalidVersion
+	}
+	return e.Sections[s.Link].Data()
+}
+
+// readELFVersions parses the GNU symbol versioning sections of e. Files
+// without symbol versioning yield empty tables.
+func readELFVersions(e *elf.File) (*elfVersions, error) {
+	v := &elfVersions{
+		defs:  make(map[uint16]string),
+		needs: make(map[uint16]versionNeed),
+	}
+	bo := e.ByteOrder
+	for _, s := range e.Sections {
+		switch s.Type {
+		case elf.SHT_GNU_VERSYM:
+			b, err := s.Data()
+			if err != nil {
+				return nil, err
+			}
+			v.versym = make([]uint16, len(b)/2)
+			for i := range v.versym {
+				v.versym[i] = bo.Uint16(b[2*i:])
+			}
+		case elf.SHT_GNU_VERDEF:
+			b, err := s.Data()
+			if err != nil {
+				return nil, err
+			}
+			str, err := sectionStrings(e, s)
+			if err != nil {
+				return nil, err
+			}
+			// Elf_Verdef is 20 bytes, Elf_Verdaux 8 bytes
+			for off := uint32(0); ; {
+				if uint64(off)+20 > uint64(len(b)) {
+					return nil, errInvalidVersion
+				}
+				d := b[off:]
+				ndx, aux, next := bo.Uint16(d[4:6]), bo.Uint32(d[12:16]),
+					bo.Uint32(d[16:20])
+				if a := uint64(off) + uint64(aux); a+8 <= uint64(len(b)) {
+					v.defs[ndx] = cStringAt(str, bo.Uint32(b[a:a+4]))
+				}
+				if next == 0 {
+					break
+				}
+				off += next
+			}
+		case elf.SHT_GNU_VERNEED:
+			b, err := s.Data()
+			if err != nil {
+				return nil, err
+			}
+			str, err := sectionStrings(e, s)
+			if err != nil {
+				return nil, err
+			}
+			// Elf_Verneed and Elf_Vernaux are both 16 bytes
+			for off := uint32(0); ; {
+				if uint64(off)+16 > uint64(len(b)) {
+					return nil, errInvalidVersion
+				}
+				n := b[off:]
+				cnt, file := bo.Uint16(n[2:4]), cStringAt(str,
+					bo.Uint32(n[4:8]))
+				aoff := uint64(off) + uint64(bo.Uint32(n[8:12]))
+				for i := uint16(0); i < cnt; i++ {
+					if aoff+16 > uint64(len(b)) {
+						return nil, errInvalidVersion
+					}
+					a := b[aoff:]
+					v.needs[bo.Uint16(a[6:8])] = versionNeed{
+						file: file,
+						name: cStringAt(str, bo.Uint32(a[8:12])),
+						weak: bo.Uint16(a[4:6])&verFlagWeak != 0,
+					}
+					aoff += uint64(bo.Uint32(a[12:16]))
+				}
+				next := bo.Uint32(n[12:16])
+				if next == 0 {
+					break
+				}
+				off += next
+			}
+		}
+	}
+	return v, nil
+}
+
+// symbolVersion returns the version index of the i-th dynamic symbol, as
+// returned by elf.File.DynamicSymbols. The table includes the null symbol.
+func (v *elfVersions) symbolVersion(i int) uint16 {
+	if i+1 < len(v.versym) {
+		return v.versym[i+1] & versymIdxMask
+	}
+	return 0
+}
+
+// symbolHidden returns whether the i-th dynamic symbol is the definition of
+// a hidden version, which only references to that version bind to.
+func (v *elfVersions) symbolHidden(i int) bool {
+	return i+1 < len(v.versym) && v.versym[i+1]&versymHidden != 0
+}
+
+// definitions maps the names of defined symbols to their versions. Versions
+// that are only defined hidden map to false.
+type definitions map[string]map[string]bool
+
+// add adds the symbols in syms that other objects can bind to, with their
+// versions from vers.
+func (d definitions) add(syms []elf.Symbol, vers *elfVersions) {
+	for i, s := range syms {
+		if s.Section == elf.SHN_UNDEF {
+			continue
+		}
+		switch elf.ST_BIND(s.Info) {
+		case elf.STB_GLOBAL, elf.STB_WEAK, stbGNUUnique:
+		default:
+			continue
+		}
+		if d[s.Name] == nil {
+			d[s.Name] = make(map[string]bool)
+		}
+		// Indices 0 and 1 denote local and global unversioned symbols
+		var version string
+		if idx := vers.symbolVersion(i); idx > 1 {
+			version = vers.defs[idx]
+		}
+		d[s.Name][version] = d[s.Name][version] || !vers.symbolHidden(i)
+	}
+}
+
+// satisfies returns whether the definitions of name satisfy a reference to
+// it. References without a version bind to any definition that is not
+// hidden, unversioned definitions satisfy any reference.
+func (d definitions) satisfies(name, version string, versioned bool) bool {
+	defs := d[name]
+	if !versioned {
+		for _, visible := range defs {
+			if visible {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := defs[version]
+	return ok || defs[""]
+}
+
+// Verify checks that the libraries resolved for the binary in filename
+// define all undefined symbols and symbol versions that the binary and its
+// libraries need. Like the dynamic loader, symbols may be defined by any
+// library in the graph. Weak references and files that are not ELF are
+// ignored. Libraries that cannot be found are reported as well.
+func (c *Config) Verify(filename string) (problems []Problem, err error) {
+	root, err := c.DependencyGraph(filename)
+	if err != nil {
+		return
+	}
+
+	type object struct {
+		lib  *Library
+		syms []elf.Symbol
+		vers *elfVersions
+	}
+	var objects []object
+	root.Walk(func(l *Library) {
+		if err != nil {
+			return
+		}
+		if l.Missing() {
+			return
+		}
+		for _, n := range l.Needed {
+			if n.Missing() {
+				problems = append(problems, Problem{Binary: l.Path,
+					Library: n.Name})
+			}
+		}
+		p, err2 := c.Root.Path(l.Path)
+		if err2 != nil {
+			err = err2
+			return
+		}
+		e, err2 := elf.Open(p)
+		if err2 != nil {
+			return // Not an ELF, e.g. a script
+		}
+		defer e.Close()
+		o := object{lib: l}
+		if o.syms, err2 = e.DynamicSymbols(); err2 != nil &&
+			err2 != elf.ErrNoSymbols {
+			err = fmt.Errorf("%s: %s", l.Path, err2)
+			return
+		}
+		if o.vers, err2 = readELFVersions(e); err2 != nil {
+			err = fmt.Errorf("%s: %s", l.Path, err2)
+			return
+		}
+		objects = append(objects, o)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect all defined symbols and versions
+	defined := make(definitions)
+	versions := make(map[string]map[string]bool)
+	for _, o := range objects {
+		vs := make(map[string]bool)
+		for _, name := range o.vers.defs {
+			vs[name] = true
+		}
+		versions[o.lib.Name] = vs
+		defined.add(o.syms, o.vers)
+	}
+
+	for _, o := range objects {
+		needs := make(map[string]map[string]bool) // File to versions
+		for _, n := range o.vers.needs {
+			if n.weak {
+				continue
+			}
+			if needs[n.file] == nil {
+				needs[n.file] = make(map[string]bool)
+			}
+			needs[n.file][n.name] = true
+		}
+		for file, names := range needs {
+			vs, ok := versions[file]
+			if !ok {
+				continue // Missing library, already reported
+			}
+			for name := range names {
+				if !vs[name] {
+					problems = append(problems, Problem{Binary: o.lib.Path,
+						Library: file, Version: name})
+				}
+			}
+		}
+
+		for i, s := range o.syms {
+			if s.Section != elf.SHN_UNDEF || s.Name == "" ||
+				elf.ST_BIND(s.Info) == elf.STB_WEAK {
+				continue
+			}
+			n, versioned := o.vers.needs[o.vers.symbolVersion(i)]
+			if defined.satisfies(s.Name, n.name, versioned) {
+				continue
+			}
+			if _, ok := defined[s.Name]; !ok || !versioned {
+				problems = append(problems, Problem{Binary: o.lib.Path,
+					Symbol: s.Name})
+				continue
+			}
+			problems = append(problems, Problem{Binary: o.lib.Path,
+				Library: n.file, Symbol: s.Name, Version: n.name})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].String() < problems[j].String()
+	})
+	return
+}
@@ -0,0 +1,158 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Symbol-level verification tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package loader
+
+import (
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blichmann.eu/code/jailtime/pkg/sysroot"
+)
+
+func TestVerify(t *testing.T) {
+	problems, err := DefaultConfig.Verify("testdata/nc.openbsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("expected no problems, actual: %s", p)
+	}
+}
+
+func TestVerifyUnsatisfied(t *testing.T) {
+	const interp = "/lib64/ld-linux-x86-64.so.2"
+	loader, err := ioutil.ReadFile(interp)
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := ioutil.ReadFile("testdata/nc.openbsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td, err := ioutil.TempDir("", "verify_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// Use the dynamic loader in place of libc, which lacks most symbols
+	for name, b := range map[string][]byte{
+		"bin/nc":                         nc,
+		interp[1:]:                       loader,
+		"lib/x86_64-linux-gnu/libc.so.6": loader,
+	} {
+		p := filepath.Join(td, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewConfig(sysroot.Root(td))
+	c.SearchPaths = []string{"/lib/x86_64-linux-gnu"}
+	problems, err := c.Verify("/bin/nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var haveMissingLib, haveUndefined bool
+	for _, p := range problems {
+		t.Log(p)
+		if p.Library == "libbsd.so.0" && p.Symbol == "" && p.Version == "" {
+			haveMissingLib = true
+		}
+		if p.Binary == "/bin/nc" && p.Symbol == "__libc_start_main" {
+			haveUndefined = true
+		}
+	}
+	if !haveMissingLib {
+		t.Error("expected libbsd.so.0 to be reported as missing")
+	}
+	if !haveUndefined {
+		t.Error("expected __libc_start_main to be reported as undefined")
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	// The null symbol is not part of the symbols, but of the versions
+	vers := &elfVersions{
+		defs:   map[uint16]string{2: "LIB_1", 3: "LIB_2"},
+		versym: []uint16{0, 1, 1, 1, 1, 2, 3 | versymHidden},
+	}
+	const text = elf.SectionIndex(1)
+	syms := []elf.Symbol{
+		{Name: "global", Section: text,
+			Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)},
+		{Name: "unique", Section: text,
+			Info: elf.ST_INFO(stbGNUUnique, elf.STT_OBJECT)},
+		{Name: "local", Section: text,
+			Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_FUNC)},
+		{Name: "undefined", Section: elf.SHN_UNDEF,
+			Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)},
+		{Name: "versioned", Section: text,
+			Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)},
+		{Name: "versioned", Section: text,
+			Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)},
+	}
+	d := make(definitions)
+	d.add(syms, vers)
+	for _, test := range []struct {
+		name, version string
+		versioned     bool
+		expected      bool
+	}{
+		{"global", "", false, true},
+		{"global", "LIB_1", true, true},
+		{"unique", "", false, true},
+		{"local", "", false, false},
+		{"undefined", "", false, false},
+		{"versioned", "", false, true},
+		{"versioned", "LIB_1", true, true},
+		{"versioned", "LIB_3", true, false},
+		// Hidden versions only satisfy references to them
+		{"versioned", "LIB_2", true, true},
+	} {
+		if actual := d.satisfies(test.name, test.version,
+			test.versioned); actual != test.expected {
+			t.Errorf("%s@%s: expected %t, actual %t", test.name,
+				test.version, test.expected, actual)
+		}
+	}
+
+	// Hidden definitions alone do not satisfy unversioned references
+	d = make(definitions)
+	d.add(syms[5:], &elfVersions{defs: vers.defs,
+		versym: []uint16{0, 3 | versymHidden}})
+	if d.satisfies("versioned", "", false) {
+		t.Error("expected hidden definition to be skipped")
+	}
+}
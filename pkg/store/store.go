@@ -0,0 +1,370 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Content-addressed store of files shared between jails
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package store implements a content-addressed store for files that many
+// jails have in common. Files are kept once, named by the SHA-256 hash of
+// their contents, and hard linked into each jail.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"blichmann.eu/code/jailtime/pkg/copy"
+)
+
+// Store is a directory with objects, which hold file contents, and
+// manifests, which record the objects that each jail uses.
+type Store struct {
+	dir string
+}
+
+// Open opens the store in dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	for _, d := range []string{"objects", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{dir}, nil
+}
+
+// Hash returns the SHA-256 hash of the contents of the file filename, in
+// hexadecimal.
+func Hash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// objectPath returns the path of the object with the hash sum.
+func (s *Store) objectPath(sum string) string {
+	return filepath.Join(s.dir, "objects", sum[:2], sum[2:])
+}
+
+// shareable returns whether a file with the attributes in fi may be shared
+// between jails. Files that others may write to are not, as a change in one
+// jail would show up in all of them.
+func shareable(fi os.FileInfo) bool {
+	return fi.Mode().Perm()&0022 == 0
+}
+
+// sameAttributes returns whether both files have the same mode, owner and
+// modification time, so that a jail cannot tell one from the other. Linking
+// files with different times would change the time of one of them, which
+// --preserve=timestamps and --incremental rely on.
+func sameAttributes(a, b os.FileInfo) bool {
+	if a.Mode() != b.Mode() || !a.ModTime().Equal(b.ModTime()) {
+		return false
+	}
+	uidA, gidA, ok := fileOwner(a)
+	uidB, gidB, okB := fileOwner(b)
+	return ok && okB && uidA == uidB && gidA == gidB
+}
+
+// cannotLink returns whether err means that a hard link cannot be created,
+// because the files are on different file systems or the kernel does not
+// allow it.
+func cannotLink(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	switch err {
+	case syscall.EXDEV, syscall.EPERM, syscall.EMLINK:
+		return true
+	}
+	return false
+}
+
+// Add puts the regular file at path into the store and returns the hash of
+// its contents. If the store already has an object with the same contents,
+// mode, owner and modification time, path is replaced by a hard link to it.
+// Otherwise, path becomes the object. Files that others may write to, or that
+// are on a different file system than the store, are never hard linked.
+// Instead, the object is a separate copy that others cannot write to, and
+// path is replaced by a clone of it if the file system supports it.
+func (s *Store) Add(path string) (string, error) {
+	sum, err := Hash(path)
+	if err != nil {
+		return "", err
+	}
+	return sum, s.AddHashed(path, sum)
+}
+
+// AddHashed is like Add, for a file whose hash is already known, as
+// returned by Hash.
+func (s *Store) AddHashed(path, sum string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", path)
+	}
+	obj := s.objectPath(sum)
+	if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+		return err
+	}
+	for {
+		ofi, err := os.Lstat(obj)
+		if os.IsNotExist(err) {
+			if shareable(fi) {
+				err = os.Link(path, obj)
+				if os.IsExist(err) {
+					continue // Added concurrently
+				} else if !cannotLink(err) {
+					return err
+				}
+			}
+			_, err = copy.File(path, obj, &copy.Options{
+				Reflink:  copy.ReflinkAuto,
+				Preserve: copy.PreserveAll,
+			})
+			if err == nil && !shareable(fi) {
+				err = os.Chmod(obj, fi.Mode()&^0022)
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		if os.SameFile(fi, ofi) {
+			return nil
+		}
+		if shareable(fi) && sameAttributes(fi, ofi) {
+			err = replaceWithLink(obj, path)
+			if !cannotLink(err) {
+				return err
+			}
+		}
+		return replaceWithClone(obj, path)
+	}
+}
+
+// tempPath returns a name for a temporary file that replaces path.
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+
+		".store")
+}
+
+// replaceWithLink atomically replaces path with a hard link to obj.
+func replaceWithLink(obj, path string) error {
+	t := tempPath(path)
+	os.Remove(t) // Left over from an earlier run
+	if err := os.Link(obj, t); err != nil {
+		return err
+	}
+	if err := os.Rename(t, path); err != nil {
+		os.Remove(t)
+		return err
+	}
+	return nil
+}
+
+// replaceWithClone replaces path with a clone of obj that keeps the
+// attributes of path. If obj cannot be cloned, path is left as it is.
+func replaceWithClone(obj, path string) error {
+	t := tempPath(path)
+	if _, err := copy.File(obj, t, &copy.Options{
+		Reflink:           copy.ReflinkAlways,
+		RemoveDestination: true,
+	}); err != nil {
+		os.Remove(t)
+		return nil // Keep the existing copy
+	}
+	err := copy.Attributes(path, t, copy.PreserveAll)
+	if err == nil {
+		err = os.Rename(t, path)
+	}
+	if err != nil {
+		os.Remove(t)
+	}
+	return err
+}
+
+// Manifest records the SHA-256 hash of each regular file in a jail, which
+// is also the name of its object in the store. It is written in the format
+// of sha256sum(1), with paths relative to the jail, so that
+// 'sha256sum --check' can verify the jail from inside of it. A comment in
+// the first line names the jail.
+type Manifest struct {
+	Jail  string            // Absolute path of the jail
+	Files map[string]string // Hashes by path inside the jail
+}
+
+// manifestPath returns the path of the manifest for jail.
+func (s *Store) manifestPath(jail string) string {
+	h := sha256.Sum256([]byte(jail))
+	return filepath.Join(s.dir, "manifests", hex.EncodeToString(h[:]))
+}
+
+// parseManifest parses a manifest. Lines that start with '#' are comments,
+// except for the one that names the jail.
+func parseManifest(r io.Reader) (*Manifest, error) {
+	m := &Manifest{Files: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.HasPrefix(text, "# jail ") {
+			m.Jail = text[len("# jail "):]
+			continue
+		} else if strings.HasPrefix(text, "#") {
+			continue
+		}
+		// sha256sum(1) marks files read in binary mode with '*'
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != 2*sha256.Size ||
+			!strings.HasPrefix(fields[1], " ") &&
+				!strings.HasPrefix(fields[1], "*") {
+			return nil, fmt.Errorf("line %d: expected hash and path", line)
+		}
+		m.Files["/"+fields[1][1:]] = fields[0]
+	}
+	return m, scanner.Err()
+}
+
+// ReadManifestFile reads the manifest in filename. If it does not exist, it
+// returns an empty one.
+func ReadManifestFile(filename string) (*Manifest, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return &Manifest{Files: make(map[string]string)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := parseManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return m, nil
+}
+
+// WriteFile replaces the file filename with the manifest m.
+func (m *Manifest) WriteFile(filename string) error {
+	paths := make([]string, 0, len(m.Files))
+	for p := range m.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# jail %s\n", m.Jail)
+	for _, p := range paths {
+		fmt.Fprintf(&b, "%s  %s\n", m.Files[p], strings.TrimPrefix(p, "/"))
+	}
+	return copy.WriteFile(filename, b.Bytes(), 0644, nil)
+}
+
+// ReadManifest returns the manifest that was last written to the store for
+// jail. If there is none, it returns an empty one.
+func (s *Store) ReadManifest(jail string) (*Manifest, error) {
+	m, err := ReadManifestFile(s.manifestPath(jail))
+	if err != nil {
+		return nil, err
+	}
+	m.Jail = jail
+	return m, nil
+}
+
+// WriteManifest replaces the manifest of the jail in m in the store. The
+// files in it keep their objects from being removed by GC.
+func (s *Store) WriteManifest(m *Manifest) error {
+	return m.WriteFile(s.manifestPath(m.Jail))
+}
+
+// GC removes objects that no jail uses anymore and returns the number of
+// bytes freed. Manifests of jails that no longer exist are removed first.
+// Objects that no manifest refers to are kept if they are still hard
+// linked somewhere else, like into a jail that is being built. Each file
+// that is removed is passed to removed. With dryRun, nothing is removed.
+func (s *Store) GC(dryRun bool, removed func(path string)) (int64, error) {
+	manifests := filepath.Join(s.dir, "manifests")
+	fis, err := ioutil.ReadDir(manifests)
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[string]bool)
+	for _, fi := range fis {
+		name := filepath.Join(manifests, fi.Name())
+		m, err := ReadManifestFile(name)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := os.Stat(m.Jail); os.IsNotExist(err) {
+			removed(name)
+			if !dryRun {
+				if err := os.Remove(name); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+		for _, sum := range m.Files {
+			used[sum] = true
+		}
+	}
+
+	var freed int64
+	objects := filepath.Join(s.dir, "objects")
+	err = filepath.Walk(objects, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil || !fi.Mode().IsRegular() ||
+			strings.HasPrefix(fi.Name(), ".") { // Still being written
+			return err
+		}
+		sum := filepath.Base(filepath.Dir(path)) + fi.Name()
+		if used[sum] {
+			return nil
+		}
+		if linkCount(fi) > 1 {
+			return nil
+		}
+		removed(path)
+		freed += fi.Size()
+		if dryRun {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	return freed, err
+}
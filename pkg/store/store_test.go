@@ -0,0 +1,279 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Content-addressed store tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var modTime = time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// writeFiles creates files with the given contents and mode in dir. All of
+// them have the same modification time.
+func writeFiles(t *testing.T, dir string, files map[string]string,
+	mode os.FileMode) {
+	t.Helper()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		// Not affected by the umask
+		if err := os.Chmod(filepath.Join(dir, name), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, name), modTime,
+			modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sameFile returns whether a and b are hard links to the same file.
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	fa, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(fa, fb)
+}
+
+func TestAdd(t *testing.T) {
+	td, err := ioutil.TempDir("", "store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	s, err := Open(filepath.Join(td, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, td, map[string]string{"a": "shared", "b": "shared",
+		"c": "other"}, 0755)
+	writeFiles(t, td, map[string]string{"w": "shared"}, 0666)
+	writeFiles(t, td, map[string]string{"m": "shared"}, 0755)
+	later := modTime.Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(td, "m"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	sums := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "w", "m"} {
+		sum, err := s.Add(filepath.Join(td, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums[name] = sum
+	}
+	if sums["a"] != sums["b"] || sums["a"] != sums["w"] ||
+		sums["a"] == sums["c"] {
+		t.Errorf("expected equal hashes for equal contents, actual %v", sums)
+	}
+	a, b := filepath.Join(td, "a"), filepath.Join(td, "b")
+	if !sameFile(t, a, b) || !sameFile(t, a, s.objectPath(sums["a"])) {
+		t.Error("expected a and b to be linked to the same object")
+	}
+	if sameFile(t, a, filepath.Join(td, "c")) {
+		t.Error("expected c to be a different object")
+	}
+	if sameFile(t, a, filepath.Join(td, "w")) {
+		t.Error("expected writable file not to be linked")
+	}
+	if sameFile(t, a, filepath.Join(td, "m")) {
+		t.Error("expected file with another time not to be linked")
+	}
+	for name, expected := range map[string]time.Time{"a": modTime,
+		"m": later} {
+		if fi, err := os.Stat(filepath.Join(td, name)); err != nil {
+			t.Fatal(err)
+		} else if !fi.ModTime().Equal(expected) {
+			t.Errorf("%s: expected %s, actual %s", name, expected,
+				fi.ModTime())
+		}
+	}
+	b2, err := ioutil.ReadFile(filepath.Join(td, "w"))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(b2) != "shared" {
+		t.Errorf("expected %s, actual %s", "shared", b2)
+	}
+
+	// Adding again changes nothing
+	if sum, err := s.Add(a); err != nil {
+		t.Fatal(err)
+	} else if sum != sums["a"] {
+		t.Errorf("expected %s, actual %s", sums["a"], sum)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	td, err := ioutil.TempDir("", "store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	s, err := Open(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sum = "2c26b46b68ffc68ff99b453c1d304134" +
+		"13422d706483bfa0f98a5e886266e7ae"
+	expected := &Manifest{Jail: "/srv/jails/some user",
+		Files: map[string]string{"/bin/with space": sum, "/bin/sh": sum}}
+	if err := s.WriteManifest(expected); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := s.ReadManifest(expected.Jail); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, actual %v", expected, actual)
+	}
+	if m, err := s.ReadManifest("/no/such/jail"); err != nil {
+		t.Fatal(err)
+	} else if len(m.Files) != 0 {
+		t.Errorf("expected empty manifest, actual %v", m)
+	}
+
+	// Manifests are in the format of sha256sum(1)
+	filename := filepath.Join(td, "jail.sha256")
+	if err := expected.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	const text = "# jail /srv/jails/some user\n" +
+		sum + "  bin/sh\n" +
+		sum + "  bin/with space\n"
+	if b, err := ioutil.ReadFile(filename); err != nil {
+		t.Fatal(err)
+	} else if string(b) != text {
+		t.Errorf("expected %q, actual %q", text, b)
+	}
+	for _, test := range []struct {
+		text     string
+		expected map[string]string
+	}{
+		{"# comment\n" + sum + " *bin/sh\n",
+			map[string]string{"/bin/sh": sum}},
+		{sum + " bin/sh\n", nil},
+		{"abc  bin/sh\n", nil},
+	} {
+		err := ioutil.WriteFile(filename, []byte(test.text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ReadManifestFile(filename)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected error", test.text)
+			}
+		} else if err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(m.Files, test.expected) {
+			t.Errorf("expected %v, actual %v", test.expected, m.Files)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	td, err := ioutil.TempDir("", "store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	s, err := Open(filepath.Join(td, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jails := []string{filepath.Join(td, "jail1"), filepath.Join(td, "jail2")}
+	for i, content := range []string{"one", "two"} {
+		if err := os.Mkdir(jails[i], 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, jails[i], map[string]string{"file": content,
+			"common": "common"}, 0644)
+		m := &Manifest{Jail: jails[i], Files: make(map[string]string)}
+		for _, name := range []string{"file", "common"} {
+			sum, err := s.Add(filepath.Join(jails[i], name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Files["/"+name] = sum
+		}
+		if err := s.WriteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var removed []string
+	collect := func(path string) { removed = append(removed, path) }
+	if _, err := s.GC(false, collect); err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 0 {
+		t.Errorf("expected nothing to be removed, actual %v", removed)
+	}
+
+	// Objects only used by a removed jail go away, shared ones stay
+	if err := os.RemoveAll(jails[1]); err != nil {
+		t.Fatal(err)
+	}
+	freed, err := s.GC(true, collect)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 2 || freed != 3 {
+		t.Errorf("expected manifest and one object, actual %v (%d bytes)",
+			removed, freed)
+	}
+	for _, path := range removed {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept with dry run", path)
+		}
+	}
+	removed = nil
+	if _, err := s.GC(false, collect); err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 2 {
+		t.Errorf("expected manifest and one object, actual %v", removed)
+	}
+	if sum, err := Hash(filepath.Join(jails[0], "common")); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(s.objectPath(sum)); err != nil {
+		t.Errorf("expected shared object to be kept: %s", err)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Path resolution inside a root directory
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package sysroot resolves paths relative to a root directory, similar to
+// how the kernel resolves paths after chroot(2). Absolute symlinks and ".."
+// components never lead outside of the root.
+package sysroot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Root is a directory that acts as the root directory for path lookups. The
+// empty Root refers to the host's root directory, in which case all paths
+// are used as-is.
+type Root string
+
+// Maximum number of symlinks to follow, same as MAXSYMLINKS on Linux.
+const maxSymlinks = 40
+
+var errTooManyLinks = errors.New("too many levels of symbolic links")
+
+// resolve returns the host path for path inside r. Symlinks are resolved as
+// if r was the root directory. If followFinal is false, the final path
+// component is not resolved, like lstat(2) does.
+func (r Root) resolve(path string, followFinal bool) (string, error) {
+	if r == "" {
+		return path, nil
+	}
+	resolved := "/"
+	todo := strings.Split(path, "/")
+	for links := 0; len(todo) > 0; {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, c)
+		if len(todo) == 0 && !followFinal {
+			resolved = next
+			break
+		}
+		fi, err := os.Lstat(filepath.Join(string(r), next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// Paths that do not exist are resolved lexically
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", &os.PathError{Op: "resolve", Path: path,
+				Err: errTooManyLinks}
+		}
+		value, err := os.Readlink(filepath.Join(string(r), next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(value) {
+			resolved = "/"
+		}
+		todo = append(strings.Split(value, "/"), todo...)
+	}
+	return filepath.Join(string(r), resolved), nil
+}
+
+// Path returns the host path for path inside r with all symlinks resolved.
+func (r Root) Path(path string) (string, error) {
+	return r.resolve(path, true)
+}
+
+// LinkPath returns the host path for path inside r like Path, but does not
+// resolve a symlink in the final path component.
+func (r Root) LinkPath(path string) (string, error) {
+	return r.resolve(path, false)
+}
+
+// Open opens the file at path inside r for reading.
+func (r Root) Open(path string) (*os.File, error) {
+	p, err := r.Path(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// Stat returns file information for path inside r, following symlinks.
+func (r Root) Stat(path string) (os.FileInfo, error) {
+	p, err := r.Path(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+// Lstat returns file information for path inside r. If the file is a
+// symlink, it describes the link itself.
+func (r Root) Lstat(path string) (os.FileInfo, error) {
+	p, err := r.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+// Readlink returns the value of the symlink at path inside r.
+func (r Root) Readlink(path string) (string, error) {
+	p, err := r.resolve(path, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+// Glob returns the paths inside r that match pattern, see filepath.Glob.
+// Only the final path component of pattern may contain wildcards.
+func (r Root) Glob(pattern string) ([]string, error) {
+	if r == "" {
+		return filepath.Glob(pattern)
+	}
+	dir, base := filepath.Split(filepath.Join("/", pattern))
+	p, err := r.Path(dir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := filepath.Glob(filepath.Join(p, base))
+	for i := range m {
+		m[i] = filepath.Join(dir, filepath.Base(m[i]))
+	}
+	return m, err
+}
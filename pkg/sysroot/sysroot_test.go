@@ -0,0 +1,100 @@
+/*
+ * jailtime version 0.8
+ * Copyright (c)2015-2023 Christian Blichmann
+ *
+ * Path resolution tests
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sysroot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	td, err := ioutil.TempDir("", "sysroot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// Merged /usr layout with an absolute symlink for the loader
+	for _, d := range []string{"usr/lib", "lib64"} {
+		if err := os.MkdirAll(filepath.Join(td, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(td, "usr/lib/ld.so"), nil,
+		0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, value := range map[string]string{
+		"lib":          "usr/lib",
+		"lib64/ld.so":  "/lib/ld.so",
+		"lib64/escape": "../../../../..",
+	} {
+		if err := os.Symlink(value, filepath.Join(td, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := Root(td)
+	for _, tc := range []struct{ path, expected string }{
+		{"/lib64/ld.so", "/usr/lib/ld.so"},
+		{"/lib/../lib64", "/usr/lib64"}, // Like the kernel, ".." follows "lib"
+		{"/lib64/escape/etc/passwd", "/etc/passwd"},
+		{"/no/such/file", "/no/such/file"},
+	} {
+		p, err := r.Path(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := filepath.Join(td, tc.expected); p != expected {
+			t.Errorf("%s: expected %s, actual %s", tc.path, expected, p)
+		}
+	}
+
+	if p, err := r.LinkPath("/lib/../lib64/ld.so"); err != nil {
+		t.Fatal(err)
+	} else if expected := filepath.Join(td, "usr/lib64/ld.so"); p != expected {
+		t.Errorf("expected %s, actual %s", expected, p)
+	}
+
+	if fi, err := r.Lstat("/lib64/ld.so"); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("expected symlink")
+	}
+	if _, err := r.Stat("/lib64/ld.so"); err != nil {
+		t.Error(err)
+	}
+
+	if p, err := Root("").Path("/lib64/ld.so"); err != nil {
+		t.Fatal(err)
+	} else if p != "/lib64/ld.so" {
+		t.Errorf("expected %s, actual %s", "/lib64/ld.so", p)
+	}
+}